@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	goFlags "github.com/jessevdk/go-flags"
+	"github.com/miekg/dns"
 )
 
 // Options represents console arguments
@@ -54,18 +56,55 @@ type Options struct {
 	// Cache size value
 	CacheSizeBytes int `short:"e" long:"cache-size" description:"Cache size (in bytes). Default: 64k"`
 
+	// Redis-compatible server to keep the cache in
+	CacheRedis string `long:"cache-redis" description:"Address (host:port) of a Redis-compatible server to keep the DNS cache in. Allows several dnsproxy instances to share one cache"`
+
+	// If true, identical in-flight requests share one upstream exchange
+	CoalesceRequests bool `long:"coalesce-requests" description:"If specified, identical requests received at the same time share one upstream exchange" optional:"yes" optional-value:"true"`
+
 	// If true, refuse ANY requests
 	RefuseAny bool `short:"a" long:"refuse-any" description:"If specified, refuse ANY requests" optional:"yes" optional-value:"true"`
 
 	// DNS upstreams
 	Upstreams []string `short:"u" long:"upstream" description:"An upstream to be used (can be specified multiple times)" required:"true"`
 
+	// Proxy server for the upstream connections
+	UpstreamProxy string `long:"upstream-proxy" description:"Proxy server URL for the upstream connections: socks5://[user:password@]host[:port] or http://[user:password@]host[:port]. Plain DNS upstreams must use tcp://"`
+
+	// Local IP address or network interface for the upstream connections
+	UpstreamBind string `long:"upstream-bind" description:"Local IP address or network interface name (Linux only) the upstream connections are sent from"`
+
+	// ODoH relay for the odoh:// upstreams
+	ODoHRelay string `long:"odoh-relay" description:"Relay URL or DNS stamp for the Oblivious DNS-over-HTTPS upstreams"`
+
+	// Dial the IPv6 addresses of the upstreams first
+	UpstreamPreferIPv6 bool `long:"upstream-prefer-ipv6" description:"If specified, the IPv6 addresses of the upstreams are dialed first" optional:"yes" optional-value:"true"`
+
+	// Randomize the query name case for the plain DNS upstreams
+	UpstreamRandomizeCase bool `long:"upstream-randomize-case" description:"If specified, the case of the query names sent to the plain DNS upstreams over UDP is randomized (0x20)" optional:"yes" optional-value:"true"`
+
+	// Anonymization relays for the DNSCrypt upstreams
+	DNSCryptRelays []string `long:"dnscrypt-relay" description:"Anonymization relay (DNS stamp or IP:port) for the DNSCrypt upstreams (can be specified multiple times)"`
+
 	// Fallback DNS resolver
 	Fallbacks []string `short:"f" long:"fallback" description:"Fallback resolvers to use when regular ones are unavailable, can be specified multiple times"`
 
 	// If true, parallel queries to all configured upstream servers
 	AllServers bool `short:"s" long:"all-servers" description:"If specified, parallel queries to all configured upstream servers are enabled" optional:"yes" optional-value:"true"`
 
+	// Upstream selection strategies
+	UpstreamStrategies []string `long:"upstream-strategy" description:"Order in which the upstreams are tried: lowest_latency (default), round_robin, weighted_random or strict_order. Use [/domain1/../domainN/]<strategy> syntax to set the strategy of the domain-specific upstreams (can be specified multiple times)"`
+
+	// If true, the answer contains the only IP address that was the fastest to connect to
+	FastestAddr bool `long:"fastest-addr" description:"If specified, A and AAAA requests are sent to all upstreams and the response contains the IP address that was the fastest to connect to (over TCP port 80 or 443)" optional:"yes" optional-value:"true"`
+
+	// Hedged requests
+	HedgeDelay    int  `long:"hedge-delay" description:"Delay (in milliseconds) after which the request is also sent to the next upstream if the previous one hasn't answered yet. Disabled if not set" default:"0"`
+	HedgeAdaptive bool `long:"hedge-adaptive" description:"If specified, the hedging delay of an upstream is the 95th percentile of its recent response times, but not more than --hedge-delay" optional:"yes" optional-value:"true"`
+
+	// Response codes that are considered as failures
+	FallbackRcodes []string `long:"fallback-rcode" description:"Response code (e.g. SERVFAIL or REFUSED) after which the next upstream or the fallback is tried (can be specified multiple times)"`
+
 	// If true, all AAAA requests will be replied with NoError RCode and empty answer
 	IPv6Disabled bool `short:"d" long:"ipv6-disabled" description:"If specified, all AAAA requests will be replied with NoError RCode and empty answer" optional:"yes" optional-value:"true"`
 
@@ -75,6 +114,17 @@ type Options struct {
 	// Use Custom EDNS Client Address
 	EDNSAddr string `long:"edns-addr" description:"Send EDNS Client Address"`
 
+	// Admin API listen address
+	AdminAddr string `long:"admin-addr" description:"Listen address (host:port) for the admin HTTP API that allows inspecting and flushing the cache. Listens on 127.0.0.1 if the host is not set. Disabled if not set"`
+
+	// Admin API token
+	AdminToken string `long:"admin-token" description:"Token that the admin HTTP API requests must have in the 'Authorization: Bearer <token>' header. Required if the admin API listens on a non-loopback address"`
+
+	// Upstreams health checking
+	HealthCheckInterval int    `long:"health-check-interval" description:"Interval (in seconds) between the upstreams health probes. Health checking is disabled if not set" default:"0"`
+	HealthCheckName     string `long:"health-check-name" description:"Domain name that is resolved by the upstreams health probes" default:"ipv4only.arpa"`
+	HealthCheckFailures int    `long:"health-check-failures" description:"Number of consecutive failures that take an upstream out of rotation until a health probe succeeds" default:"3"`
+
 	// Print DNSProxy version (just for the help)
 	Version bool `long:"version" description:"Prints the program version"`
 }
@@ -153,8 +203,26 @@ func createProxyConfig(options Options) proxy.Config {
 		log.Fatalf("cannot parse %s", options.ListenAddr)
 	}
 
+	// --upstream-bind is either an IP address or a network interface name
+	var sourceIP net.IP
+	var iface string
+	if options.UpstreamBind != "" {
+		sourceIP = net.ParseIP(options.UpstreamBind)
+		if sourceIP == nil {
+			iface = options.UpstreamBind
+		}
+	}
+
 	// Init upstreams
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(options.Upstreams, options.BootstrapDNS, defaultTimeout)
+	upstreamConfig, err := proxy.ParseUpstreamsConfigEx(options.Upstreams, options.BootstrapDNS, defaultTimeout, func(address string, opts upstream.Options) (upstream.Upstream, error) {
+		opts.Proxy = options.UpstreamProxy
+		opts.SourceIP, opts.Interface = sourceIP, iface
+		opts.ODoHRelay = options.ODoHRelay
+		opts.DNSCryptRelays = options.DNSCryptRelays
+		opts.PreferIPv6 = options.UpstreamPreferIPv6
+		opts.RandomizeCase = options.UpstreamRandomizeCase
+		return upstream.AddressToUpstream(address, opts)
+	})
 	if err != nil {
 		log.Fatalf("error while parsing upstreams configuration: %s", err)
 	}
@@ -166,9 +234,31 @@ func createProxyConfig(options Options) proxy.Config {
 		Ratelimit:                options.Ratelimit,
 		CacheEnabled:             options.Cache,
 		CacheSizeBytes:           options.CacheSizeBytes,
+		CoalesceRequests:         options.CoalesceRequests,
 		RefuseAny:                options.RefuseAny,
 		AllServers:               options.AllServers,
+		FastestAddr:              options.FastestAddr,
+		HedgeDelay:               time.Duration(options.HedgeDelay) * time.Millisecond,
+		HedgeAdaptive:            options.HedgeAdaptive,
 		EnableEDNSClientSubnet:   options.EnableEDNSSubnet,
+		HealthCheckInterval:      time.Duration(options.HealthCheckInterval) * time.Second,
+		HealthCheckName:          options.HealthCheckName,
+		HealthCheckFailures:      options.HealthCheckFailures,
+	}
+
+	for _, r := range options.FallbackRcodes {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(r)]
+		if !ok {
+			log.Fatalf("unknown response code: %s", r)
+		}
+		config.FallbackRcodes = append(config.FallbackRcodes, rcode)
+	}
+
+	if len(options.UpstreamStrategies) > 0 {
+		config.UpstreamStrategy, config.DomainsReservedStrategies, err = proxy.ParseUpstreamStrategies(options.UpstreamStrategies)
+		if err != nil {
+			log.Fatalf("error while parsing upstream strategies: %s", err)
+		}
 	}
 
 	if options.EDNSAddr != "" {
@@ -186,7 +276,17 @@ func createProxyConfig(options Options) proxy.Config {
 	if options.Fallbacks != nil {
 		fallbacks := []upstream.Upstream{}
 		for i, f := range options.Fallbacks {
-			fallback, err := upstream.AddressToUpstream(f, upstream.Options{Timeout: defaultTimeout})
+			opts := upstream.Options{
+				Timeout:        defaultTimeout,
+				Proxy:          options.UpstreamProxy,
+				SourceIP:       sourceIP,
+				Interface:      iface,
+				ODoHRelay:      options.ODoHRelay,
+				DNSCryptRelays: options.DNSCryptRelays,
+				PreferIPv6:     options.UpstreamPreferIPv6,
+				RandomizeCase:  options.UpstreamRandomizeCase,
+			}
+			fallback, err := upstream.AddressToUpstream(f, opts)
 			if err != nil {
 				log.Fatalf("cannot parse the fallback %s (%s): %s", f, options.BootstrapDNS, err)
 			}
@@ -213,6 +313,19 @@ func createProxyConfig(options Options) proxy.Config {
 		config.HTTPSListenAddr = &net.TCPAddr{Port: options.HTTPSListenPort, IP: listenIP}
 	}
 
+	if options.CacheRedis != "" {
+		config.CacheStorage = proxy.NewRedisCacheStorage(options.CacheRedis, "dnsproxy:", defaultTimeout)
+	}
+
+	if options.AdminAddr != "" {
+		adminAddr, err := net.ResolveTCPAddr("tcp", options.AdminAddr)
+		if err != nil {
+			log.Fatalf("cannot parse the admin address %s: %s", options.AdminAddr, err)
+		}
+		config.AdminListenAddr = adminAddr
+		config.AdminToken = options.AdminToken
+	}
+
 	// Init TCP and UDP listen addresses if listen port is not equal to zero
 	if options.ListenPort > 0 {
 		config.UDPListenAddr = &net.UDPAddr{Port: options.ListenPort, IP: listenIP}
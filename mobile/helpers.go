@@ -1,6 +1,7 @@
 package mobile
 
 import (
+	"encoding/hex"
 	"errors"
 	"strings"
 	"time"
@@ -16,6 +17,11 @@ type DNSStamp struct {
 	ServerAddr   string // Server address
 	ProviderName string // Provider name
 	Path         string // Path (for DOH)
+	ServerPK     []byte // DNSCrypt provider's public key (for DNSCrypt)
+	Hashes       string // Hex-encoded SHA-256 hashes of the certificates separated by a newline (for DOH and DOT)
+	DNSSEC       bool   // The server does the DNSSEC validation
+	NoLog        bool   // The server doesn't record logs
+	NoFilter     bool   // The server doesn't intentionally block domains
 }
 
 // ParseDNSStamp parses a DNS stamp string and returns a stamp instance or an error
@@ -25,14 +31,62 @@ func ParseDNSStamp(stampStr string) (*DNSStamp, error) {
 		return nil, err
 	}
 
+	hashes := make([]string, 0, len(serverStamp.Hashes))
+	for _, hash := range serverStamp.Hashes {
+		hashes = append(hashes, hex.EncodeToString(hash))
+	}
+
 	return &DNSStamp{
 		Proto:        int(serverStamp.Proto),
 		ServerAddr:   serverStamp.ServerAddrStr,
 		ProviderName: serverStamp.ProviderName,
 		Path:         serverStamp.Path,
+		ServerPK:     serverStamp.ServerPk,
+		Hashes:       strings.Join(hashes, "\n"),
+		DNSSEC:       serverStamp.Props&dnsstamps.ServerInformalPropertyDNSSEC != 0,
+		NoLog:        serverStamp.Props&dnsstamps.ServerInformalPropertyNoLog != 0,
+		NoFilter:     serverStamp.Props&dnsstamps.ServerInformalPropertyNoFilter != 0,
 	}, nil
 }
 
+// String returns the sdns:// stamp string or an empty string if the protocol or the hashes are invalid
+// Use upstream.AddressToStamp to create a stamp from an upstream address.
+func (s *DNSStamp) String() string {
+	serverStamp := dnsstamps.ServerStamp{
+		Proto:         dnsstamps.StampProtoType(s.Proto),
+		ServerAddrStr: s.ServerAddr,
+		ProviderName:  s.ProviderName,
+		Path:          s.Path,
+		ServerPk:      s.ServerPK,
+	}
+	for _, line := range strings.Split(s.Hashes, "\n") {
+		if line == "" {
+			continue
+		}
+		hash, err := hex.DecodeString(line)
+		if err != nil {
+			return ""
+		}
+		serverStamp.Hashes = append(serverStamp.Hashes, hash)
+	}
+	if s.DNSSEC {
+		serverStamp.Props |= dnsstamps.ServerInformalPropertyDNSSEC
+	}
+	if s.NoLog {
+		serverStamp.Props |= dnsstamps.ServerInformalPropertyNoLog
+	}
+	if s.NoFilter {
+		serverStamp.Props |= dnsstamps.ServerInformalPropertyNoFilter
+	}
+
+	switch serverStamp.Proto {
+	case dnsstamps.StampProtoTypePlain, dnsstamps.StampProtoTypeDNSCrypt, dnsstamps.StampProtoTypeDoH, dnsstamps.StampProtoTypeTLS:
+		return serverStamp.String()
+	}
+	// dnsstamps panics on the unsupported protocols
+	return ""
+}
+
 // TestUpstream checks if upstream is valid and available
 // If it is, no error is returned. Otherwise this method returns an error with an explanation.
 // * address - see upstream.AddressToUpstream for examples
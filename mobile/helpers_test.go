@@ -16,6 +16,34 @@ func TestParseDNSStamp(t *testing.T) {
 		stamp.Proto != 0x01 {
 		t.Fatalf("wrong stamp data: %v", stamp)
 	}
+
+	if stamp.String() != stampStr {
+		t.Fatalf("wrong stamp string: %s", stamp.String())
+	}
+}
+
+func TestDNSStampString(t *testing.T) {
+	stamp := &DNSStamp{
+		Proto:        0x02,
+		ServerAddr:   "176.103.130.130",
+		ProviderName: "dns.adguard.com",
+		Path:         "/dns-query",
+		Hashes:       "0102\n0304",
+		NoLog:        true,
+	}
+	parsed, err := ParseDNSStamp(stamp.String())
+	if err != nil {
+		t.Fatalf("cannot fail: %s", err)
+	}
+	if parsed.ProviderName != stamp.ProviderName || parsed.Path != stamp.Path ||
+		parsed.Hashes != stamp.Hashes || !parsed.NoLog || parsed.DNSSEC {
+		t.Fatalf("wrong stamp data: %v", parsed)
+	}
+
+	stamp.Proto = 0x05
+	if stamp.String() != "" {
+		t.Fatalf("unsupported protocol must not be encoded")
+	}
 }
 
 func TestTestUpstream(t *testing.T) {
@@ -53,6 +53,7 @@ type Config struct {
 	Timeout           int    // Default timeout for all resolvers (milliseconds)
 	CacheSizeBytes    int    // Cache size (in bytes). Default: 64k
 	AllServers        bool   // If true, parallel queries to all configured upstream servers are enabled
+	UpstreamStrategy  string // Upstream selection strategy: lowest_latency (default), round_robin, weighted_random or strict_order
 	MaxGoroutines     int    // Maximum number of parallel goroutines that process the requests
 	SystemResolvers   string // A list of system resolvers for ipv6-only network (each on new line). We need to specify it to use dns.Client instead of default net.Resolver
 	DetectDNS64Prefix bool   // If true, DNS64 prefix detection is enabled
@@ -312,6 +313,14 @@ func createConfig(config *Config) (*proxy.Config, error) {
 		Ratelimit:      0,
 	}
 
+	if config.UpstreamStrategy != "" {
+		strategy, err := proxy.NewUpstreamStrategy(config.UpstreamStrategy)
+		if err != nil {
+			return nil, err
+		}
+		proxyConfig.UpstreamStrategy = strategy
+	}
+
 	if config.Fallbacks != "" {
 		fallbacks := []upstream.Upstream{}
 		lines = strings.Split(config.Fallbacks, "\n")
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// Admin HTTP API
+//
+// GET  /cache                                 -- list the cached responses
+// POST /cache/flush                           -- flush the whole cache
+// POST /cache/flush?name=example.org          -- flush the responses for the specified name
+// POST /cache/flush?name=org&subdomains=true  -- flush the responses for the name and all its subdomains
+// GET  /stats                                 -- proxy statistics
+// GET  /upstreams/health                      -- upstreams health state (see Config.HealthCheckInterval)
+// GET  /upstreams/stats                       -- upstreams counters (see Proxy.UpstreamStats)
+//
+// The API can flush the cache and reveals the queried names so it must not be exposed to untrusted networks:
+// the listener binds to loopback unless the address is set explicitly, and a non-loopback address requires
+// Config.AdminToken.
+
+// AdminHandler returns the http.Handler that serves the admin HTTP API
+// It is used by the admin listener (see Config.AdminListenAddr), but can also be mounted elsewhere.
+// If Config.AdminToken is set, the requests without it are rejected.
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache", p.handleAdminCache)
+	mux.HandleFunc("/cache/flush", p.handleAdminCacheFlush)
+	mux.HandleFunc("/stats", p.handleAdminStats)
+	mux.HandleFunc("/upstreams/health", p.handleAdminUpstreamHealth)
+	mux.HandleFunc("/upstreams/stats", p.handleAdminUpstreamStats)
+	if p.AdminToken == "" {
+		return mux
+	}
+
+	expected := []byte("Bearer " + p.AdminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// AdminAddr returns the admin API listen address or nil if the proxy does not listen to it
+func (p *Proxy) AdminAddr() net.Addr {
+	p.RLock()
+	defer p.RUnlock()
+	if p.adminListen == nil {
+		return nil
+	}
+	return p.adminListen.Addr()
+}
+
+// validateAdminConfig defaults the admin API address to loopback and verifies that
+// a non-loopback address is protected with a token.
+// It is called before any listener is created so that Start does not leave them open on error.
+func (p *Proxy) validateAdminConfig() error {
+	if p.AdminListenAddr == nil {
+		return nil
+	}
+
+	if p.AdminListenAddr.IP == nil {
+		addr := *p.AdminListenAddr
+		addr.IP = net.IPv4(127, 0, 0, 1)
+		p.AdminListenAddr = &addr
+	}
+	if !p.AdminListenAddr.IP.IsLoopback() && p.AdminToken == "" {
+		return fmt.Errorf("admin API on a non-loopback address %s requires a token", p.AdminListenAddr.IP)
+	}
+	return nil
+}
+
+// startAdminListener starts serving the admin HTTP API
+func (p *Proxy) startAdminListener() error {
+	log.Printf("Creating the admin HTTP server")
+	adminListen, err := net.ListenTCP("tcp", p.AdminListenAddr)
+	if err != nil {
+		return errorx.Decorate(err, "could not start admin listener")
+	}
+	p.adminListen = adminListen
+	p.adminServer = &http.Server{
+		Handler:           p.AdminHandler(),
+		ReadHeaderTimeout: defaultTimeout,
+		WriteTimeout:      defaultTimeout,
+	}
+	log.Printf("Listening to admin API on http://%s", p.adminListen.Addr())
+
+	go func(srv *http.Server, l net.Listener) {
+		err := srv.Serve(l)
+		if err != http.ErrServerClosed {
+			log.Printf("Admin HTTP server was closed unexpectedly: %s", err)
+		} else {
+			log.Printf("Admin HTTP server was closed")
+		}
+	}(p.adminServer, p.adminListen)
+
+	return nil
+}
+
+// handleAdminCache lists the cached responses
+func (p *Proxy) handleAdminCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, p.CacheEntries())
+}
+
+// handleAdminCacheFlush flushes either the whole cache or the responses for the specified name
+func (p *Proxy) handleAdminCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	name := q.Get("name")
+	subdomains := false
+	if s := q.Get("subdomains"); s != "" {
+		var err error
+		subdomains, err = strconv.ParseBool(s)
+		if err != nil {
+			http.Error(w, "invalid subdomains value: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+
+	removed := 0
+	if name == "" {
+		removed = p.FlushCache()
+	} else {
+		removed = p.FlushCacheName(name, subdomains)
+	}
+	writeAdminJSON(w, map[string]int{"removed": removed})
+}
+
+// adminStats is the response of the GET /stats admin API method
+type adminStats struct {
+	Cache      CacheStats      `json:"cache"`
+	Coalescing CoalescingStats `json:"coalescing"`
+}
+
+// handleAdminStats returns the proxy statistics
+func (p *Proxy) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, adminStats{
+		Cache:      p.CacheStats(),
+		Coalescing: p.CoalescingStats(),
+	})
+}
+
+// handleAdminUpstreamHealth returns the upstreams health state
+func (p *Proxy) handleAdminUpstreamHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	health := p.UpstreamHealth()
+	if health == nil {
+		health = []UpstreamHealth{}
+	}
+	writeAdminJSON(w, health)
+}
+
+// handleAdminUpstreamStats returns the upstreams counters
+func (p *Proxy) handleAdminUpstreamStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, p.UpstreamStats())
+}
+
+// writeAdminJSON writes the specified value to the admin API client
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("couldn't marshal admin API response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminCache(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.AdminListenAddr = &net.TCPAddr{Port: 0, IP: net.ParseIP(listenIP)}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		_ = dnsProxy.Stop()
+	}()
+
+	for _, host := range []string{"example.org.", "www.example.org.", "example.net."} {
+		reply := dns.Msg{}
+		reply.SetQuestion(host, dns.TypeA)
+		reply.Response = true
+		reply.Answer = []dns.RR{newRR(host + " 3600 IN A 1.1.1.1")}
+		dnsProxy.cache.Set(&reply)
+	}
+
+	baseURL := fmt.Sprintf("http://%s", dnsProxy.AdminAddr())
+
+	// list
+	resp, err := http.Get(baseURL + "/cache")
+	assert.Nil(t, err)
+	var entries []CacheEntry
+	assert.Nil(t, readAdminJSON(resp, &entries))
+	assert.Equal(t, 3, len(entries))
+
+	// wrong method
+	resp, err = http.Get(baseURL + "/cache/flush")
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// flush a name with subdomains
+	resp, err = http.Post(baseURL+"/cache/flush?name=example.org&subdomains=true", "", nil)
+	assert.Nil(t, err)
+	result := map[string]int{}
+	assert.Nil(t, readAdminJSON(resp, &result))
+	assert.Equal(t, 2, result["removed"])
+
+	// flush everything
+	resp, err = http.Post(baseURL+"/cache/flush", "", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, readAdminJSON(resp, &result))
+	assert.Equal(t, 1, result["removed"])
+	assert.Equal(t, 0, len(dnsProxy.CacheEntries()))
+}
+
+func TestAdminToken(t *testing.T) {
+	// pick a free port so that we can check it is not left open
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(listenIP)})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	udpAddr := l.LocalAddr().(*net.UDPAddr)
+	_ = l.Close()
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UDPListenAddr = udpAddr
+	dnsProxy.TCPListenAddr = &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port}
+	dnsProxy.AdminListenAddr = &net.TCPAddr{Port: 0, IP: net.IPv4zero}
+
+	// a token is required for a non-loopback address
+	assert.NotNil(t, dnsProxy.Start())
+	_ = dnsProxy.Stop()
+
+	// and the DNS listeners are not created
+	l, err = net.ListenUDP("udp", udpAddr)
+	assert.Nil(t, err)
+	if l != nil {
+		_ = l.Close()
+	}
+	tl, err := net.ListenTCP("tcp", dnsProxy.TCPListenAddr)
+	assert.Nil(t, err)
+	if tl != nil {
+		_ = tl.Close()
+	}
+
+	// loopback is used if the IP is not set
+	dnsProxy = createTestProxy(t, nil)
+	dnsProxy.AdminListenAddr = &net.TCPAddr{Port: 0}
+	dnsProxy.AdminToken = "secret"
+	err = dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		_ = dnsProxy.Stop()
+	}()
+	assert.True(t, dnsProxy.AdminAddr().(*net.TCPAddr).IP.IsLoopback())
+
+	url := fmt.Sprintf("http://%s/stats", dnsProxy.AdminAddr())
+	for token, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, token)
+	}
+}
+
+func readAdminJSON(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
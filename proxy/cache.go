@@ -7,7 +7,6 @@ import (
 	"sync"
 	"time"
 
-	glcache "github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
@@ -15,9 +14,10 @@ import (
 const defaultCacheSize = 64 * 1024 // in bytes
 
 type cache struct {
-	items        glcache.Cache // cache
-	cacheSize    int           // cache size (in bytes)
-	sync.RWMutex               // lock
+	storage      CacheStorage // storage for the cached responses (lazily initialized LRU storage if nil)
+	cacheSize    int          // cache size (in bytes), used for the default storage only
+	stats        cacheStats   // cache counters
+	sync.RWMutex              // lock
 }
 
 func (c *cache) Get(request *dns.Msg) (*dns.Msg, bool) {
@@ -26,22 +26,24 @@ func (c *cache) Get(request *dns.Msg) (*dns.Msg, bool) {
 	}
 	// create key for request
 	key := key(request)
-	c.Lock()
-	if c.items == nil {
-		c.Unlock()
+	storage := c.getStorage()
+	if storage == nil {
+		c.stats.miss()
 		return nil, false
 	}
-	c.Unlock()
-	data := c.items.Get(key)
+	data := storageGet(storage, key)
 	if data == nil {
+		c.stats.miss()
 		return nil, false
 	}
 
 	res := unpackResponse(data, request)
 	if res == nil {
-		c.items.Del(key)
+		c.stats.expired()
+		c.del(key)
 		return nil, false
 	}
+	c.stats.hit()
 	return res, true
 }
 
@@ -49,41 +51,162 @@ func (c *cache) Set(m *dns.Msg) {
 	if m == nil {
 		return // no-op
 	}
-	if !isCacheable(m) {
+	if ok, reason := isCacheable(m); !ok {
+		c.stats.reject(reason)
 		return
 	}
 	key := key(m)
 
 	c.Lock()
 	// lazy initialization for cache
-	if c.items == nil {
-		conf := glcache.Config{
-			MaxSize:   defaultCacheSize,
-			EnableLRU: true,
+	if c.storage == nil {
+		c.storage = newLRUStorage(c.cacheSize, c.onDelete)
+	}
+	storage := c.storage
+	c.Unlock()
+
+	storageSet(storage, key, m)
+}
+
+// getStorage returns the cache storage (nil if the cache is empty and uninitialized)
+func (c *cache) getStorage() CacheStorage {
+	c.RLock()
+	defer c.RUnlock()
+	return c.storage
+}
+
+// onDelete is called by the LRU storage when it evicts an item
+func (c *cache) onDelete(_ []byte) {
+	c.stats.evict()
+}
+
+// del removes the item with the specified key
+func (c *cache) del(key []byte) {
+	storage := c.getStorage()
+	if storage == nil {
+		return
+	}
+	err := storage.Delete(key)
+	if err != nil {
+		log.Debug("failed to delete a cached response: %s", err)
+	}
+}
+
+// clear removes all the items from the cache and returns their number
+func (c *cache) clear() int {
+	storage := c.getStorage()
+	if storage == nil {
+		return 0
+	}
+	keys := storageKeys(storage)
+	for _, key := range keys {
+		c.del(key)
+	}
+	return len(keys)
+}
+
+// delName removes the items for the specified lowercase FQDN (and its subdomains if subdomains is true)
+// and returns their number. The names are read from the keys so the responses are not unpacked.
+func (c *cache) delName(name string, subdomains bool) int {
+	storage := c.getStorage()
+	if storage == nil {
+		return 0
+	}
+	n := 0
+	for _, key := range storageKeys(storage) {
+		if len(key) > 5 && matchCacheName(string(key[5:]), name, subdomains) {
+			c.del(key)
+			n++
 		}
-		if c.cacheSize > 0 {
-			conf.MaxSize = uint(c.cacheSize)
+	}
+	return n
+}
+
+// list returns all the items that are currently stored in the cache.
+// Expired items are removed instead.
+func (c *cache) list() []cacheItem {
+	storage := c.getStorage()
+	if storage == nil {
+		return nil
+	}
+
+	items := []cacheItem{}
+	for _, key := range storageKeys(storage) {
+		item, ok := newCacheItem(key, storageGet(storage, key))
+		if !ok {
+			c.del(key)
+			continue
 		}
-		c.items = glcache.New(conf)
+		items = append(items, item)
 	}
-	c.Unlock()
+	return items
+}
 
+// storageGet reads the data from the cache storage (nil if not found or failed)
+func storageGet(storage CacheStorage, key []byte) []byte {
+	data, err := storage.Get(key)
+	if err != nil {
+		log.Debug("failed to get a cached response: %s", err)
+		return nil
+	}
+	return data
+}
+
+// storageSet packs the response and puts it to the cache storage
+func storageSet(storage CacheStorage, key []byte, m *dns.Msg) {
 	data := packResponse(m)
-	_ = c.items.Set(key, data)
+	ttl := time.Duration(findLowestTTL(m)) * time.Second
+	err := storage.Set(key, data, ttl)
+	if err != nil {
+		log.Debug("failed to cache a response: %s", err)
+	}
 }
 
+// storageKeys returns the keys of all the items in the cache storage
+func storageKeys(storage CacheStorage) [][]byte {
+	keys, err := storage.Keys()
+	if err != nil {
+		log.Printf("failed to list the cached responses: %s", err)
+		return nil
+	}
+	return keys
+}
+
+// storageSize returns the number of items in the cache storage and their size (in bytes)
+// Zeroes are returned if the storage can't tell its size
+func storageSize(storage CacheStorage) (int, int) {
+	if s, ok := storage.(cacheStorageSize); ok {
+		return s.Size()
+	}
+	return 0, 0
+}
+
+// Reasons for not caching a response (see isCacheable)
+const (
+	notCacheableTruncated = "truncated"    // truncated response
+	notCacheableQuestions = "questions"    // wrong number of questions
+	notCacheableTTL       = "zero_ttl"     // zero or no TTL
+	notCacheableRcode     = "rcode"        // response code other than NOERROR or NXDOMAIN
+	notCacheableNoAnswer  = "no_answer"    // NOERROR response to A/AAAA with no answers
+	notCacheableNoIP      = "no_ip_answer" // NOERROR response to A/AAAA with no A and AAAA answers
+
+	// the subnets index is full (see maxSubnetIndexSize), subnet cache only
+	notCacheableIndexFull = "subnet_index_full"
+)
+
 // check if message is cacheable
-func isCacheable(m *dns.Msg) bool {
+// If it's not, the reason is returned as well
+func isCacheable(m *dns.Msg) (bool, string) {
 	// truncated messages aren't valid
 	if m.Truncated {
 		log.Tracef("Refusing to cache truncated message")
-		return false
+		return false, notCacheableTruncated
 	}
 
 	// if has wrong number of questions, also don't cache
 	if len(m.Question) != 1 {
 		log.Tracef("Refusing to cache message with wrong number of questions")
-		return false
+		return false, notCacheableQuestions
 	}
 
 	qName := m.Question[0].Name
@@ -91,19 +214,19 @@ func isCacheable(m *dns.Msg) bool {
 
 	ttl := findLowestTTL(m)
 	if ttl == 0 {
-		return false
+		return false, notCacheableTTL
 	}
 
 	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
 		log.Tracef("%s: refusing to cache message with response type %s", qName, dns.RcodeToString[m.Rcode])
-		return false
+		return false, notCacheableRcode
 	}
 
 	if m.Rcode == dns.RcodeSuccess && (qType == dns.TypeA || qType == dns.TypeAAAA) {
 		// Now verify that it contains at least one A or AAAA record
 		if len(m.Answer) == 0 {
 			log.Tracef("%s: refusing to cache a NOERROR response with no answers", qName)
-			return false
+			return false, notCacheableNoAnswer
 		}
 
 		found := false
@@ -116,11 +239,11 @@ func isCacheable(m *dns.Msg) bool {
 
 		if !found {
 			log.Tracef("%s: refusing to cache a response with no A and AAAA answers", qName)
-			return false
+			return false, notCacheableNoIP
 		}
 	}
 
-	return true
+	return true, ""
 }
 
 func findLowestTTL(m *dns.Msg) uint32 {
@@ -204,8 +327,13 @@ func packResponse(m *dns.Msg) []byte {
 	return d
 }
 
-// Return nil if response has expired
+// Return nil if response has expired or can't be unpacked
+// (the data comes from the cache storage that may be shared with other applications)
 func unpackResponse(data []byte, request *dns.Msg) *dns.Msg {
+	if len(data) < 4 {
+		return nil
+	}
+
 	now := time.Now().Unix()
 	expire := binary.BigEndian.Uint32(data[:4])
 	if int64(expire) <= now {
@@ -247,3 +375,32 @@ func unpackResponse(data []byte, request *dns.Msg) *dns.Msg {
 	}
 	return &res
 }
+
+// cacheItem is a DNS response read from the cache along with its key
+type cacheItem struct {
+	key []byte   // cache key
+	msg *dns.Msg // cached DNS response
+	ttl uint32   // remaining TTL (in seconds)
+}
+
+// newCacheItem unpacks the data stored in the cache (see packResponse)
+// Returns false if the data is invalid or has expired
+func newCacheItem(key []byte, data []byte) (cacheItem, bool) {
+	if len(data) < 4 {
+		return cacheItem{}, false
+	}
+
+	now := time.Now().Unix()
+	expire := binary.BigEndian.Uint32(data[:4])
+	if int64(expire) <= now {
+		return cacheItem{}, false
+	}
+
+	m := &dns.Msg{}
+	err := m.Unpack(data[4:])
+	if err != nil || len(m.Question) != 1 {
+		return cacheItem{}, false
+	}
+
+	return cacheItem{key: key, msg: m, ttl: expire - uint32(now)}, true
+}
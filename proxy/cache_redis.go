@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+const (
+	redisMaxIdleConns = 8       // maximum number of idle connections to the Redis server kept by redisStorage
+	redisMaxBulkLen   = 1 << 20 // maximum length of the bulk strings, the cached responses and keys are much shorter
+	redisMaxArrayLen  = 1 << 16 // maximum number of the array elements, SCAN returns about COUNT keys at once
+)
+
+// redisStorage is a CacheStorage that keeps the cached responses in a Redis-compatible server.
+// It allows multiple proxy instances to share a single cache.
+// Only the basic commands are used: GET, SET with PX, DEL and SCAN.
+type redisStorage struct {
+	addr    string        // server address (host:port)
+	prefix  string        // prefix for all keys
+	timeout time.Duration // dial and I/O timeout
+
+	conns      []*redisConn // idle connections
+	connsMutex sync.Mutex   // protects conns
+}
+
+// redisConn is a connection to the Redis server
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply returned by the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// NewRedisCacheStorage creates a CacheStorage that keeps the cached responses in a Redis-compatible server
+// addr -- server address (host:port)
+// prefix -- prefix for all the keys (i.e. "dnsproxy:"). Proxies that share the cache must use the same prefix.
+// timeout -- dial and I/O timeout
+func NewRedisCacheStorage(addr string, prefix string, timeout time.Duration) CacheStorage {
+	return &redisStorage{
+		addr:    addr,
+		prefix:  prefix,
+		timeout: timeout,
+	}
+}
+
+// Get implements the CacheStorage interface for *redisStorage
+func (s *redisStorage) Get(key []byte) ([]byte, error) {
+	reply, err := s.do("GET", s.key(key))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, nil
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected GET reply %v", reply)
+	}
+	return data, nil
+}
+
+// Set implements the CacheStorage interface for *redisStorage
+func (s *redisStorage) Set(key []byte, val []byte, ttl time.Duration) error {
+	ms := int64(ttl / time.Millisecond)
+	if ms <= 0 {
+		return nil // would expire right away
+	}
+	_, err := s.do("SET", s.key(key), val, []byte("PX"), []byte(strconv.FormatInt(ms, 10)))
+	return err
+}
+
+// Delete implements the CacheStorage interface for *redisStorage
+func (s *redisStorage) Delete(key []byte) error {
+	_, err := s.do("DEL", s.key(key))
+	return err
+}
+
+// Keys implements the CacheStorage interface for *redisStorage
+func (s *redisStorage) Keys() ([][]byte, error) {
+	pattern := []byte(escapeRedisPattern(s.prefix) + "*")
+	keys := [][]byte{}
+	cursor := []byte("0")
+	for {
+		reply, err := s.do("SCAN", cursor, []byte("MATCH"), pattern, []byte("COUNT"), []byte("1000"))
+		if err != nil {
+			return nil, err
+		}
+
+		arr, ok := reply.([]interface{})
+		if !ok || len(arr) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply %v", reply)
+		}
+		next, ok1 := arr[0].([]byte)
+		found, ok2 := arr[1].([]interface{})
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply %v", reply)
+		}
+
+		for _, k := range found {
+			if b, ok := k.([]byte); ok && len(b) >= len(s.prefix) {
+				keys = append(keys, b[len(s.prefix):])
+			}
+		}
+
+		if string(next) == "0" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// key adds the prefix to the key
+func (s *redisStorage) key(key []byte) []byte {
+	k := make([]byte, 0, len(s.prefix)+len(key))
+	k = append(k, s.prefix...)
+	return append(k, key...)
+}
+
+// do sends a command to the server and reads the reply
+func (s *redisStorage) do(cmd string, args ...[]byte) (interface{}, error) {
+	conn, err := s.getConn()
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't connect to redis server %s", s.addr)
+	}
+
+	if s.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+
+	err = writeRedisCommand(conn, cmd, args...)
+	if err != nil {
+		conn.Close()
+		return nil, errorx.Decorate(err, "couldn't send %s to redis server %s", cmd, s.addr)
+	}
+
+	reply, err := readRedisReply(conn.r)
+	if err != nil {
+		if _, ok := err.(redisError); ok {
+			// the error reply has been read completely, the connection is still usable
+			s.putConn(conn)
+			return nil, err
+		}
+		conn.Close()
+		return nil, errorx.Decorate(err, "couldn't read %s reply from redis server %s", cmd, s.addr)
+	}
+
+	s.putConn(conn)
+	return reply, nil
+}
+
+// getConn returns an idle connection or creates a new one
+func (s *redisStorage) getConn() (*redisConn, error) {
+	s.connsMutex.Lock()
+	if n := len(s.conns); n > 0 {
+		c := s.conns[n-1]
+		s.conns = s.conns[:n-1]
+		s.connsMutex.Unlock()
+		return c, nil
+	}
+	s.connsMutex.Unlock()
+
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// putConn returns the connection to the pool of idle connections
+func (s *redisStorage) putConn(c *redisConn) {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+	if len(s.conns) >= redisMaxIdleConns {
+		c.Close()
+		return
+	}
+	s.conns = append(s.conns, c)
+}
+
+// writeRedisCommand writes the command as a RESP array of bulk strings
+func writeRedisCommand(w io.Writer, cmd string, args ...[]byte) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)+1), 10)
+	buf = append(buf, '\r', '\n')
+	buf = appendRedisBulk(buf, []byte(cmd))
+	for _, a := range args {
+		buf = appendRedisBulk(buf, a)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendRedisBulk(buf []byte, b []byte) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(b)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, b...)
+	return append(buf, '\r', '\n')
+}
+
+// readRedisReply reads a RESP reply
+// Simple strings and bulk strings are returned as []byte, integers as int64, arrays as []interface{}.
+// Null replies are returned as nil, error replies as redisError.
+// Any other error (including an error reply inside an array) means that the reply is not read completely.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: invalid reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := readRedisLen(line, redisMaxBulkLen)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := readRedisLen(line, redisMaxArrayLen)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		arr := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := readRedisReply(r)
+			if err != nil {
+				// the rest of the array is not read
+				return nil, errorx.Decorate(err, "redis: invalid array element")
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+}
+
+// readRedisLen parses the length of a bulk string or an array from its header line
+// -1 means the null reply, the other negative lengths and the lengths larger than max are invalid.
+func readRedisLen(line string, max int) (int, error) {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return 0, err
+	}
+	if n < -1 || n > max {
+		return 0, fmt.Errorf("redis: invalid length %d", n)
+	}
+	return n, nil
+}
+
+// escapeRedisPattern escapes the glob-style pattern special characters
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRedisServer is a minimal in-memory stand-in for a Redis server
+// It supports GET, SET (with PX), DEL and SCAN (with MATCH, the whole keyspace is returned at once)
+type testRedisServer struct {
+	listener net.Listener
+	items    map[string][]byte
+	expire   map[string]time.Time
+	sync.Mutex
+}
+
+func startTestRedisServer(t *testing.T) *testRedisServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot start the redis server: %s", err)
+	}
+	s := &testRedisServer{listener: l, items: map[string][]byte{}, expire: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		v, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		args, ok := v.([]interface{})
+		if !ok || len(args) == 0 {
+			return
+		}
+		cmd := []string{}
+		for _, a := range args {
+			cmd = append(cmd, string(a.([]byte)))
+		}
+		_, err = conn.Write(s.handle(cmd))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *testRedisServer) handle(cmd []string) []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	for k, e := range s.expire {
+		if time.Now().After(e) {
+			delete(s.items, k)
+			delete(s.expire, k)
+		}
+	}
+
+	switch cmd[0] {
+	case "GET":
+		v, ok := s.items[cmd[1]]
+		if !ok {
+			return []byte("$-1\r\n")
+		}
+		return appendRedisBulk(nil, v)
+	case "SET":
+		s.items[cmd[1]] = []byte(cmd[2])
+		if len(cmd) == 5 && cmd[3] == "PX" {
+			ms, _ := strconv.Atoi(cmd[4])
+			s.expire[cmd[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return []byte("+OK\r\n")
+	case "DEL":
+		_, ok := s.items[cmd[1]]
+		delete(s.items, cmd[1])
+		delete(s.expire, cmd[1])
+		if ok {
+			return []byte(":1\r\n")
+		}
+		return []byte(":0\r\n")
+	case "SCAN":
+		keys := [][]byte{}
+		for k := range s.items {
+			if ok, _ := path.Match(cmd[3], k); ok {
+				keys = append(keys, []byte(k))
+			}
+		}
+		reply := []byte("*2\r\n")
+		reply = appendRedisBulk(reply, []byte("0"))
+		reply = append(reply, []byte("*"+strconv.Itoa(len(keys))+"\r\n")...)
+		for _, k := range keys {
+			reply = appendRedisBulk(reply, k)
+		}
+		return reply
+	}
+	return []byte("-ERR unknown command\r\n")
+}
+
+func TestRedisCacheStorage(t *testing.T) {
+	srv := startTestRedisServer(t)
+	defer srv.listener.Close()
+
+	storage := NewRedisCacheStorage(srv.listener.Addr().String(), "test:", time.Second)
+
+	val, err := storage.Get([]byte("key\x00\x01"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+
+	assert.Nil(t, storage.Set([]byte("key\x00\x01"), []byte("value\r\n"), time.Minute))
+	assert.Nil(t, storage.Set([]byte("expiring"), []byte("value"), 100*time.Millisecond))
+
+	val, err = storage.Get([]byte("key\x00\x01"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value\r\n"), val)
+
+	keys, err := storage.Keys()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+
+	time.Sleep(200 * time.Millisecond)
+	val, err = storage.Get([]byte("expiring"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+
+	assert.Nil(t, storage.Delete([]byte("key\x00\x01")))
+	keys, err = storage.Keys()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(keys))
+
+	// server is unavailable
+	storage = NewRedisCacheStorage("127.0.0.1:1", "test:", time.Second)
+	_, err = storage.Get([]byte("key"))
+	assert.NotNil(t, err)
+}
+
+func TestSharedCacheStorage(t *testing.T) {
+	srv := startTestRedisServer(t)
+	defer srv.listener.Close()
+	addr := srv.listener.Addr().String()
+
+	u := &testUpstream{aResp: newRR("host. 60 IN A 1.2.3.4").(*dns.A)}
+
+	// two proxies share the same redis server
+	proxies := []*Proxy{{}, {}}
+	for _, p := range proxies {
+		p.CacheEnabled = true
+		p.CacheStorage = NewRedisCacheStorage(addr, "dnsproxy:", time.Second)
+		p.Upstreams = []upstream.Upstream{u}
+		p.Init()
+	}
+
+	d := &DNSContext{Req: createHostTestMessage("host")}
+	assert.Nil(t, proxies[0].Resolve(d))
+	assert.False(t, d.FromCache)
+
+	// served from the cache filled by the first proxy
+	d = &DNSContext{Req: createHostTestMessage("host")}
+	assert.Nil(t, proxies[1].Resolve(d))
+	assert.True(t, d.FromCache)
+	assert.True(t, getIPFromResponse(d.Res).Equal(net.IP{1, 2, 3, 4}))
+	assert.Equal(t, 1, len(proxies[1].CacheEntries()))
+
+	// flushed by the second proxy -- gone for the first one too
+	assert.Equal(t, 1, proxies[1].FlushCacheName("host", false))
+	d = &DNSContext{Req: createHostTestMessage("host")}
+	assert.Nil(t, proxies[0].Resolve(d))
+	assert.False(t, d.FromCache)
+}
+
+func TestReadRedisReply(t *testing.T) {
+	read := func(data string) (interface{}, error) {
+		return readRedisReply(bufio.NewReader(strings.NewReader(data)))
+	}
+
+	v, err := read("*2\r\n$1\r\n0\r\n:5\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{[]byte("0"), int64(5)}, v)
+	v, err = read("$-1\r\n")
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+
+	// the top-level error reply is read completely
+	_, err = read("-ERR failed\r\n")
+	assert.Equal(t, redisError("ERR failed"), err)
+
+	// the nested one is not
+	_, err = read("*2\r\n-ERR failed\r\n$1\r\n0\r\n")
+	assert.NotNil(t, err)
+	_, ok := err.(redisError)
+	assert.False(t, ok)
+
+	// invalid lengths
+	for _, data := range []string{"$-2\r\n", "*-5\r\n", "$2147483647\r\n", "*1000000000\r\n"} {
+		_, err = read(data)
+		assert.NotNil(t, err, data)
+	}
+}
+
+func TestRedisNestedError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = readRedisReply(bufio.NewReader(conn))
+		_, _ = conn.Write([]byte("*2\r\n-ERR failed\r\n$1\r\n0\r\n"))
+		time.Sleep(time.Second)
+	}()
+
+	// the connection with the unread reply is not reused
+	storage := NewRedisCacheStorage(l.Addr().String(), "test:", time.Second).(*redisStorage)
+	_, err = storage.Keys()
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(storage.conns))
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// CacheStats contains the DNS cache counters
+// The counters cover both the general and the subnet caches
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`      // number of requests served from the cache
+	Misses    uint64 `json:"misses"`    // number of requests not found in the cache (including Expired)
+	Expired   uint64 `json:"expired"`   // number of misses that found only an expired response (it is removed, not served)
+	Evictions uint64 `json:"evictions"` // number of responses evicted to stay within the cache size
+
+	// Rejected is the number of responses that weren't cached, by reason:
+	// "truncated", "questions", "zero_ttl", "rcode", "no_answer", "no_ip_answer", "subnet_index_full"
+	Rejected map[string]uint64 `json:"rejected"`
+
+	// Current cache size (in bytes) and number of cached responses
+	// These are only reported for the default in-memory storage
+	Size    int `json:"size"`
+	Entries int `json:"entries"`
+}
+
+// cacheStats contains the counters of a single cache
+type cacheStats struct {
+	hits      uint64
+	misses    uint64
+	expires   uint64
+	evictions uint64
+	rejected  map[string]uint64
+
+	sync.Mutex // protects the counters
+}
+
+func (s *cacheStats) hit() {
+	s.Lock()
+	s.hits++
+	s.Unlock()
+}
+
+func (s *cacheStats) miss() {
+	s.Lock()
+	s.misses++
+	s.Unlock()
+}
+
+// expired counts a miss because of an expired response
+func (s *cacheStats) expired() {
+	s.Lock()
+	s.misses++
+	s.expires++
+	s.Unlock()
+}
+
+func (s *cacheStats) evict() {
+	s.Lock()
+	s.evictions++
+	s.Unlock()
+}
+
+func (s *cacheStats) reject(reason string) {
+	s.Lock()
+	if s.rejected == nil {
+		s.rejected = map[string]uint64{}
+	}
+	s.rejected[reason]++
+	s.Unlock()
+}
+
+// addTo adds the counters to the CacheStats
+func (s *cacheStats) addTo(stats *CacheStats) {
+	s.Lock()
+	defer s.Unlock()
+	stats.Hits += s.hits
+	stats.Misses += s.misses
+	stats.Expired += s.expires
+	stats.Evictions += s.evictions
+	for reason, n := range s.rejected {
+		stats.Rejected[reason] += n
+	}
+}
+
+// CacheStats returns the DNS cache counters
+func (p *Proxy) CacheStats() CacheStats {
+	stats := CacheStats{Rejected: map[string]uint64{}}
+
+	if p.cache != nil {
+		p.cache.stats.addTo(&stats)
+		if storage := p.cache.getStorage(); storage != nil {
+			entries, size := storageSize(storage)
+			stats.Entries += entries
+			stats.Size += size
+		}
+	}
+
+	if p.cacheSubnet != nil {
+		p.cacheSubnet.stats.addTo(&stats)
+		p.cacheSubnet.RLock()
+		storage := p.cacheSubnet.storage
+		p.cacheSubnet.RUnlock()
+		if storage != nil {
+			entries, size := storageSize(storage)
+			stats.Entries += entries
+			stats.Size += size
+		}
+	}
+
+	return stats
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	glcache "github.com/AdguardTeam/golibs/cache"
+)
+
+// CacheStorage is a key-value storage for the cached DNS responses.
+// By default, the proxy uses an in-memory LRU storage limited by Config.CacheSizeBytes,
+// a custom storage can be set with Config.CacheStorage.
+// The storage may drop any value at any time (i.e. when it's full).
+// Implementations must be safe for concurrent use.
+type CacheStorage interface {
+	// Get returns the value stored with the key, or nil if there's no such value or it has expired
+	Get(key []byte) ([]byte, error)
+
+	// Set stores the value with the key. The value must expire after ttl.
+	Set(key []byte, val []byte, ttl time.Duration) error
+
+	// Delete removes the value stored with the key (if any)
+	Delete(key []byte) error
+
+	// Keys returns the keys of all the stored values
+	// It is used to list and flush the cache so it does not need to be fast
+	Keys() ([][]byte, error)
+}
+
+// cacheStorageSize is implemented by the storages that know their size
+type cacheStorageSize interface {
+	// Size returns the number of stored values and their size in bytes
+	Size() (int, int)
+}
+
+// lruStorage is the default in-memory CacheStorage
+// When it's full, the least recently used values are evicted.
+type lruStorage struct {
+	items    glcache.Cache    // LRU cache
+	onDelete func(key []byte) // called when an item is evicted
+	maxSize  int              // the LRU cache size, larger items are rejected by it
+
+	// writeLock serializes the changes of the LRU cache so that keys and size match its items,
+	// the items are only evicted while they're being set
+	writeLock sync.Mutex
+
+	keys       map[string]int // keys of the stored items and the items sizes
+	size       int            // total size of the stored items
+	sync.Mutex                // protects keys and size
+}
+
+// newLRUStorage creates a new lruStorage
+// cacheSize is the storage size in bytes (defaultCacheSize if 0)
+// onDelete is called when a value is evicted (can be nil)
+func newLRUStorage(cacheSize int, onDelete func(key []byte)) *lruStorage {
+	s := &lruStorage{
+		keys:     map[string]int{},
+		onDelete: onDelete,
+	}
+
+	conf := glcache.Config{
+		MaxSize:   defaultCacheSize,
+		EnableLRU: true,
+		OnDelete:  s.evicted,
+	}
+	if cacheSize > 0 {
+		conf.MaxSize = uint(cacheSize)
+	}
+	s.maxSize = int(conf.MaxSize)
+	s.items = glcache.New(conf)
+	return s
+}
+
+// Get implements the CacheStorage interface for *lruStorage
+// Expired values are returned as is, the expiration time is checked by the cache.
+func (s *lruStorage) Get(key []byte) ([]byte, error) {
+	return s.items.Get(key), nil
+}
+
+// Set implements the CacheStorage interface for *lruStorage
+func (s *lruStorage) Set(key []byte, val []byte, _ time.Duration) error {
+	// the LRU cache evicts the old items to store the new one, so it only rejects the items larger than itself
+	// (its Set result tells whether the item has been replaced, not whether it has been stored)
+	size := len(key) + len(val)
+	if size > s.maxSize {
+		return errors.New("the value is larger than the cache")
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_ = s.items.Set(key, val)
+
+	s.Lock()
+	s.size += size - s.keys[string(key)]
+	s.keys[string(key)] = size
+	s.Unlock()
+	return nil
+}
+
+// Delete implements the CacheStorage interface for *lruStorage
+func (s *lruStorage) Delete(key []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.items.Del(key)
+
+	s.Lock()
+	s.size -= s.keys[string(key)]
+	delete(s.keys, string(key))
+	s.Unlock()
+	return nil
+}
+
+// Keys implements the CacheStorage interface for *lruStorage
+func (s *lruStorage) Keys() ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	keys := make([][]byte, 0, len(s.keys))
+	for k := range s.keys {
+		keys = append(keys, []byte(k))
+	}
+	return keys, nil
+}
+
+// Size implements the cacheStorageSize interface for *lruStorage
+func (s *lruStorage) Size() (int, int) {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.keys), s.size
+}
+
+// evicted is called by the LRU cache when it evicts an item
+func (s *lruStorage) evicted(key []byte, _ []byte) {
+	s.Lock()
+	s.size -= s.keys[string(key)]
+	delete(s.keys, string(key))
+	s.Unlock()
+
+	if s.onDelete != nil {
+		s.onDelete(key)
+	}
+}
+
+// prefixStorage stores the values in another storage with a key prefix
+// It allows the general and subnet caches to share a single custom storage
+type prefixStorage struct {
+	storage CacheStorage
+	prefix  string
+}
+
+// withPrefix returns the storage that adds the prefix to all keys or nil if storage is nil
+func withPrefix(storage CacheStorage, prefix string) CacheStorage {
+	if storage == nil {
+		return nil
+	}
+	return &prefixStorage{storage: storage, prefix: prefix}
+}
+
+func (s *prefixStorage) key(key []byte) []byte {
+	k := make([]byte, 0, len(s.prefix)+len(key))
+	k = append(k, s.prefix...)
+	return append(k, key...)
+}
+
+// Get implements the CacheStorage interface for *prefixStorage
+func (s *prefixStorage) Get(key []byte) ([]byte, error) {
+	return s.storage.Get(s.key(key))
+}
+
+// Set implements the CacheStorage interface for *prefixStorage
+func (s *prefixStorage) Set(key []byte, val []byte, ttl time.Duration) error {
+	return s.storage.Set(s.key(key), val, ttl)
+}
+
+// Delete implements the CacheStorage interface for *prefixStorage
+func (s *prefixStorage) Delete(key []byte) error {
+	return s.storage.Delete(s.key(key))
+}
+
+// Keys implements the CacheStorage interface for *prefixStorage
+func (s *prefixStorage) Keys() ([][]byte, error) {
+	all, err := s.storage.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := [][]byte{}
+	for _, k := range all {
+		if len(k) >= len(s.prefix) && string(k[:len(s.prefix)]) == s.prefix {
+			keys = append(keys, k[len(s.prefix):])
+		}
+	}
+	return keys, nil
+}
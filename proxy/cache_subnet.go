@@ -1,19 +1,74 @@
 package proxy
 
 import (
-	"encoding/binary"
 	"net"
-	"strings"
 	"sync"
+	"time"
 
-	glcache "github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
+const (
+	maxSubnetIndexSize       = 64 * 1024   // maximum number of the subnets in the index
+	subnetIndexPruneInterval = time.Minute // how often the subnets of the expired responses are removed from the index
+)
+
+// cacheSubnet is the cache for the responses that depend on the client subnet (ECS)
+// Besides the storage, it keeps an in-memory index of the subnets that are cached for every name.
+// The index is local to the process: if the storage is shared by multiple proxies (see Config.CacheStorage),
+// each of them only finds the ECS responses it has cached itself, the others' ones are not used.
+// The storage doesn't report the expired responses, so the index entries expire with their responses
+// and the index size is limited by maxSubnetIndexSize.
 type cacheSubnet struct {
-	items        glcache.Cache // cache
-	cacheSize    int           // cache size (in bytes)
-	sync.RWMutex               // lock
+	storage      CacheStorage            // storage for the cached responses (lazily initialized LRU storage if nil)
+	index        map[string]*subnetIndex // subnets cached for every (do, qtype, qclass, name), see key()
+	indexSize    int                     // number of the subnets in the index
+	indexLimit   int                     // maximum number of the subnets in the index (maxSubnetIndexSize if 0)
+	pruned       time.Time               // the last time the expired subnets were removed from the index
+	cacheSize    int                     // cache size (in bytes), used for the default storage only
+	stats        cacheStats              // cache counters
+	sync.RWMutex                         // lock
+}
+
+// subnetIndex contains the subnets that responses for a single (do, qtype, qclass, name) are cached for
+type subnetIndex struct {
+	all       bool       // if true, there is a response that is valid for all subnets
+	allExpire uint32     // when the response that is valid for all subnets expires (unix time)
+	v4        subnetTree // IPv4 subnets
+	v6        subnetTree // IPv6 subnets
+}
+
+// tree returns the subnet tree for the IP address family
+func (idx *subnetIndex) tree(ip net.IP) *subnetTree {
+	if len(ip) == net.IPv4len {
+		return &idx.v4
+	}
+	return &idx.v6
+}
+
+// empty checks if there are no subnets in the index
+func (idx *subnetIndex) empty() bool {
+	return !idx.all && idx.v4.empty() && idx.v6.empty()
+}
+
+// has checks if the subnet is in the index
+func (idx *subnetIndex) has(ip net.IP, mask uint8) bool {
+	if mask == 0 {
+		return idx.all
+	}
+	found := idx.tree(ip).lookup(ip, mask)
+	return len(found) > 0 && found[0].mask == mask
+}
+
+// prune removes the subnets whose responses have expired by now and returns their number
+func (idx *subnetIndex) prune(now uint32) int {
+	removed := idx.v4.prune(now) + idx.v6.prune(now)
+	if idx.all && idx.allExpire <= now {
+		idx.all = false
+		removed++
+	}
+	return removed
 }
 
 // Get key
@@ -22,50 +77,58 @@ type cacheSubnet struct {
 // uint16(qtype)
 // uint16(qclass)
 // uint8(subnet_mask)
+// uint8(len(client_ip))
 // client_ip
 // name
+// Note that the client IP is masked, that it is omitted if the mask is zero,
+// and that the mask is clamped to the IP address length
 func keyWithSubnet(m *dns.Msg, ip net.IP, mask uint8) []byte {
-	q := m.Question[0]
-	cap := 1 + 2 + 2 + 1 + len(q.Name)
-	if mask != 0 {
-		cap += len(ip)
-	}
+	ip, mask = subnetIP(ip, mask)
 
-	// init the array
-	b := make([]byte, cap)
-	k := 0
+	base := key(m)
+	b := make([]byte, 0, len(base)+2+len(ip))
+	b = append(b, base[:5]...)
+	b = append(b, mask, uint8(len(ip)))
+	b = append(b, ip...)
+	b = append(b, base[5:]...)
+	return b
+}
 
-	// put do
-	opt := m.IsEdns0()
-	do := false
-	if opt != nil {
-		do = opt.Do()
-	}
-	if do {
-		b[k] = 1
-	} else {
-		b[k] = 0
+// parseKeyWithSubnet splits the key created by keyWithSubnet into
+// the general cache key (see key()), masked client IP and subnet mask
+func parseKeyWithSubnet(b []byte) ([]byte, net.IP, uint8, bool) {
+	if len(b) < 7 || len(b) < 7+int(b[6]) {
+		return nil, nil, 0, false
 	}
-	k++
 
-	// put qtype
-	binary.BigEndian.PutUint16(b[:], q.Qtype)
-	k += 2
+	mask := b[5]
+	ipLen := int(b[6])
+	if int(mask) > ipLen*8 {
+		// the key is not created by keyWithSubnet
+		return nil, nil, 0, false
+	}
+	ip := net.IP(b[7 : 7+ipLen])
 
-	// put qclass
-	binary.BigEndian.PutUint16(b[k:], q.Qclass)
-	k += 2
+	base := make([]byte, 0, len(b)-2-ipLen)
+	base = append(base, b[:5]...)
+	base = append(base, b[7+ipLen:]...)
+	return base, ip, mask, true
+}
 
-	// add mask
-	b[k] = mask
-	k++
-	if mask != 0 {
-		copy(b[k:], ip)
-		k += len(ip)
+// subnetIP returns the IP address masked with the subnet mask and the mask clamped to the address length
+// (the ECS scope prefix may be longer than the address)
+// IPv4 addresses are always in the 4-byte form, and nil is returned if the mask is zero
+func subnetIP(ip net.IP, mask uint8) (net.IP, uint8) {
+	if mask == 0 {
+		return nil, 0
 	}
-
-	copy(b[k:], strings.ToLower(q.Name))
-	return b
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if int(mask) > len(ip)*8 {
+		mask = uint8(len(ip) * 8)
+	}
+	return ip.Mask(net.CIDRMask(int(mask), len(ip)*8)), mask
 }
 
 // GetWithSubnet - get DNS response
@@ -73,64 +136,280 @@ func keyWithSubnet(m *dns.Msg, ip net.IP, mask uint8) []byte {
 // mask: subnet mask for client IP address
 // Return (response, true) if response is found
 //  or (nil, false) on error
-// Note: it's a slow longest-prefix-match algorithm -
-//  we search in cache up to 'mask+1' times, decrementing the value with each iteration.
+// The most specific cached subnet that contains the client IP address is found
+// with a single longest-prefix-match lookup in the subnets index.
 func (c *cacheSubnet) GetWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (*dns.Msg, bool) {
 	if request == nil || len(request.Question) != 1 {
 		return nil, false
 	}
-	// create key for request
-	c.Lock()
-	if c.items == nil {
-		c.Unlock()
+
+	c.RLock()
+	storage := c.storage
+	if storage == nil {
+		c.RUnlock()
+		c.stats.miss()
 		return nil, false
 	}
-	c.Unlock()
+	candidates := c.lookup(key(request), ip, mask)
+	c.RUnlock()
 
-	var key, data []byte
-	for {
-		key = keyWithSubnet(request, ip, mask)
-		data = c.items.Get(key)
-		if data != nil {
-			break
+	expired := false
+	for _, k := range candidates {
+		key := keyWithSubnet(request, k.ip, k.mask)
+		data := storageGet(storage, key)
+		if data == nil {
+			// the item has been evicted or has expired in the storage
+			c.Lock()
+			c.removeFromIndex(key)
+			c.Unlock()
+			continue
 		}
-		if mask == 0 {
-			return nil, false
+
+		res := unpackResponse(data, request)
+		if res == nil {
+			expired = true
+			c.del(key)
+			continue
 		}
-		mask--
+		c.stats.hit()
+		return res, true
 	}
 
-	res := unpackResponse(data, request)
-	if res == nil {
-		c.items.Del(key)
-		return nil, false
+	if expired {
+		c.stats.expired()
+	} else {
+		c.stats.miss()
 	}
-	return res, true
+	return nil, false
+}
+
+// subnetKey is a cached subnet
+type subnetKey struct {
+	ip   net.IP
+	mask uint8
+}
+
+// lookup returns the cached subnets that contain the IP address, the most specific goes first
+// c must be locked
+func (c *cacheSubnet) lookup(base []byte, ip net.IP, mask uint8) []subnetKey {
+	idx := c.index[string(base)]
+	if idx == nil {
+		return nil
+	}
+
+	var found []subnetKey
+	if mask != 0 {
+		ip, mask = subnetIP(ip, mask)
+		for _, n := range idx.tree(ip).lookup(ip, mask) {
+			found = append(found, subnetKey{ip: n.ip, mask: n.mask})
+		}
+	}
+	if idx.all {
+		found = append(found, subnetKey{})
+	}
+	return found
 }
 
 // SetWithSubnet - store DNS response
 // ip: IP subnet this response is valid for
 // mask: subnet mask
 func (c *cacheSubnet) SetWithSubnet(m *dns.Msg, ip net.IP, mask uint8) {
-	if m == nil || !isCacheable(m) {
+	if m == nil {
+		return
+	}
+	if ok, reason := isCacheable(m); !ok {
+		c.stats.reject(reason)
 		return
 	}
 	key := keyWithSubnet(m, ip, mask)
+	expire := uint32(time.Now().Unix()) + findLowestTTL(m)
 
 	c.Lock()
 	// lazy initialization for cache
-	if c.items == nil {
-		conf := glcache.Config{
-			MaxSize:   defaultCacheSize,
-			EnableLRU: true,
+	if c.storage == nil {
+		c.storage = newLRUStorage(c.cacheSize, c.onDelete)
+	}
+	storage := c.storage
+	c.Unlock()
+
+	storageSet(storage, key, m)
+
+	c.Lock()
+	added := c.addToIndex(key, expire)
+	c.Unlock()
+
+	if !added {
+		c.stats.reject(notCacheableIndexFull)
+		if err := storage.Delete(key); err != nil {
+			log.Debug("failed to delete a cached response: %s", err)
 		}
-		if c.cacheSize > 0 {
-			conf.MaxSize = uint(c.cacheSize)
+	}
+}
+
+// addToIndex adds the subnet from the cache key to the subnets index
+// Returns false if the index is full even after the subnets of the expired responses are removed.
+// c must be locked
+func (c *cacheSubnet) addToIndex(key []byte, expire uint32) bool {
+	base, ip, mask, ok := parseKeyWithSubnet(key)
+	if !ok {
+		return true
+	}
+
+	if c.index == nil {
+		c.index = map[string]*subnetIndex{}
+	}
+	idx := c.index[string(base)]
+
+	limit := c.indexLimit
+	if limit == 0 {
+		limit = maxSubnetIndexSize
+	}
+	now := time.Now()
+	if c.indexSize >= limit || now.Sub(c.pruned) >= subnetIndexPruneInterval {
+		c.pruneIndex(uint32(now.Unix()))
+		c.pruned = now
+		idx = c.index[string(base)]
+	}
+	if c.indexSize >= limit && (idx == nil || !idx.has(ip, mask)) {
+		return false
+	}
+
+	if idx == nil {
+		idx = &subnetIndex{}
+		c.index[string(base)] = idx
+	}
+	if mask == 0 {
+		if !idx.all {
+			c.indexSize++
+		}
+		idx.all = true
+		idx.allExpire = expire
+	} else if idx.tree(ip).insert(ip, mask, expire) {
+		c.indexSize++
+	}
+	return true
+}
+
+// pruneIndex removes the subnets whose responses have expired by now from the index
+// c must be locked
+func (c *cacheSubnet) pruneIndex(now uint32) {
+	for base, idx := range c.index {
+		c.indexSize -= idx.prune(now)
+		if idx.empty() {
+			delete(c.index, base)
 		}
-		c.items = glcache.New(conf)
 	}
+}
+
+// removeFromIndex removes the subnet from the cache key from the subnets index
+// c must be locked
+func (c *cacheSubnet) removeFromIndex(key []byte) {
+	base, ip, mask, ok := parseKeyWithSubnet(key)
+	if !ok {
+		return
+	}
+
+	idx := c.index[string(base)]
+	if idx == nil {
+		return
+	}
+	if mask == 0 {
+		if idx.all {
+			c.indexSize--
+		}
+		idx.all = false
+	} else if idx.tree(ip).remove(ip, mask) {
+		c.indexSize--
+	}
+	if idx.empty() {
+		delete(c.index, string(base))
+	}
+}
+
+// onDelete is called by the LRU storage when it evicts an item
+func (c *cacheSubnet) onDelete(key []byte) {
+	c.stats.evict()
+	c.Lock()
+	c.removeFromIndex(key)
+	c.Unlock()
+}
+
+// del removes the item with the specified key
+func (c *cacheSubnet) del(key []byte) {
+	c.Lock()
+	storage := c.storage
+	c.removeFromIndex(key)
+	c.Unlock()
+
+	if storage == nil {
+		return
+	}
+	err := storage.Delete(key)
+	if err != nil {
+		log.Debug("failed to delete a cached response: %s", err)
+	}
+}
+
+// clear removes all the items from the cache and returns their number
+func (c *cacheSubnet) clear() int {
+	c.RLock()
+	storage := c.storage
+	c.RUnlock()
+	if storage == nil {
+		return 0
+	}
+
+	keys := storageKeys(storage)
+	for _, key := range keys {
+		c.del(key)
+	}
+
+	c.Lock()
+	c.index = map[string]*subnetIndex{}
+	c.indexSize = 0
 	c.Unlock()
+	return len(keys)
+}
 
-	data := packResponse(m)
-	_ = c.items.Set(key, data)
+// delName removes the items for the specified lowercase FQDN (and its subdomains if subdomains is true)
+// and returns their number. The names are read from the keys so the responses are not unpacked.
+func (c *cacheSubnet) delName(name string, subdomains bool) int {
+	c.RLock()
+	storage := c.storage
+	c.RUnlock()
+	if storage == nil {
+		return 0
+	}
+
+	n := 0
+	for _, key := range storageKeys(storage) {
+		base, _, _, ok := parseKeyWithSubnet(key)
+		if ok && len(base) > 5 && matchCacheName(string(base[5:]), name, subdomains) {
+			c.del(key)
+			n++
+		}
+	}
+	return n
+}
+
+// list returns all the items that are currently stored in the cache.
+// Expired items are removed instead.
+func (c *cacheSubnet) list() []cacheItem {
+	c.RLock()
+	storage := c.storage
+	c.RUnlock()
+	if storage == nil {
+		return nil
+	}
+
+	items := []cacheItem{}
+	for _, key := range storageKeys(storage) {
+		item, ok := newCacheItem(key, storageGet(storage, key))
+		if !ok {
+			c.del(key)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
 }
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"net"
+)
+
+// subnetTree is a path-compressed binary radix tree of the subnets (prefixes)
+// that responses are cached for. It is used to find the longest cached prefix
+// that contains the client IP address with a single tree walk.
+// All the prefixes in a tree must be of the same address family.
+type subnetTree struct {
+	root *subnetNode
+}
+
+// subnetNode is a node of the subnetTree
+type subnetNode struct {
+	ip       net.IP         // masked prefix
+	mask     uint8          // prefix length
+	cached   bool           // if true, there is a cached response for this prefix
+	expire   uint32         // when the cached response expires (unix time)
+	children [2]*subnetNode // children, indexed by the bit that follows the prefix
+}
+
+// insert adds the prefix with the response expiration time to the tree
+// Returns false if the prefix was already there (its expiration time is updated then).
+func (t *subnetTree) insert(ip net.IP, mask uint8, expire uint32) bool {
+	ip = ip.Mask(net.CIDRMask(int(mask), len(ip)*8))
+
+	link := &t.root
+	for {
+		n := *link
+		if n == nil {
+			*link = &subnetNode{ip: ip, mask: mask, cached: true, expire: expire}
+			return true
+		}
+
+		common := commonPrefixLen(n.ip, ip, minUint8(n.mask, mask))
+		if common == n.mask && common == mask {
+			// the very same prefix
+			added := !n.cached
+			n.cached = true
+			n.expire = expire
+			return added
+		}
+
+		if common == n.mask {
+			// the new prefix is more specific than n, go deeper
+			link = &n.children[ipBit(ip, n.mask)]
+			continue
+		}
+
+		// the new prefix diverges from n or is less specific than n,
+		// so it must be placed above n
+		parent := &subnetNode{
+			ip:   ip.Mask(net.CIDRMask(int(common), len(ip)*8)),
+			mask: common,
+		}
+		parent.children[ipBit(n.ip, common)] = n
+		if common == mask {
+			parent.cached = true
+			parent.expire = expire
+		} else {
+			parent.children[ipBit(ip, common)] = &subnetNode{ip: ip, mask: mask, cached: true, expire: expire}
+		}
+		*link = parent
+		return true
+	}
+}
+
+// remove removes the prefix from the tree
+// Returns false if the prefix wasn't there.
+func (t *subnetTree) remove(ip net.IP, mask uint8) bool {
+	ip = ip.Mask(net.CIDRMask(int(mask), len(ip)*8))
+
+	link := &t.root
+	var parentLink **subnetNode
+	for {
+		n := *link
+		if n == nil || n.mask > mask || commonPrefixLen(n.ip, ip, n.mask) != n.mask {
+			return false // not found
+		}
+
+		if n.mask < mask {
+			parentLink = link
+			link = &n.children[ipBit(ip, n.mask)]
+			continue
+		}
+
+		removed := n.cached
+		n.cached = false
+		compact(link)
+		if parentLink != nil {
+			compact(parentLink)
+		}
+		return removed
+	}
+}
+
+// prune removes the prefixes whose responses have expired by now and returns their number
+func (t *subnetTree) prune(now uint32) int {
+	return pruneNode(&t.root, now)
+}
+
+// pruneNode removes the expired prefixes from the subtree
+func pruneNode(link **subnetNode, now uint32) int {
+	n := *link
+	if n == nil {
+		return 0
+	}
+
+	removed := pruneNode(&n.children[0], now) + pruneNode(&n.children[1], now)
+	if n.cached && n.expire <= now {
+		n.cached = false
+		removed++
+	}
+	compact(link)
+	return removed
+}
+
+// lookup returns the prefixes that contain ip and are not longer than maxMask
+// The longest (most specific) prefix goes first
+func (t *subnetTree) lookup(ip net.IP, maxMask uint8) []*subnetNode {
+	var found []*subnetNode
+	n := t.root
+	for n != nil && n.mask <= maxMask && commonPrefixLen(n.ip, ip, n.mask) == n.mask {
+		if n.cached {
+			found = append(found, n)
+		}
+		if int(n.mask) == len(ip)*8 {
+			break
+		}
+		n = n.children[ipBit(ip, n.mask)]
+	}
+
+	// reverse the list so that the longest prefix goes first
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found
+}
+
+// empty checks if there are no prefixes in the tree
+func (t *subnetTree) empty() bool {
+	return t.root == nil
+}
+
+// compact removes the node if it is not cached and has less than two children
+func compact(link **subnetNode) {
+	n := *link
+	if n == nil || n.cached {
+		return
+	}
+
+	switch {
+	case n.children[0] == nil && n.children[1] == nil:
+		*link = nil
+	case n.children[0] == nil:
+		*link = n.children[1]
+	case n.children[1] == nil:
+		*link = n.children[0]
+	}
+}
+
+// commonPrefixLen returns the length of the common prefix of a and b (but not more than max bits)
+func commonPrefixLen(a, b net.IP, max uint8) uint8 {
+	var n uint8
+	for i := 0; i < len(a) && i < len(b) && n < max; i++ {
+		x := a[i] ^ b[i]
+		for bit := uint(7); ; bit-- {
+			if n == max {
+				return n
+			}
+			if x&(1<<bit) != 0 {
+				return n
+			}
+			n++
+			if bit == 0 {
+				break
+			}
+		}
+	}
+	return n
+}
+
+// ipBit returns the value of the specified bit of the IP address (0 is the most significant bit)
+func ipBit(ip net.IP, bit uint8) int {
+	return int(ip[bit/8]>>(7-bit%8)) & 1
+}
+
+func minUint8(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
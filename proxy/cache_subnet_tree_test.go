@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubnetTree(t *testing.T) {
+	tree := subnetTree{}
+	assert.True(t, tree.empty())
+
+	tree.insert(net.IP{1, 2, 3, 4}, 24, 0)
+	tree.insert(net.IP{1, 2, 0, 0}, 16, 0)
+	tree.insert(net.IP{1, 2, 128, 0}, 17, 0)
+	tree.insert(net.IP{10, 0, 0, 0}, 8, 0)
+
+	assertSubnets(t, tree.lookup(net.IP{1, 2, 3, 0}, 24), "1.2.3.0/24", "1.2.0.0/16")
+	assertSubnets(t, tree.lookup(net.IP{1, 2, 3, 0}, 20), "1.2.0.0/16")
+	assertSubnets(t, tree.lookup(net.IP{1, 2, 200, 0}, 24), "1.2.128.0/17", "1.2.0.0/16")
+	assertSubnets(t, tree.lookup(net.IP{1, 3, 0, 0}, 24))
+	assertSubnets(t, tree.lookup(net.IP{10, 20, 30, 0}, 24), "10.0.0.0/8")
+
+	tree.remove(net.IP{1, 2, 0, 0}, 16)
+	assertSubnets(t, tree.lookup(net.IP{1, 2, 3, 0}, 24), "1.2.3.0/24")
+	assertSubnets(t, tree.lookup(net.IP{1, 2, 4, 0}, 24))
+
+	// removing a prefix that isn't there is a no-op
+	tree.remove(net.IP{1, 2, 3, 0}, 25)
+	assertSubnets(t, tree.lookup(net.IP{1, 2, 3, 0}, 32), "1.2.3.0/24")
+
+	tree.remove(net.IP{1, 2, 3, 0}, 24)
+	tree.remove(net.IP{1, 2, 128, 0}, 17)
+	tree.remove(net.IP{10, 0, 0, 0}, 8)
+	assert.True(t, tree.empty())
+}
+
+func TestSubnetTreeRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree := subnetTree{}
+	prefixes := map[string]*net.IPNet{}
+
+	for i := 0; i < 2000; i++ {
+		ip := net.IP{10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256))}
+		mask := uint8(8 + r.Intn(25))
+		ipNet := &net.IPNet{IP: ip.Mask(net.CIDRMask(int(mask), 32)), Mask: net.CIDRMask(int(mask), 32)}
+
+		if r.Intn(3) == 0 {
+			tree.remove(ip, mask)
+			delete(prefixes, ipNet.String())
+		} else {
+			tree.insert(ip, mask, 0)
+			prefixes[ipNet.String()] = ipNet
+		}
+
+		// compare the tree lookup with a full scan
+		client := net.IP{10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256))}
+		clientMask := uint8(r.Intn(33))
+		var expected *net.IPNet
+		for _, p := range prefixes {
+			ones, _ := p.Mask.Size()
+			if ones <= int(clientMask) && p.Contains(client.Mask(net.CIDRMask(int(clientMask), 32))) {
+				if expected == nil {
+					expected = p
+				} else if eOnes, _ := expected.Mask.Size(); ones > eOnes {
+					expected = p
+				}
+			}
+		}
+
+		found := tree.lookup(client.Mask(net.CIDRMask(int(clientMask), 32)), clientMask)
+		if expected == nil {
+			assert.Equal(t, 0, len(found))
+		} else if assert.True(t, len(found) > 0) {
+			n := &net.IPNet{IP: found[0].ip, Mask: net.CIDRMask(int(found[0].mask), 32)}
+			assert.Equal(t, expected.String(), n.String())
+		}
+	}
+}
+
+func TestSubnetTreePrune(t *testing.T) {
+	tree := subnetTree{}
+	assert.True(t, tree.insert(net.IP{1, 2, 0, 0}, 16, 100))
+	assert.True(t, tree.insert(net.IP{1, 2, 3, 0}, 24, 200))
+	assert.True(t, tree.insert(net.IP{1, 2, 128, 0}, 17, 50))
+	assert.False(t, tree.insert(net.IP{1, 2, 128, 0}, 17, 300))
+
+	assert.Equal(t, 1, tree.prune(150))
+	assertSubnets(t, tree.lookup(net.IP{1, 2, 3, 0}, 24), "1.2.3.0/24")
+	assertSubnets(t, tree.lookup(net.IP{1, 2, 200, 0}, 24), "1.2.128.0/17")
+
+	assert.Equal(t, 2, tree.prune(400))
+	assert.True(t, tree.empty())
+}
+
+func assertSubnets(t *testing.T, nodes []*subnetNode, expected ...string) {
+	var actual []string
+	for _, n := range nodes {
+		ipNet := net.IPNet{IP: n.ip, Mask: net.CIDRMask(int(n.mask), len(n.ip)*8)}
+		actual = append(actual, ipNet.String())
+	}
+	assert.Equal(t, expected, actual)
+}
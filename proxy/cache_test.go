@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/go-test/deep"
@@ -480,3 +481,385 @@ func TestSubnet(t *testing.T) {
 	a = resp.Answer[0].(*dns.A)
 	assert.True(t, a.A.String() == "3.3.3.3")
 }
+
+func TestCacheFlush(t *testing.T) {
+	dnsProxy := Proxy{}
+	dnsProxy.CacheEnabled = true
+	dnsProxy.EnableEDNSClientSubnet = true
+	dnsProxy.Init()
+
+	for _, rr := range []string{
+		"example.org. 3600 IN A 1.1.1.1",
+		"www.example.org. 3600 IN A 1.1.1.2",
+		"example.net. 3600 IN A 1.1.1.3",
+	} {
+		reply := dns.Msg{}
+		reply.SetQuestion(newRR(rr).Header().Name, dns.TypeA)
+		reply.Response = true
+		reply.Answer = []dns.RR{newRR(rr)}
+		dnsProxy.cache.Set(&reply)
+	}
+
+	reply := dns.Msg{}
+	reply.SetQuestion("Example.org.", dns.TypeAAAA)
+	reply.Response = true
+	reply.Answer = []dns.RR{newRR("example.org. 3600 IN AAAA ::1")}
+	_, _ = setECS(&reply, net.IP{1, 2, 3, 0}, 24)
+	dnsProxy.cacheSubnet.SetWithSubnet(&reply, net.IP{1, 2, 3, 0}, 24)
+
+	entries := dnsProxy.CacheEntries()
+	assert.Equal(t, 4, len(entries))
+	for _, e := range entries {
+		assert.True(t, e.TTL > 3590 && e.TTL <= 3600)
+		if e.Type == "AAAA" {
+			assert.Equal(t, "1.2.3.0/24", e.Subnet)
+		} else {
+			assert.Equal(t, "", e.Subnet)
+		}
+	}
+
+	// only the exact name, both caches
+	assert.Equal(t, 2, dnsProxy.FlushCacheName("EXAMPLE.ORG", false))
+	assert.Equal(t, 2, len(dnsProxy.CacheEntries()))
+
+	// subdomains
+	assert.Equal(t, 1, dnsProxy.FlushCacheName("example.org.", true))
+	entries = dnsProxy.CacheEntries()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "example.net.", entries[0].Name)
+
+	request := dns.Msg{}
+	request.SetQuestion("www.example.org.", dns.TypeA)
+	_, ok := dnsProxy.cache.Get(&request)
+	assert.False(t, ok)
+
+	// everything
+	assert.Equal(t, 1, dnsProxy.FlushCache())
+	assert.Equal(t, 0, len(dnsProxy.CacheEntries()))
+}
+
+func TestCacheEvictedKeys(t *testing.T) {
+	testCache := &cache{cacheSize: 256}
+
+	for i := 0; i < 10; i++ {
+		host := fmt.Sprintf("host%d.example.org.", i)
+		reply := dns.Msg{}
+		reply.SetQuestion(host, dns.TypeA)
+		reply.Response = true
+		reply.Answer = []dns.RR{newRR(host + " 3600 IN A 1.1.1.1")}
+		testCache.Set(&reply)
+	}
+
+	// evicted items must not be listed
+	items := testCache.list()
+	assert.True(t, len(items) > 0 && len(items) < 10)
+	entries, _ := storageSize(testCache.storage)
+	assert.Equal(t, len(items), entries)
+}
+
+func TestCacheLargeItem(t *testing.T) {
+	storage := newLRUStorage(64, nil)
+	assert.NotNil(t, storage.Set([]byte("key"), make([]byte, 100), time.Minute))
+	keys, _ := storage.Keys()
+	assert.Equal(t, 0, len(keys))
+
+	assert.Nil(t, storage.Set([]byte("key"), make([]byte, 10), time.Minute))
+	keys, _ = storage.Keys()
+	assert.Equal(t, 1, len(keys))
+}
+
+func TestCacheStorageSize(t *testing.T) {
+	storage := newLRUStorage(100, nil)
+
+	// the size is read while the items are set and evicted
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = storage.Set([]byte{byte(i), byte(j)}, make([]byte, 8), time.Minute)
+				_, _ = storage.Size()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	entries, size := storage.Size()
+	assert.Equal(t, 10, entries)
+	assert.Equal(t, 100, size)
+
+	_ = storage.Set([]byte{0, 0}, make([]byte, 18), time.Minute)
+	_ = storage.Delete([]byte{3, 99})
+	entries, size = storage.Size()
+	keys, _ := storage.Keys()
+	assert.Equal(t, len(keys), entries)
+	assert.True(t, size <= 100)
+}
+
+func TestCacheInvalidItem(t *testing.T) {
+	storage := newLRUStorage(0, nil)
+	testCache := &cache{storage: storage}
+	subnetCache := &cacheSubnet{storage: storage}
+
+	req := dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	resp := &dns.Msg{}
+	resp.SetReply(&req)
+	resp.Answer = []dns.RR{newRR("example.org. 60 IN A 1.1.1.1")}
+	subnetCache.SetWithSubnet(resp, net.IP{1, 2, 3, 0}, 24)
+
+	// the values that are too short or can't be unpacked are removed
+	for _, val := range [][]byte{nil, {1, 2}, {0xff, 0xff, 0xff, 0xff, 1}} {
+		_ = storage.Set(key(&req), val, time.Minute)
+		_, ok := testCache.Get(&req)
+		assert.False(t, ok)
+		data, _ := storage.Get(key(&req))
+		assert.Nil(t, data)
+
+		subnetKey := keyWithSubnet(&req, net.IP{1, 2, 3, 0}, 24)
+		_ = storage.Set(subnetKey, val, time.Minute)
+		_, ok = subnetCache.GetWithSubnet(&req, net.IP{1, 2, 3, 4}, 24)
+		assert.False(t, ok)
+		data, _ = storage.Get(subnetKey)
+		assert.Nil(t, data)
+		subnetCache.SetWithSubnet(resp, net.IP{1, 2, 3, 0}, 24)
+	}
+}
+
+func TestSubnetLongestPrefix(t *testing.T) {
+	c := &cacheSubnet{}
+
+	req := dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	for _, tc := range []struct {
+		ip   net.IP
+		mask uint8
+		rr   string
+	}{
+		{net.IP{1, 2, 0, 0}, 16, "example.com. 60 IN A 1.1.1.1"},
+		{net.IP{1, 2, 3, 0}, 24, "example.com. 60 IN A 2.2.2.2"},
+		{net.ParseIP("2001:db8::"), 32, "example.com. 60 IN A 3.3.3.3"},
+	} {
+		resp := &dns.Msg{}
+		resp.Response = true
+		resp.SetQuestion("example.com.", dns.TypeA)
+		resp.Answer = []dns.RR{newRR(tc.rr)}
+		c.SetWithSubnet(resp, tc.ip, tc.mask)
+	}
+
+	assertSubnetAnswer(t, c, &req, net.IP{1, 2, 3, 0}, 24, "2.2.2.2")
+	assertSubnetAnswer(t, c, &req, net.IP{1, 2, 4, 0}, 24, "1.1.1.1")
+	assertSubnetAnswer(t, c, &req, net.IP{1, 2, 3, 0}, 20, "1.1.1.1")
+	assertSubnetAnswer(t, c, &req, net.ParseIP("2001:db8:1::"), 56, "3.3.3.3")
+	assertSubnetAnswer(t, c, &req, net.IP{1, 3, 0, 0}, 24, "")
+
+	// DO bit is a part of the key
+	reqDO := req.Copy()
+	reqDO.SetEdns0(4096, true)
+	assertSubnetAnswer(t, c, reqDO, net.IP{1, 2, 3, 0}, 24, "")
+
+	// the index is cleaned up when the items are removed
+	c.clear()
+	assertSubnetAnswer(t, c, &req, net.IP{1, 2, 3, 0}, 24, "")
+	assert.Equal(t, 0, len(c.index))
+}
+
+func TestSubnetOversizedScope(t *testing.T) {
+	c := &cacheSubnet{}
+	req := dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// the scope prefix is longer than the address, it's the same as the full address then
+	ip4 := net.IP{1, 2, 3, 4}
+	ip6 := net.ParseIP("2001:db8::1")
+	assert.Equal(t, keyWithSubnet(&req, ip4, 32), keyWithSubnet(&req, ip4, 200))
+	assert.Equal(t, keyWithSubnet(&req, ip6, 128), keyWithSubnet(&req, ip6, 200))
+
+	resp := &dns.Msg{}
+	resp.Response = true
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Answer = []dns.RR{newRR("example.com. 60 IN A 1.1.1.1")}
+	c.SetWithSubnet(resp, ip4, 200)
+	c.SetWithSubnet(resp, ip6, 200)
+
+	assertSubnetAnswer(t, c, &req, ip4, 200, "1.1.1.1")
+	assertSubnetAnswer(t, c, &req, ip4, 32, "1.1.1.1")
+	assertSubnetAnswer(t, c, &req, net.IP{1, 2, 3, 5}, 200, "")
+	assertSubnetAnswer(t, c, &req, ip6, 200, "1.1.1.1")
+	assertSubnetAnswer(t, c, &req, ip6, 128, "1.1.1.1")
+	assert.Equal(t, 2, len(c.list()))
+}
+
+func TestSubnetEvictedIndex(t *testing.T) {
+	c := &cacheSubnet{cacheSize: 512}
+
+	for i := 0; i < 32; i++ {
+		resp := &dns.Msg{}
+		resp.Response = true
+		resp.SetQuestion("example.com.", dns.TypeA)
+		resp.Answer = []dns.RR{newRR("example.com. 60 IN A 1.1.1.1")}
+		c.SetWithSubnet(resp, net.IP{1, 2, byte(i), 0}, 24)
+	}
+
+	// only the prefixes that are still in the cache must be indexed
+	count := 0
+	for i := 0; i < 32; i++ {
+		req := dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeA)
+		idx := c.index[string(key(&req))]
+		if assert.NotNil(t, idx) && len(idx.v4.lookup(net.IP{1, 2, byte(i), 0}, 24)) > 0 {
+			count++
+		}
+	}
+	entries, _ := storageSize(c.storage)
+	assert.Equal(t, entries, count)
+	assert.True(t, count < 32)
+}
+
+func TestSubnetIndexLimit(t *testing.T) {
+	c := &cacheSubnet{indexLimit: 2}
+	set := func(ip net.IP, ttl string) {
+		resp := &dns.Msg{}
+		resp.Response = true
+		resp.SetQuestion("example.com.", dns.TypeA)
+		resp.Answer = []dns.RR{newRR("example.com. " + ttl + " IN A 1.1.1.1")}
+		c.SetWithSubnet(resp, ip, 24)
+	}
+	req := dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	set(net.IP{1, 2, 1, 0}, "1")
+	set(net.IP{1, 2, 2, 0}, "60")
+	// the index is full, the response is not cached
+	set(net.IP{1, 2, 3, 0}, "60")
+	assertSubnetAnswer(t, c, &req, net.IP{1, 2, 3, 0}, 24, "")
+	assert.Equal(t, map[string]uint64{"subnet_index_full": 1}, c.stats.rejected)
+	entries, _ := storageSize(c.storage)
+	assert.Equal(t, 2, entries)
+
+	// the cached subnets are updated anyway
+	set(net.IP{1, 2, 2, 0}, "60")
+	assert.Equal(t, uint64(1), c.stats.rejected["subnet_index_full"])
+
+	// the subnets of the expired responses are removed from the index to make room
+	time.Sleep(1100 * time.Millisecond)
+	set(net.IP{1, 2, 3, 0}, "60")
+	assertSubnetAnswer(t, c, &req, net.IP{1, 2, 3, 0}, 24, "1.1.1.1")
+	assert.Equal(t, 2, c.indexSize)
+	idx := c.index[string(key(&req))]
+	assert.False(t, idx.has(net.IP{1, 2, 1, 0}, 24))
+}
+
+func TestSubnetIndexIsLocal(t *testing.T) {
+	storage := newLRUStorage(0, nil)
+	c1 := &cacheSubnet{storage: storage}
+	c2 := &cacheSubnet{storage: storage}
+
+	resp := &dns.Msg{}
+	resp.Response = true
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Answer = []dns.RR{newRR("example.com. 60 IN A 1.1.1.1")}
+	c1.SetWithSubnet(resp, net.IP{1, 2, 3, 0}, 24)
+
+	// the response is in the shared storage, but only the instance that has cached it knows the subnet
+	req := dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	assertSubnetAnswer(t, c1, &req, net.IP{1, 2, 3, 0}, 24, "1.1.1.1")
+	assertSubnetAnswer(t, c2, &req, net.IP{1, 2, 3, 0}, 24, "")
+	assert.Equal(t, 1, len(c2.list()))
+}
+
+func assertSubnetAnswer(t *testing.T, c *cacheSubnet, req *dns.Msg, ip net.IP, mask uint8, expected string) {
+	resp, ok := c.GetWithSubnet(req, ip, mask)
+	if expected == "" {
+		assert.False(t, ok)
+		return
+	}
+	if assert.True(t, ok) {
+		assert.Equal(t, expected, resp.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	dnsProxy := Proxy{}
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheSizeBytes = 512
+	dnsProxy.Init()
+
+	request := dns.Msg{}
+	request.SetQuestion("example.org.", dns.TypeA)
+
+	// miss
+	_, ok := dnsProxy.cache.Get(&request)
+	assert.False(t, ok)
+
+	// rejected
+	reply := dns.Msg{}
+	reply.SetQuestion("example.org.", dns.TypeA)
+	reply.Response = true
+	dnsProxy.cache.Set(&reply)
+	reply.Answer = []dns.RR{newRR("example.org. 60 IN CNAME example.net.")}
+	dnsProxy.cache.Set(&reply)
+	reply.Rcode = dns.RcodeServerFailure
+	dnsProxy.cache.Set(&reply)
+	reply.Rcode = dns.RcodeSuccess
+
+	// expired
+	reply.Answer = []dns.RR{newRR("example.org. 1 IN A 1.1.1.1")}
+	dnsProxy.cache.Set(&reply)
+	time.Sleep(1100 * time.Millisecond)
+	_, ok = dnsProxy.cache.Get(&request)
+	assert.False(t, ok)
+
+	// hit
+	reply.Answer = []dns.RR{newRR("example.org. 60 IN A 1.1.1.1")}
+	dnsProxy.cache.Set(&reply)
+	_, ok = dnsProxy.cache.Get(&request)
+	assert.True(t, ok)
+
+	stats := dnsProxy.CacheStats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Expired)
+	assert.Equal(t, uint64(0), stats.Evictions)
+	assert.Equal(t, map[string]uint64{"zero_ttl": 1, "no_ip_answer": 1, "rcode": 1}, stats.Rejected)
+	assert.Equal(t, 1, stats.Entries)
+	assert.True(t, stats.Size > 0)
+
+	// evictions
+	for i := 0; i < 10; i++ {
+		host := fmt.Sprintf("host%d.example.org.", i)
+		reply := dns.Msg{}
+		reply.SetQuestion(host, dns.TypeA)
+		reply.Response = true
+		reply.Answer = []dns.RR{newRR(host + " 60 IN A 1.1.1.1")}
+		dnsProxy.cache.Set(&reply)
+	}
+	stats = dnsProxy.CacheStats()
+	assert.True(t, stats.Evictions > 0)
+	assert.Equal(t, 11, stats.Entries+int(stats.Evictions))
+	assert.True(t, stats.Size <= 512)
+}
+
+func TestCacheResponseHandler(t *testing.T) {
+	dnsProxy := Proxy{}
+	dnsProxy.CacheEnabled = true
+	u := &testUpstream{aResp: newRR("host. 60 IN A 1.2.3.4").(*dns.A)}
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+
+	var fromCache []bool
+	dnsProxy.ResponseHandler = func(d *DNSContext, err error) {
+		assert.Nil(t, err)
+		fromCache = append(fromCache, d.FromCache)
+	}
+	dnsProxy.Init()
+
+	for i := 0; i < 2; i++ {
+		d := &DNSContext{Req: createHostTestMessage("host")}
+		assert.Nil(t, dnsProxy.Resolve(d))
+		assert.True(t, getIPFromResponse(d.Res).Equal(net.IP{1, 2, 3, 4}))
+	}
+	assert.Equal(t, []bool{false, true}, fromCache)
+}
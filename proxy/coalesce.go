@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// exchangeFunc performs the actual upstream exchange for a request
+type exchangeFunc func() (*dns.Msg, upstream.Upstream, error)
+
+// inflightExchange is an upstream exchange that is currently in progress
+// All the identical requests received while it's in progress wait for its result instead of querying upstreams
+type inflightExchange struct {
+	done  chan struct{}     // closed when the exchange is finished
+	reply *dns.Msg          // a copy of the response (never returned as is, waiters copy it)
+	u     upstream.Upstream // upstream that resolved the request
+	err   error             // exchange error
+}
+
+// coalescer keeps track of the in-flight upstream exchanges
+type coalescer struct {
+	inflight   map[string]*inflightExchange // in-flight exchanges by request key
+	sync.Mutex                              // protects inflight and the counters
+
+	exchanges uint64 // number of upstream exchanges started
+	coalesced uint64 // number of requests that waited for another request's exchange
+}
+
+// CoalescingStats contains request coalescing counters
+type CoalescingStats struct {
+	Exchanges uint64 `json:"exchanges"` // number of upstream exchanges
+	Coalesced uint64 `json:"coalesced"` // number of requests served by an exchange started for another identical request
+}
+
+// CoalescingStats returns request coalescing counters
+func (p *Proxy) CoalescingStats() CoalescingStats {
+	c := &p.coalescer
+	c.Lock()
+	defer c.Unlock()
+	return CoalescingStats{
+		Exchanges: c.exchanges,
+		Coalesced: c.coalesced,
+	}
+}
+
+// coalescingKey returns the key that identifies identical requests
+// The same key as in the cache is used (see key() and keyWithSubnet()) along with the CD and RD flags
+// that the upstreams respond differently to.
+func (p *Proxy) coalescingKey(d *DNSContext) string {
+	var flags byte
+	if d.Req.CheckingDisabled {
+		flags |= 1
+	}
+	if d.Req.RecursionDesired {
+		flags |= 2
+	}
+
+	if p.Config.EnableEDNSClientSubnet && d.ecsReqMask != 0 {
+		return "s" + string([]byte{flags}) + string(keyWithSubnet(d.Req, d.ecsReqIP, d.ecsReqMask))
+	}
+	return "g" + string([]byte{flags}) + string(key(d.Req))
+}
+
+// errCoalescedExchangeFailed is returned to the waiters of an in-flight exchange that didn't complete
+var errCoalescedExchangeFailed = errors.New("in-flight exchange failed")
+
+// exchangeCoalesced calls exchange unless there is an identical request in-flight.
+// In the latter case it waits for that request to finish and returns a copy of its response.
+func (p *Proxy) exchangeCoalesced(d *DNSContext, exchange exchangeFunc) (*dns.Msg, upstream.Upstream, error) {
+	if !p.CoalesceRequests || len(d.Upstreams) > 0 || len(d.Req.Question) != 1 {
+		// Requests with custom upstreams are never coalesced
+		return exchange()
+	}
+
+	c := &p.coalescer
+	k := p.coalescingKey(d)
+
+	c.Lock()
+	if call, ok := c.inflight[k]; ok {
+		c.coalesced++
+		c.Unlock()
+		log.Tracef("Waiting for the in-flight request for %s", d.Req.Question[0].Name)
+		<-call.done
+		return coalescedReply(d.Req, call.reply), call.u, call.err
+	}
+
+	// the error is returned to the waiters if the exchange panics
+	call := &inflightExchange{done: make(chan struct{}), err: errCoalescedExchangeFailed}
+	if c.inflight == nil {
+		c.inflight = map[string]*inflightExchange{}
+	}
+	c.inflight[k] = call
+	c.exchanges++
+	c.Unlock()
+
+	defer func() {
+		c.Lock()
+		delete(c.inflight, k)
+		c.Unlock()
+		close(call.done)
+	}()
+
+	reply, u, err := exchange()
+
+	// Store a copy because the caller is free to modify the response
+	if reply != nil {
+		call.reply = reply.Copy()
+	}
+	call.u = u
+	call.err = err
+
+	return reply, u, err
+}
+
+// coalescedReply makes a copy of the response for the specified request
+func coalescedReply(req *dns.Msg, reply *dns.Msg) *dns.Msg {
+	if reply == nil {
+		return nil
+	}
+
+	res := reply.Copy()
+	res.Id = req.Id
+	// the names may differ in case
+	res.Question = make([]dns.Question, len(req.Question))
+	copy(res.Question, req.Question)
+	return res
+}
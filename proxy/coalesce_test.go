@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowUpstream answers with a delay and counts the requests
+type slowUpstream struct {
+	delay    time.Duration
+	requests int32
+}
+
+func (u *slowUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.requests, 1)
+	time.Sleep(u.delay)
+
+	resp := dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+	return &resp, nil
+}
+
+func (u *slowUpstream) Address() string {
+	return "slow"
+}
+
+func TestCoalesceRequests(t *testing.T) {
+	u := &slowUpstream{delay: 200 * time.Millisecond}
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	dnsProxy.CoalesceRequests = true
+
+	const count = 10
+	g := &sync.WaitGroup{}
+	g.Add(count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			defer g.Done()
+
+			d := &DNSContext{Req: createHostTestMessage("Example.org")}
+			if i%2 == 0 {
+				d.Req = createHostTestMessage("example.ORG")
+			}
+			err := dnsProxy.Resolve(d)
+			assert.Nil(t, err)
+			assert.Equal(t, d.Req.Id, d.Res.Id)
+			assert.Equal(t, d.Req.Question[0].Name, d.Res.Question[0].Name)
+			assert.True(t, getIPFromResponse(d.Res).Equal(net.IP{1, 2, 3, 4}))
+		}(i)
+	}
+	g.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.requests))
+	stats := dnsProxy.CoalescingStats()
+	assert.Equal(t, uint64(1), stats.Exchanges)
+	assert.Equal(t, uint64(count-1), stats.Coalesced)
+
+	// different qtype is a different request
+	d := &DNSContext{Req: createHostTestMessage("example.org")}
+	d.Req.Question[0].Qtype = dns.TypeAAAA
+	assert.Nil(t, dnsProxy.Resolve(d))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.requests))
+}
+
+func TestCoalesceRequestsFlags(t *testing.T) {
+	u := &slowUpstream{delay: 200 * time.Millisecond}
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	dnsProxy.CoalesceRequests = true
+
+	// the requests that differ in the CD bit only are not coalesced
+	g := &sync.WaitGroup{}
+	g.Add(2)
+	for _, cd := range []bool{false, true} {
+		go func(cd bool) {
+			defer g.Done()
+
+			d := &DNSContext{Req: createHostTestMessage("example.org")}
+			d.Req.CheckingDisabled = cd
+			assert.Nil(t, dnsProxy.Resolve(d))
+			assert.Equal(t, cd, d.Res.CheckingDisabled)
+		}(cd)
+	}
+	g.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.requests))
+	stats := dnsProxy.CoalescingStats()
+	assert.Equal(t, uint64(2), stats.Exchanges)
+	assert.Equal(t, uint64(0), stats.Coalesced)
+}
+
+func TestCoalesceRequestsSubnet(t *testing.T) {
+	u := &slowUpstream{delay: 200 * time.Millisecond}
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	dnsProxy.CoalesceRequests = true
+	dnsProxy.EnableEDNSClientSubnet = true
+
+	clients := []net.IP{
+		{1, 2, 3, 1},
+		{1, 2, 3, 2}, // same /24 as the first one
+		{2, 2, 3, 1},
+	}
+
+	g := &sync.WaitGroup{}
+	g.Add(len(clients))
+	for _, ip := range clients {
+		go func(ip net.IP) {
+			defer g.Done()
+
+			d := &DNSContext{
+				Req:  createHostTestMessage("example.org"),
+				Addr: &net.UDPAddr{IP: ip},
+			}
+			assert.Nil(t, dnsProxy.Resolve(d))
+			assert.Equal(t, d.Req.Id, d.Res.Id)
+		}(ip)
+	}
+	g.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.requests))
+	assert.Equal(t, uint64(1), dnsProxy.CoalescingStats().Coalesced)
+}
+
+func TestCoalesceRequestsPanic(t *testing.T) {
+	dnsProxy := Proxy{}
+	dnsProxy.CoalesceRequests = true
+
+	started := make(chan struct{})
+	waiter := make(chan error)
+	go func() {
+		<-started
+		d := &DNSContext{Req: createHostTestMessage("example.org")}
+		_, _, err := dnsProxy.exchangeCoalesced(d, func() (*dns.Msg, upstream.Upstream, error) {
+			t.Error("the in-flight exchange must be waited for")
+			return nil, nil, nil
+		})
+		waiter <- err
+	}()
+
+	func() {
+		defer func() { assert.NotNil(t, recover()) }()
+		d := &DNSContext{Req: createHostTestMessage("example.org")}
+		_, _, _ = dnsProxy.exchangeCoalesced(d, func() (*dns.Msg, upstream.Upstream, error) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			panic("exchange failed")
+		})
+	}()
+
+	// the waiter gets an error and the in-flight exchange is removed
+	assert.Equal(t, errCoalescedExchangeFailed, <-waiter)
+	assert.Empty(t, dnsProxy.coalescer.inflight)
+}
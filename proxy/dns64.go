@@ -97,7 +97,7 @@ func (p *Proxy) createDNS64MappedResponse(newAResp, oldAAAAResp *dns.Msg) (*dns.
 // checkDNS64 is called when there is no answer for AAAA request and NAT64 prefix available.
 // this function creates modified A request from oldAAAAReq, exchanges it and returns DNS64 mapped response
 // oldAAAAReq is message with AAAA Question. oldAAAAResp is response for oldAAAAReq with empty answer section
-func (p *Proxy) checkDNS64(oldAAAAReq, oldAAAAResp *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+func (p *Proxy) checkDNS64(oldAAAAReq, oldAAAAResp *dns.Msg, upstreams []upstream.Upstream, strategy UpstreamStrategy) (*dns.Msg, upstream.Upstream, error) {
 	// Let's create A request to the same hostname
 	modifiedAReq, err := createModifiedARequest(oldAAAAReq)
 	if err != nil {
@@ -106,7 +106,7 @@ func (p *Proxy) checkDNS64(oldAAAAReq, oldAAAAResp *dns.Msg, upstreams []upstrea
 	}
 
 	// Exchange new A request with selected upstreams
-	newAResp, u, err := p.exchange(modifiedAReq, upstreams)
+	newAResp, u, err := p.exchange(modifiedAReq, upstreams, strategy)
 	if err != nil {
 		log.Tracef("Failed to exchange DNS64 request: %s", err)
 		return nil, nil, err
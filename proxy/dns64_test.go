@@ -25,7 +25,7 @@ func TestProxyWithDNS64(t *testing.T) {
 
 	// Let's create test A request to ipv4OnlyHost and exchange it with test proxy
 	req := createHostTestMessage(ipv4OnlyHost)
-	resp, _, err := dnsProxy.exchange(req, dnsProxy.Upstreams)
+	resp, _, err := dnsProxy.exchange(req, dnsProxy.Upstreams, nil)
 	if err != nil {
 		t.Fatalf("Can not exchange test message for %s cause: %s", ipv4OnlyHost, err)
 	}
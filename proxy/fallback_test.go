@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// rcodeUpstream responds with the specified response code after a delay
+type rcodeUpstream struct {
+	addr  string
+	rcode int
+	delay time.Duration
+}
+
+func (u *rcodeUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	time.Sleep(u.delay)
+	resp := dns.Msg{}
+	resp.SetRcode(m, u.rcode)
+	if u.rcode == dns.RcodeSuccess {
+		resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+	}
+	return &resp, nil
+}
+
+func (u *rcodeUpstream) Address() string {
+	return u.addr
+}
+
+func TestFallbackRcodes(t *testing.T) {
+	servfail := &rcodeUpstream{addr: "servfail", rcode: dns.RcodeServerFailure}
+	refused := &rcodeUpstream{addr: "refused", rcode: dns.RcodeRefused}
+	good := &rcodeUpstream{addr: "good", rcode: dns.RcodeSuccess}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{servfail, good}
+	dnsProxy.UpstreamStrategy = NewStrictOrderStrategy()
+	dnsProxy.Init()
+
+	// SERVFAIL is a valid response by default
+	d := DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, servfail, d.Upstream)
+
+	// the next upstream is tried
+	dnsProxy.FallbackRcodes = []int{dns.RcodeServerFailure, dns.RcodeRefused}
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, good, d.Upstream)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+
+	// the fallback is tried
+	dnsProxy.Upstreams = []upstream.Upstream{refused, servfail}
+	dnsProxy.Fallbacks = []upstream.Upstream{good}
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, good, d.Upstream)
+
+	// the first failure response is returned if there's nothing better
+	dnsProxy.Fallbacks = []upstream.Upstream{servfail}
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, refused, d.Upstream)
+	assert.Equal(t, dns.RcodeRefused, d.Res.Rcode)
+
+	// the same with the hedged requests
+	dnsProxy.HedgeDelay = time.Hour
+	dnsProxy.Upstreams = []upstream.Upstream{refused, servfail, good}
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, good, d.Upstream)
+
+	dnsProxy.Upstreams = []upstream.Upstream{refused, servfail}
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, refused, d.Upstream)
+}
+
+func TestFallbackRcodesParallel(t *testing.T) {
+	servfail := &rcodeUpstream{addr: "servfail", rcode: dns.RcodeServerFailure}
+	refused := &rcodeUpstream{addr: "refused", rcode: dns.RcodeRefused}
+	good := &rcodeUpstream{addr: "good", rcode: dns.RcodeSuccess, delay: 100 * time.Millisecond}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{servfail, good}
+	dnsProxy.AllServers = true
+	dnsProxy.Init()
+
+	// the slower good answer is preferred over SERVFAIL
+	d := DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, good, d.Upstream)
+
+	// SERVFAIL is returned if there's nothing better
+	dnsProxy.Upstreams = []upstream.Upstream{servfail, &rcodeUpstream{addr: "servfail2", rcode: dns.RcodeServerFailure}}
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+
+	// custom failure response codes
+	dnsProxy.FallbackRcodes = []int{dns.RcodeRefused}
+	dnsProxy.Upstreams = []upstream.Upstream{refused, good}
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, good, d.Upstream)
+}
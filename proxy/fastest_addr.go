@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+const (
+	defaultFastestAddrTimeout = 1 * time.Second  // default TCP connection deadline for the probes
+	fastestAddrCacheTTL       = 10 * time.Minute // how long the successful probe results are cached
+	fastestAddrFailureTTL     = 30 * time.Second // how long the failed probe results are cached
+)
+
+// fastestAddrPorts are the ports the probes connect to
+var fastestAddrPorts = []int{80, 443}
+
+// probeResult is the cached result of probing an IP address
+type probeResult struct {
+	ok      bool          // false if no connection could be established
+	latency time.Duration // connection time
+}
+
+// fastestAddr chooses the IP address with the lowest TCP connection time (see Config.FastestAddr)
+type fastestAddr struct {
+	probes  *gocache.Cache // IP address -> probeResult
+	ports   []int          // ports to connect to
+	timeout time.Duration  // connection deadline
+}
+
+// newFastestAddr creates a new fastestAddr instance
+func newFastestAddr(timeout time.Duration) *fastestAddr {
+	if timeout <= 0 {
+		timeout = defaultFastestAddrTimeout
+	}
+	return &fastestAddr{
+		probes:  gocache.New(fastestAddrCacheTTL, fastestAddrCacheTTL),
+		ports:   fastestAddrPorts,
+		timeout: timeout,
+	}
+}
+
+// exchangeFastest sends the request to all the upstreams, probes all the IP addresses from their answers
+// and returns the response with the single IP address that was the fastest to connect to.
+// The response is returned as is if no address could be connected to.
+func (f *fastestAddr) exchangeFastest(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	results, err := upstream.ExchangeAll(upstreams, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// prefer the successful responses if no address is chosen
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Resp.Rcode == dns.RcodeSuccess && results[j].Resp.Rcode != dns.RcodeSuccess
+	})
+
+	// IP address -> the first result that contains it
+	owners := map[string]*upstream.ExchangeAllResult{}
+	ips := []net.IPAddr{}
+	for i := range results {
+		var answerIPs []net.IPAddr
+		proxyutil.AppendIPAddrs(&answerIPs, results[i].Resp.Answer)
+		for _, ip := range answerIPs {
+			if _, ok := owners[ip.IP.String()]; ok {
+				continue
+			}
+			owners[ip.IP.String()] = &results[i]
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) < 2 || isDNSSECRequest(req) {
+		// the DNSSEC-aware clients get the responses as they are, the filtered RRsets can't be validated
+		return results[0].Resp, results[0].Upstream, nil
+	}
+
+	fastest, ok := f.fastest(ips)
+	if !ok {
+		log.Tracef("%s: none of %d addresses is reachable", req.Question[0].Name, len(ips))
+		return results[0].Resp, results[0].Upstream, nil
+	}
+
+	log.Tracef("%s: the fastest address is %s", req.Question[0].Name, fastest)
+	owner := owners[fastest.String()]
+	return filterAnswerIP(owner.Resp, fastest), owner.Upstream, nil
+}
+
+// fastest returns the IP address with the lowest connection time
+// The addresses that were probed recently are not probed again.
+func (f *fastestAddr) fastest(ips []net.IPAddr) (net.IP, bool) {
+	var best net.IP
+	var bestLatency time.Duration
+
+	toProbe := []net.IP{}
+	for _, ip := range ips {
+		v, found := f.probes.Get(ip.IP.String())
+		if !found {
+			toProbe = append(toProbe, ip.IP)
+			continue
+		}
+		res := v.(probeResult)
+		if res.ok && (best == nil || res.latency < bestLatency) {
+			best = ip.IP
+			bestLatency = res.latency
+		}
+	}
+
+	if len(toProbe) == 0 {
+		return best, best != nil
+	}
+
+	// wait for the first address to connect, the rest of the probes will cache their results
+	type probeReply struct {
+		ip  net.IP
+		res probeResult
+	}
+	ch := make(chan probeReply, len(toProbe))
+	for _, ip := range toProbe {
+		go func(ip net.IP) {
+			ch <- probeReply{ip: ip, res: f.probe(ip)}
+		}(ip)
+	}
+
+	for range toProbe {
+		r := <-ch
+		if !r.res.ok {
+			continue
+		}
+		if best == nil || r.res.latency < bestLatency {
+			best = r.ip
+			bestLatency = r.res.latency
+		}
+		break
+	}
+	return best, best != nil
+}
+
+// probe connects to the IP address on every port in parallel and caches the result
+// The failures are cached for a shorter time so that the addresses that were down temporarily are probed again soon.
+func (f *fastestAddr) probe(ip net.IP) probeResult {
+	ch := make(chan probeResult, len(f.ports))
+	for _, port := range f.ports {
+		go func(port int) {
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), f.timeout)
+			if err != nil {
+				ch <- probeResult{}
+				return
+			}
+			_ = conn.Close()
+			ch <- probeResult{ok: true, latency: time.Since(start)}
+		}(port)
+	}
+
+	res := probeResult{}
+	for range f.ports {
+		res = <-ch
+		if res.ok {
+			break
+		}
+	}
+	ttl := gocache.DefaultExpiration
+	if !res.ok {
+		ttl = fastestAddrFailureTTL
+	}
+	f.probes.Set(ip.String(), res, ttl)
+	return res
+}
+
+// filterAnswerIP returns a copy of the response with the only A or AAAA record that contains the specified IP
+// The response is returned as is if its A or AAAA records are signed, since the signatures
+// wouldn't match the filtered RRset.
+func filterAnswerIP(resp *dns.Msg, ip net.IP) *dns.Msg {
+	for _, rr := range resp.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok && (sig.TypeCovered == dns.TypeA || sig.TypeCovered == dns.TypeAAAA) {
+			return resp
+		}
+	}
+
+	filtered := resp.Copy()
+	filtered.Answer = nil
+	for _, rr := range resp.Answer {
+		switch a := rr.(type) {
+		case *dns.A:
+			if !a.A.Equal(ip) {
+				continue
+			}
+		case *dns.AAAA:
+			if !a.AAAA.Equal(ip) {
+				continue
+			}
+		}
+		filtered.Answer = append(filtered.Answer, dns.Copy(rr))
+	}
+	return filtered
+}
+
+// isDNSSECRequest checks if the DNSSEC records are requested (the DO bit is set)
+func isDNSSECRequest(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// isAddrRequest checks if it's an A or AAAA request
+func isAddrRequest(req *dns.Msg) bool {
+	if len(req.Question) != 1 {
+		return false
+	}
+	qType := req.Question[0].Qtype
+	return qType == dns.TypeA || qType == dns.TypeAAAA
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// addrUpstream answers A requests with the specified IP addresses
+type addrUpstream struct {
+	addr   string
+	ips    []string
+	signed bool // if true, the A records are followed by their RRSIG
+}
+
+func (u *addrUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, newRR(m.Question[0].Name+" 60 IN CNAME cdn.example.org."))
+	for _, ip := range u.ips {
+		resp.Answer = append(resp.Answer, newRR("cdn.example.org. 60 IN A "+ip))
+	}
+	if u.signed {
+		resp.Answer = append(resp.Answer, newRR("cdn.example.org. 60 IN RRSIG A 8 3 60 20300101000000 20200101000000 12345 example.org. AAAA"))
+	}
+	return &resp, nil
+}
+
+func (u *addrUpstream) Address() string {
+	return u.addr
+}
+
+func TestFastestAddr(t *testing.T) {
+	// only 127.0.0.2 accepts connections
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+
+	u1 := &addrUpstream{addr: "u1", ips: []string{"127.0.0.1", "127.0.0.3"}}
+	u2 := &addrUpstream{addr: "u2", ips: []string{"127.0.0.3", "127.0.0.2"}}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{u1, u2}
+	dnsProxy.FastestAddr = true
+	dnsProxy.Init()
+	dnsProxy.fastestAddr.ports = []int{port}
+
+	d := DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, u2, d.Upstream)
+	assert.Len(t, d.Res.Answer, 2)
+	assert.IsType(t, &dns.CNAME{}, d.Res.Answer[0])
+	assert.Equal(t, net.ParseIP("127.0.0.2").To4(), getIPFromResponse(d.Res).To4())
+
+	// all the addresses have been probed
+	assert.Eventually(t, func() bool {
+		return dnsProxy.fastestAddr.probes.ItemCount() == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// the failures are cached for a shorter time
+	items := dnsProxy.fastestAddr.probes.Items()
+	failureDeadline := time.Now().Add(fastestAddrFailureTTL).UnixNano()
+	assert.True(t, items["127.0.0.1"].Expiration <= failureDeadline)
+	assert.True(t, items["127.0.0.3"].Expiration <= failureDeadline)
+	assert.True(t, items["127.0.0.2"].Expiration > failureDeadline)
+
+	// the cached probe results are used
+	_ = l.Close()
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, net.ParseIP("127.0.0.2").To4(), getIPFromResponse(d.Res).To4())
+
+	// none of the addresses is reachable, the response is returned as is
+	dnsProxy.fastestAddr.probes.Flush()
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Len(t, d.Res.Answer, 3)
+
+	// other requests are sent as usual
+	req := createHostTestMessage("google.com")
+	req.Question[0].Qtype = dns.TypeTXT
+	d = DNSContext{Req: req}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, u1, d.Upstream)
+}
+
+func TestFastestAddrDNSSEC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer l.Close()
+
+	u := &addrUpstream{addr: "u", ips: []string{"127.0.0.1", "127.0.0.2"}}
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	dnsProxy.FastestAddr = true
+	dnsProxy.Init()
+	dnsProxy.fastestAddr.ports = []int{l.Addr().(*net.TCPAddr).Port}
+
+	// the DNSSEC-aware clients get the whole RRset
+	req := createHostTestMessage("google.com")
+	req.SetEdns0(4096, true)
+	d := DNSContext{Req: req}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Len(t, d.Res.Answer, 3)
+
+	// the signed RRset is not filtered either
+	u.signed = true
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Len(t, d.Res.Answer, 4)
+
+	// the unsigned one is
+	u.signed = false
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Len(t, d.Res.Answer, 2)
+	assert.Equal(t, net.ParseIP("127.0.0.2").To4(), getIPFromResponse(d.Res).To4())
+}
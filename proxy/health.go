@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultHealthCheckName     = "ipv4only.arpa." // default name that is resolved by the health probes
+	defaultHealthCheckFailures = 3                // default number of consecutive failures that take an upstream out of rotation
+)
+
+// defaultHealthCheckRcodes are the response codes that are considered as failures if Config.FallbackRcodes is empty
+var defaultHealthCheckRcodes = []int{dns.RcodeServerFailure, dns.RcodeRefused}
+
+// UpstreamHealth is the health state of an upstream
+type UpstreamHealth struct {
+	Address             string    `json:"address"`              // upstream address
+	Healthy             bool      `json:"healthy"`              // false if the upstream is taken out of rotation
+	ConsecutiveFailures int       `json:"consecutive_failures"` // number of failed queries and probes in a row
+	LastError           string    `json:"last_error,omitempty"` // the last query or probe error
+	LastProbe           time.Time `json:"last_probe"`           // time of the last health probe
+}
+
+// upstreamHealth is the circuit breaker state of an upstream
+type upstreamHealth struct {
+	u         upstream.Upstream
+	healthy   bool
+	failures  int // consecutive failures
+	lastError error
+	lastProbe time.Time
+}
+
+// healthChecker probes the upstreams in the background and keeps track of their health
+// An upstream is taken out of rotation after a number of consecutive failures (of both
+// client queries and probes), and it is brought back as soon as a probe succeeds.
+type healthChecker struct {
+	interval  time.Duration // interval between the probes
+	probeName string        // name to resolve
+	failures  int           // number of consecutive failures that make an upstream unhealthy
+	rcodes    []int         // response codes that are considered as failures (see Config.FallbackRcodes)
+
+	upstreams  map[upstream.Upstream]*upstreamHealth // health state of the upstreams
+	order      []upstream.Upstream                   // upstreams in the order they were configured
+	sync.Mutex                                       // protects upstreams
+
+	stop chan struct{} // closed to stop probing
+	wg   sync.WaitGroup
+}
+
+// newHealthChecker creates a health checker for all the upstreams from the proxy configuration
+func newHealthChecker(config *Config) *healthChecker {
+	h := &healthChecker{
+		interval:  config.HealthCheckInterval,
+		probeName: dns.Fqdn(config.HealthCheckName),
+		failures:  config.HealthCheckFailures,
+		rcodes:    config.FallbackRcodes,
+		upstreams: map[upstream.Upstream]*upstreamHealth{},
+	}
+	if config.HealthCheckName == "" {
+		h.probeName = defaultHealthCheckName
+	}
+	if h.failures <= 0 {
+		h.failures = defaultHealthCheckFailures
+	}
+	if len(h.rcodes) == 0 {
+		h.rcodes = defaultHealthCheckRcodes
+	}
+
+	h.add(config.Upstreams)
+	h.add(config.Fallbacks)
+	for _, upstreams := range config.DomainsReservedUpstreams {
+		h.add(upstreams)
+	}
+	return h
+}
+
+// add adds the upstreams to the health checker
+func (h *healthChecker) add(upstreams []upstream.Upstream) {
+	for _, u := range upstreams {
+		if _, ok := h.upstreams[u]; ok {
+			continue
+		}
+		h.upstreams[u] = &upstreamHealth{u: u, healthy: true}
+		h.order = append(h.order, u)
+	}
+}
+
+// start starts probing the upstreams in the background
+func (h *healthChecker) start() {
+	h.stop = make(chan struct{})
+	h.wg.Add(1)
+	go h.loop()
+}
+
+// close stops probing the upstreams and waits for the probes in progress
+func (h *healthChecker) close() {
+	close(h.stop)
+	h.wg.Wait()
+}
+
+func (h *healthChecker) loop() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.probeAll()
+		}
+	}
+}
+
+// probeAll probes all the upstreams in parallel and waits for the results
+func (h *healthChecker) probeAll() {
+	h.Lock()
+	upstreams := make([]upstream.Upstream, len(h.order))
+	copy(upstreams, h.order)
+	h.Unlock()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(len(upstreams))
+	for _, u := range upstreams {
+		go func(u upstream.Upstream) {
+			defer wg.Done()
+			h.probe(u)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// probe sends the probe request to the upstream and updates its health
+func (h *healthChecker) probe(u upstream.Upstream) {
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.Question = []dns.Question{{Name: h.probeName, Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+
+	reply, err := u.Exchange(req)
+	if err == nil {
+		err = h.rcodeError(reply)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.upstreams[u]
+	if !ok {
+		return
+	}
+	s.lastProbe = time.Now()
+	if err == nil {
+		if !s.healthy {
+			log.Printf("Upstream %s is healthy again", u.Address())
+		}
+		s.healthy = true
+		s.failures = 0
+		return
+	}
+	h.failed(s, err)
+}
+
+// report records the result of a client query to the upstream
+// The responses with one of the failure response codes are failures, the same as for the probes.
+func (h *healthChecker) report(u upstream.Upstream, reply *dns.Msg, err error) {
+	if err == nil {
+		err = h.rcodeError(reply)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.upstreams[u]
+	if !ok {
+		return
+	}
+	if err == nil {
+		// a successful query only resets the failures counter,
+		// an unhealthy upstream is brought back by the probes
+		s.failures = 0
+		return
+	}
+	h.failed(s, err)
+}
+
+// rcodeError returns an error if the response code of the reply is considered as a failure
+func (h *healthChecker) rcodeError(reply *dns.Msg) error {
+	if reply == nil {
+		return nil
+	}
+	for _, rcode := range h.rcodes {
+		if reply.Rcode == rcode {
+			return rcodeError(reply.Rcode)
+		}
+	}
+	return nil
+}
+
+// failed records the failure and takes the upstream out of rotation if needed
+// h must be locked
+func (h *healthChecker) failed(s *upstreamHealth, err error) {
+	s.failures++
+	s.lastError = err
+	if s.healthy && s.failures >= h.failures {
+		log.Printf("Upstream %s failed %d times in a row and is taken out of rotation: %s", s.u.Address(), s.failures, err)
+		s.healthy = false
+	}
+}
+
+// isHealthy checks if the upstream is in rotation
+// Unknown upstreams (i.e. custom upstreams from DNSContext) are always considered healthy
+func (h *healthChecker) isHealthy(u upstream.Upstream) bool {
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.upstreams[u]
+	return !ok || s.healthy
+}
+
+// filter returns the upstreams that are in rotation
+// If none of them is, all the upstreams are returned as there's nothing better to try.
+func (h *healthChecker) filter(upstreams []upstream.Upstream) []upstream.Upstream {
+	healthy := make([]upstream.Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if h.isHealthy(u) {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return upstreams
+	}
+	return healthy
+}
+
+// state returns the health state of all the upstreams
+func (h *healthChecker) state() []UpstreamHealth {
+	h.Lock()
+	defer h.Unlock()
+
+	state := make([]UpstreamHealth, 0, len(h.order))
+	for _, u := range h.order {
+		s := h.upstreams[u]
+		uh := UpstreamHealth{
+			Address:             u.Address(),
+			Healthy:             s.healthy,
+			ConsecutiveFailures: s.failures,
+			LastProbe:           s.lastProbe,
+		}
+		if s.lastError != nil {
+			uh.LastError = s.lastError.Error()
+		}
+		state = append(state, uh)
+	}
+	return state
+}
+
+// rcodeError is returned when an upstream responds with a failure response code
+type rcodeError int
+
+func (e rcodeError) Error() string {
+	return "upstream responded with " + dns.RcodeToString[int(e)]
+}
+
+// UpstreamHealth returns the health state of the configured upstreams
+// (including the fallback and the domain-reserved upstreams).
+// Returns nil if the health checking is disabled (see Config.HealthCheckInterval).
+func (p *Proxy) UpstreamHealth() []UpstreamHealth {
+	p.RLock()
+	h := p.health
+	p.RUnlock()
+	if h == nil {
+		return nil
+	}
+	return h.state()
+}
+
+// healthyUpstreams returns the upstreams that are in rotation (see healthChecker.filter)
+func (p *Proxy) healthyUpstreams(upstreams []upstream.Upstream) []upstream.Upstream {
+	h := p.health
+	if h == nil {
+		return upstreams
+	}
+	return h.filter(upstreams)
+}
+
+// reportHealth records the result of a client query to the upstream
+func (p *Proxy) reportHealth(u upstream.Upstream, reply *dns.Msg, err error) {
+	if p.health != nil {
+		p.health.report(u, reply, err)
+	}
+}
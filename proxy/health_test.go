@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyUpstream fails while the failing flag is set and counts the requests
+type flakyUpstream struct {
+	addr     string
+	failing  int32
+	requests int32
+}
+
+func (u *flakyUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.requests, 1)
+	if atomic.LoadInt32(&u.failing) != 0 {
+		return nil, errors.New("upstream is down")
+	}
+
+	resp := dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 1.2.3.4")}
+	return &resp, nil
+}
+
+func (u *flakyUpstream) Address() string {
+	return u.addr
+}
+
+func (u *flakyUpstream) setFailing(failing bool) {
+	v := int32(0)
+	if failing {
+		v = 1
+	}
+	atomic.StoreInt32(&u.failing, v)
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	bad := &flakyUpstream{addr: "bad", failing: 1}
+	good := &flakyUpstream{addr: "good"}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{bad, good}
+	dnsProxy.HealthCheckInterval = time.Hour
+	dnsProxy.HealthCheckFailures = 2
+	dnsProxy.Init()
+	h := dnsProxy.health
+
+	// the first failure does not open the circuit
+	_, _, err := dnsProxy.exchange(createHostTestMessage("google.com"), []upstream.Upstream{bad}, nil)
+	assert.NotNil(t, err)
+	assert.True(t, h.isHealthy(bad))
+
+	// the probe fails as well and the upstream is taken out of rotation
+	h.probeAll()
+	assert.False(t, h.isHealthy(bad))
+	assert.True(t, h.isHealthy(good))
+	assert.Equal(t, []upstream.Upstream{good}, dnsProxy.healthyUpstreams(dnsProxy.Upstreams))
+
+	requests := atomic.LoadInt32(&bad.requests)
+	reply, u, err := dnsProxy.exchange(createHostTestMessage("google.com"), dnsProxy.Upstreams, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, reply)
+	assert.Equal(t, good, u)
+	assert.Equal(t, requests, atomic.LoadInt32(&bad.requests))
+
+	// nothing better to try if all the upstreams are out of rotation
+	assert.Equal(t, []upstream.Upstream{bad}, dnsProxy.healthyUpstreams([]upstream.Upstream{bad}))
+
+	state := dnsProxy.UpstreamHealth()
+	assert.Len(t, state, 2)
+	assert.Equal(t, "bad", state[0].Address)
+	assert.False(t, state[0].Healthy)
+	assert.Equal(t, 2, state[0].ConsecutiveFailures)
+	assert.Equal(t, "upstream is down", state[0].LastError)
+	assert.False(t, state[0].LastProbe.IsZero())
+	assert.True(t, state[1].Healthy)
+
+	// the upstream is back after a successful probe
+	bad.setFailing(false)
+	h.probeAll()
+	assert.True(t, h.isHealthy(bad))
+	assert.Equal(t, 0, dnsProxy.UpstreamHealth()[0].ConsecutiveFailures)
+}
+
+func TestUpstreamHealthParallel(t *testing.T) {
+	bad := &flakyUpstream{addr: "bad", failing: 1}
+	good := &flakyUpstream{addr: "good"}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{bad, good}
+	dnsProxy.HealthCheckInterval = time.Hour
+	dnsProxy.HealthCheckFailures = 2
+	dnsProxy.AllServers = true
+	dnsProxy.Init()
+	h := dnsProxy.health
+
+	// the failures of the parallel queries are reported too
+	for i := 0; i < 2; i++ {
+		_, u, err := dnsProxy.exchange(createHostTestMessage("google.com"), dnsProxy.Upstreams, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, good, u)
+	}
+	assert.Eventually(t, func() bool {
+		return !h.isHealthy(bad)
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, h.isHealthy(good))
+
+	// and so are the ones of the fastest address queries
+	bad.setFailing(false)
+	h.probeAll()
+	assert.True(t, h.isHealthy(bad))
+	bad.setFailing(true)
+	dnsProxy.FastestAddr = true
+	dnsProxy.AllServers = false
+	dnsProxy.Init()
+	h = dnsProxy.health
+	for i := 0; i < 2; i++ {
+		_, u, err := dnsProxy.exchange(createHostTestMessage("google.com"), dnsProxy.Upstreams, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, good, u)
+	}
+	assert.False(t, h.isHealthy(bad))
+	assert.True(t, h.isHealthy(good))
+}
+
+func TestUpstreamHealthProbes(t *testing.T) {
+	u := &flakyUpstream{addr: "flaky"}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Upstreams = []upstream.Upstream{u}
+	dnsProxy.HealthCheckInterval = 50 * time.Millisecond
+	dnsProxy.HealthCheckFailures = 1
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	u.setFailing(true)
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, dnsProxy.UpstreamHealth()[0].Healthy)
+
+	u.setFailing(false)
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, dnsProxy.UpstreamHealth()[0].Healthy)
+	assert.True(t, atomic.LoadInt32(&u.requests) > 2)
+}
+
+func TestUpstreamHealthRcodes(t *testing.T) {
+	servfail := &rcodeUpstream{addr: "servfail", rcode: dns.RcodeServerFailure}
+	refused := &rcodeUpstream{addr: "refused", rcode: dns.RcodeRefused}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{servfail, refused}
+	dnsProxy.HealthCheckInterval = time.Hour
+	dnsProxy.HealthCheckFailures = 2
+	dnsProxy.Init()
+	h := dnsProxy.health
+
+	// SERVFAIL and REFUSED are failures of both the queries and the probes by default
+	_, _, err := dnsProxy.exchange(createHostTestMessage("google.com"), []upstream.Upstream{servfail}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dnsProxy.UpstreamHealth()[0].ConsecutiveFailures)
+	h.probeAll()
+	assert.False(t, h.isHealthy(servfail))
+	assert.True(t, h.isHealthy(refused))
+	h.probeAll()
+	assert.False(t, h.isHealthy(refused))
+
+	// FallbackRcodes are used for both if set
+	dnsProxy.FallbackRcodes = []int{dns.RcodeRefused}
+	dnsProxy.Init()
+	h = dnsProxy.health
+	for i := 0; i < 2; i++ {
+		_, _, err = dnsProxy.exchange(createHostTestMessage("google.com"), []upstream.Upstream{servfail}, nil)
+		assert.Nil(t, err)
+		_, _, err = dnsProxy.exchange(createHostTestMessage("google.com"), []upstream.Upstream{refused}, nil)
+		assert.Nil(t, err)
+	}
+	assert.True(t, h.isHealthy(servfail))
+	assert.False(t, h.isHealthy(refused))
+	h.probeAll()
+	assert.True(t, h.isHealthy(servfail))
+	assert.False(t, h.isHealthy(refused))
+}
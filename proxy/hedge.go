@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+const (
+	hedgeWindowSize = 100  // number of the recent RTT samples used to calculate the adaptive hedging delay
+	hedgeMinSamples = 20   // minimum number of samples for the adaptive hedging delay
+	hedgePercentile = 0.95 // percentile of the recent RTT that is used as the adaptive hedging delay
+)
+
+// rttWindow keeps the recent RTT samples of an upstream
+type rttWindow struct {
+	samples []time.Duration
+	next    int // index of the oldest sample once the window is full
+}
+
+// add adds a new sample replacing the oldest one if the window is full
+func (w *rttWindow) add(rtt time.Duration) {
+	if len(w.samples) < hedgeWindowSize {
+		w.samples = append(w.samples, rtt)
+		return
+	}
+	w.samples[w.next] = rtt
+	w.next = (w.next + 1) % hedgeWindowSize
+}
+
+// percentile returns the specified percentile of the samples
+func (w *rttWindow) percentile(q float64) time.Duration {
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+// hedgeStats keeps the recent RTT of the upstreams (see Config.HedgeAdaptive)
+type hedgeStats struct {
+	windows map[string]*rttWindow // upstream address -> recent RTT
+	sync.Mutex
+}
+
+// hedgeResult is the result of one of the hedged exchanges
+type hedgeResult struct {
+	reply *dns.Msg
+	u     upstream.Upstream
+	rtt   time.Duration
+	err   error
+}
+
+// exchangeHedged sends the request to the first upstream and if it doesn't answer within the hedging delay,
+// sends it to the next one as well, and so on. The first successful response is returned,
+// and the exchanges that are still in progress are cancelled.
+// A failed exchange (or a response with one of FallbackRcodes) makes the next upstream to be tried immediately.
+func (p *Proxy) exchangeHedged(req *dns.Msg, upstreams []upstream.Upstream, strategy UpstreamStrategy) (*dns.Msg, upstream.Upstream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the channel must accommodate the results of all the exchanges
+	// so that the cancelled ones are not blocked
+	ch := make(chan hedgeResult, len(upstreams))
+	next := 0
+	start := func() *time.Timer {
+		u := upstreams[next]
+		next++
+		go func() {
+			startTime := time.Now()
+			reply, err := upstream.ExchangeContext(ctx, u, req)
+			ch <- hedgeResult{reply: reply, u: u, rtt: time.Since(startTime), err: err}
+		}()
+		if next == len(upstreams) {
+			return nil
+		}
+		return time.NewTimer(p.hedgeDelay(u))
+	}
+
+	timer := start()
+	pending := 1
+	errs := []error{}
+	var failure *hedgeResult // the first response with one of FallbackRcodes
+	for {
+		var timeout <-chan time.Time
+		if timer != nil {
+			timeout = timer.C
+		}
+
+		select {
+		case res := <-ch:
+			pending--
+			p.reportHealth(res.u, res.reply, res.err)
+			p.recordStats(res.u, res.rtt, res.reply, res.err)
+			strategy.Update(res.u, res.rtt, res.err)
+			if res.err == nil && p.isFallbackRcode(res.reply) {
+				log.Tracef("upstream %s responded to %s with %s", res.u.Address(), req.Question[0].String(), dns.RcodeToString[res.reply.Rcode])
+				if failure == nil {
+					failure = &res
+				}
+			} else if res.err == nil {
+				p.updateHedgeStats(res.u, res.rtt)
+				if timer != nil {
+					timer.Stop()
+				}
+				return res.reply, res.u, nil
+			} else {
+				log.Tracef("upstream %s failed to exchange %s: %s", res.u.Address(), req.Question[0].String(), res.err)
+				errs = append(errs, res.err)
+			}
+
+			if next < len(upstreams) {
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = start()
+				pending++
+			} else if pending == 0 {
+				if failure != nil {
+					return failure.reply, failure.u, nil
+				}
+				return nil, nil, errorx.DecorateMany("all upstreams failed to exchange request", errs...)
+			}
+
+		case <-timeout:
+			log.Tracef("no response to %s within the hedging delay, sending it to %s as well", req.Question[0].String(), upstreams[next].Address())
+			timer = start()
+			pending++
+		}
+	}
+}
+
+// hedgeDelay returns the time to wait for the upstream before sending the request to the next one
+func (p *Proxy) hedgeDelay(u upstream.Upstream) time.Duration {
+	if !p.HedgeAdaptive {
+		return p.HedgeDelay
+	}
+
+	p.hedgeStats.Lock()
+	defer p.hedgeStats.Unlock()
+	w, ok := p.hedgeStats.windows[u.Address()]
+	if !ok || len(w.samples) < hedgeMinSamples {
+		return p.HedgeDelay
+	}
+	if d := w.percentile(hedgePercentile); d < p.HedgeDelay {
+		return d
+	}
+	return p.HedgeDelay
+}
+
+// updateHedgeStats records the RTT of a successful exchange
+func (p *Proxy) updateHedgeStats(u upstream.Upstream, rtt time.Duration) {
+	if !p.HedgeAdaptive {
+		return
+	}
+
+	p.hedgeStats.Lock()
+	defer p.hedgeStats.Unlock()
+	if p.hedgeStats.windows == nil {
+		p.hedgeStats.windows = map[string]*rttWindow{}
+	}
+	w, ok := p.hedgeStats.windows[u.Address()]
+	if !ok {
+		w = &rttWindow{}
+		p.hedgeStats.windows[u.Address()] = w
+	}
+	w.add(rtt)
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// hangingUpstream never answers and records if the exchange was cancelled
+type hangingUpstream struct {
+	cancelled int32
+}
+
+func (u *hangingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return u.ExchangeContext(context.Background(), m)
+}
+
+func (u *hangingUpstream) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	<-ctx.Done()
+	atomic.StoreInt32(&u.cancelled, 1)
+	return nil, ctx.Err()
+}
+
+func (u *hangingUpstream) Address() string {
+	return "hanging"
+}
+
+func TestHedgedExchange(t *testing.T) {
+	hanging := &hangingUpstream{}
+	slow := &slowUpstream{delay: 100 * time.Millisecond}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{hanging, slow}
+	dnsProxy.UpstreamStrategy = NewStrictOrderStrategy()
+	dnsProxy.HedgeDelay = 50 * time.Millisecond
+	dnsProxy.Init()
+
+	start := time.Now()
+	d := DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, slow, d.Upstream)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// the losing exchange is cancelled
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&hanging.cancelled) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHedgedExchangeFailure(t *testing.T) {
+	bad := &flakyUpstream{addr: "bad", failing: 1}
+	slow := &slowUpstream{delay: 10 * time.Millisecond}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{bad, slow}
+	dnsProxy.UpstreamStrategy = NewStrictOrderStrategy()
+	dnsProxy.HedgeDelay = time.Hour
+	dnsProxy.Init()
+
+	// the next upstream is tried right after the failure
+	d := DNSContext{Req: createHostTestMessage("google.com")}
+	assert.Nil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, slow, d.Upstream)
+
+	// all upstreams failed
+	dnsProxy.Upstreams = []upstream.Upstream{bad, &flakyUpstream{addr: "bad2", failing: 1}}
+	d = DNSContext{Req: createHostTestMessage("google.com")}
+	assert.NotNil(t, dnsProxy.Resolve(&d))
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+}
+
+func TestHedgeAdaptiveDelay(t *testing.T) {
+	u := &flakyUpstream{addr: "u"}
+
+	dnsProxy := Proxy{}
+	dnsProxy.HedgeDelay = time.Second
+	dnsProxy.HedgeAdaptive = true
+
+	// not enough samples yet
+	dnsProxy.updateHedgeStats(u, 10*time.Millisecond)
+	assert.Equal(t, time.Second, dnsProxy.hedgeDelay(u))
+
+	for i := 1; i <= hedgeWindowSize; i++ {
+		dnsProxy.updateHedgeStats(u, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 95*time.Millisecond, dnsProxy.hedgeDelay(u))
+
+	// the delay is not more than HedgeDelay
+	for i := 0; i < hedgeWindowSize; i++ {
+		dnsProxy.updateHedgeStats(u, 2*time.Second)
+	}
+	assert.Equal(t, time.Second, dnsProxy.hedgeDelay(u))
+}
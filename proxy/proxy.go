@@ -9,7 +9,6 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -42,6 +41,9 @@ const (
 	ProtoHTTPS = "https"
 	// UnqualifiedNames is reserved name for "unqualified names only", ie names without dots
 	UnqualifiedNames = "unqualified_names"
+	// SearchDomains is reserved name for the upstreams that are used for their own search domains
+	// (see upstream.SearchDomainsUpstream), the search domains are checked on every lookup as they may change
+	SearchDomains = "search_domains"
 )
 
 // BeforeRequestHandler is an optional custom handler called before DNS requests
@@ -54,6 +56,7 @@ type BeforeRequestHandler func(p *Proxy, d *DNSContext) (bool, error)
 type RequestHandler func(p *Proxy, d *DNSContext) error
 
 // ResponseHandler is a callback method that is called when DNS query has been processed
+// It's called for the responses served from the cache too, DNSContext.FromCache is set then.
 // d -- current DNS query context (contains response if it was successful)
 // err -- error (if any)
 type ResponseHandler func(d *DNSContext, err error)
@@ -66,9 +69,11 @@ type Proxy struct {
 	tlsListen   net.Listener // TLS listener
 	httpsListen net.Listener // HTTPS listener
 	httpsServer *http.Server // HTTPS server instance
+	adminListen net.Listener // admin API listener
+	adminServer *http.Server // admin API server instance
 
-	upstreamRttStats map[string]int // Map of upstream addresses and their rtt. Used to sort upstreams "from fast to slow"
-	rttLock          sync.Mutex     // Synchronizes access to the upstreamRttStats map
+	defaultStrategy UpstreamStrategy // strategy of the groups that have none configured (see UpstreamStrategy)
+	strategyLock    sync.Mutex       // Synchronizes access to defaultStrategy
 
 	nat64Prefix []byte     // NAT 64 prefix
 	nat64Lock   sync.Mutex // Prefix lock
@@ -79,6 +84,16 @@ type Proxy struct {
 	cache       *cache       // cache instance (nil if cache is disabled)
 	cacheSubnet *cacheSubnet // cache instance (nil if cache is disabled)
 
+	coalescer coalescer // keeps track of in-flight upstream exchanges (see CoalesceRequests)
+
+	health *healthChecker // upstreams health checker (nil if HealthCheckInterval is not set)
+
+	upstreamStats *upstreamStats // counters of the configured upstreams (see UpstreamStats)
+
+	fastestAddr *fastestAddr // fastest address chooser (nil if FastestAddr is not set)
+
+	hedgeStats hedgeStats // recent upstreams RTT (see HedgeAdaptive)
+
 	Config // proxy configuration
 
 	maxGoroutines chan bool // limits the number of parallel queries. if nil, there's no limit
@@ -94,12 +109,36 @@ type Config struct {
 	TLSListenAddr   *net.TCPAddr // if nil, then it does not listen for TLS (DoT)
 	TLSConfig       *tls.Config  // necessary for listening for TLS
 
+	AdminListenAddr *net.TCPAddr // if nil, then it does not serve the admin HTTP API (see AdminHandler), listens on loopback if IP is not set
+	AdminToken      string       // if set, admin API requests must have the "Authorization: Bearer <token>" header, required for non-loopback AdminListenAddr
+
 	Ratelimit          int      // max number of requests per second from a given IP (0 to disable)
 	RatelimitWhitelist []string // a list of whitelisted client IP addresses
 
 	RefuseAny  bool // if true, refuse ANY requests
 	AllServers bool // if true, parallel queries to all configured upstream servers are enabled
 
+	// If true, A and AAAA requests are sent to all the upstreams in parallel,
+	// all the returned addresses are probed with a TCP connection to port 80 and 443,
+	// and the response contains the only address that was the fastest to connect to.
+	// The probe results are cached for 10 minutes.
+	FastestAddr        bool
+	FastestAddrTimeout time.Duration // TCP connection deadline for the probes. Default: 1s
+
+	// If set, the request is also sent to the next upstream if the previous one hasn't answered
+	// within this delay, and the first response is used. The exchanges that lost are cancelled.
+	// Ignored if AllServers is set.
+	HedgeDelay time.Duration
+	// If true, the hedging delay of an upstream is the 95th percentile of its recent response times
+	// (but not more than HedgeDelay, which is also used until there are enough samples).
+	HedgeAdaptive bool
+
+	// Response codes (e.g. SERVFAIL and REFUSED) that are considered as failures.
+	// The next upstream or the fallback upstreams are tried after such a response,
+	// and it's returned only if no better response was received.
+	// When querying the upstreams in parallel, only SERVFAIL is considered as a failure by default.
+	FallbackRcodes []int
+
 	// Enable EDNS Client Subnet option
 	// DNS requests to the upstream server will contain an OPT record with Client Subnet option.
 	//  If the original request already has this option set, we pass it through as is.
@@ -125,15 +164,41 @@ type Config struct {
 	CacheEnabled   bool // cache status
 	CacheSizeBytes int  // Cache size (in bytes). Default: 64k
 
+	// CacheStorage is a custom storage for the cached responses (see NewRedisCacheStorage).
+	// If nil, an in-memory LRU storage of CacheSizeBytes size is used.
+	// Note that the index of the ECS subnets (see EnableEDNSClientSubnet) is kept in memory, so the proxies that
+	// share the storage don't share the responses cached for the ECS subnets, only the other ones.
+	CacheStorage CacheStorage
+
+	// If true, identical requests received while the first one is still being resolved
+	// (see the key() function plus the CD and RD flags; the ECS subnet is taken into account when EnableEDNSClientSubnet is set)
+	// will wait for its result instead of being sent to the upstreams separately.
+	// Requests with custom upstreams (DNSContext.Upstreams) are never coalesced.
+	CoalesceRequests bool
+
+	// If set, the upstreams are probed in the background with this interval.
+	// An upstream is taken out of rotation after HealthCheckFailures consecutive failed
+	// queries or probes and it's brought back once a probe succeeds (see UpstreamHealth).
+	HealthCheckInterval time.Duration
+	HealthCheckName     string // name resolved by the health probes. Default: ipv4only.arpa
+	HealthCheckFailures int    // number of consecutive failures that take an upstream out of rotation. Default: 3
+	// The responses with one of FallbackRcodes (SERVFAIL and REFUSED if it's empty) are failures too.
+
 	Upstreams []upstream.Upstream // list of upstreams
 	Fallbacks []upstream.Upstream // list of fallback resolvers (which will be used if regular upstream failed to answer)
 
 	BeforeRequestHandler BeforeRequestHandler // callback that is called before each request
 	RequestHandler       RequestHandler       // callback that can handle incoming DNS requests
-	ResponseHandler      ResponseHandler      // response callback
+	ResponseHandler      ResponseHandler      // response callback, called for the cached responses too (see DNSContext.FromCache)
 
 	DomainsReservedUpstreams map[string][]upstream.Upstream // map of domains and lists of corresponding upstreams
 
+	// UpstreamStrategy decides in which order the upstreams are tried (see ParseUpstreamStrategies).
+	// It's used for the default upstreams and the reserved domains that have no strategy in DomainsReservedStrategies.
+	// If nil, the upstreams with the lowest latency are tried first. Ignored if AllServers is set.
+	UpstreamStrategy          UpstreamStrategy
+	DomainsReservedStrategies map[string]UpstreamStrategy // map of reserved domains and their upstream strategies
+
 	MaxGoroutines int // maximum number of goroutines processing the DNS requests (important for mobile)
 }
 
@@ -148,6 +213,7 @@ type DNSContext struct {
 	HTTPResponseWriter http.ResponseWriter // HTTP response writer (for DOH only)
 	StartTime          time.Time           // processing start time
 	Upstream           upstream.Upstream   // upstream that resolved DNS request
+	FromCache          bool                // true if the response was served from the cache (Upstream is nil then)
 
 	// Upstream servers to use for this request
 	// If set, Resolve() uses it instead of default servers
@@ -171,6 +237,9 @@ type UpstreamConfig struct {
 // So the following config: ["[/host.com/]1.2.3.4", "[/www.host.com/]2.3.4.5", "[/maps.host.com/]#", "3.4.5.6"]
 // will send queries for *.host.com to 1.2.3.4, except for *.www.host.com, which will go to 2.3.4.5 and *.maps.host.com,
 // which will go to default server 3.4.5.6 with all other domains
+// The upstreams that are meant for the specific domains (see upstream.SearchDomainsUpstream, e.g. resolvconf:///etc/resolv.conf)
+// are reserved for their search domains and unqualified names unless the domains are specified explicitly.
+// The search domains follow the changes of the upstream, the explicitly specified domains take priority over them.
 func ParseUpstreamsConfig(upstreamConfig, bootstrapDNS []string, timeout time.Duration) (UpstreamConfig, error) {
 	return ParseUpstreamsConfigEx(upstreamConfig, bootstrapDNS, timeout, func(address string, opts upstream.Options) (upstream.Upstream, error) {
 		return upstream.AddressToUpstream(address, opts)
@@ -223,6 +292,10 @@ func ParseUpstreamsConfigEx(upstreamConfig, bootstrapDNS []string, timeout time.
 			return UpstreamConfig{}, fmt.Errorf("cannot prepare the upstream %s (%s): %s", u, bootstrapDNS, err)
 		}
 
+		if _, ok := dnsUpstream.(upstream.SearchDomainsUpstream); ok && len(hosts) == 0 {
+			hosts = append(hosts, SearchDomains, UnqualifiedNames)
+		}
+
 		if len(hosts) > 0 {
 			for _, host := range hosts {
 				_, ok := domainReservedUpstreams[host]
@@ -244,12 +317,26 @@ func ParseUpstreamsConfigEx(upstreamConfig, bootstrapDNS []string, timeout time.
 func (p *Proxy) Init() {
 	if p.CacheEnabled {
 		log.Printf("DNS cache is enabled")
-		p.cache = &cache{cacheSize: p.CacheSizeBytes}
+		// the general and the subnet caches may share the custom storage so their keys are prefixed
+		p.cache = &cache{cacheSize: p.CacheSizeBytes, storage: withPrefix(p.CacheStorage, "c:")}
 		if p.Config.EnableEDNSClientSubnet {
-			p.cacheSubnet = &cacheSubnet{cacheSize: p.CacheSizeBytes}
+			if p.CacheStorage != nil {
+				log.Printf("The responses cached for the ECS subnets are not shared through the custom cache storage")
+			}
+			p.cacheSubnet = &cacheSubnet{cacheSize: p.CacheSizeBytes, storage: withPrefix(p.CacheStorage, "s:")}
 		}
 	}
 
+	if p.HealthCheckInterval > 0 {
+		p.health = newHealthChecker(&p.Config)
+	}
+	p.upstreamStats = newUpstreamStats(&p.Config)
+
+	if p.FastestAddr {
+		log.Printf("Fastest address mode is enabled")
+		p.fastestAddr = newFastestAddr(p.FastestAddrTimeout)
+	}
+
 	if p.MaxGoroutines > 0 {
 		p.maxGoroutines = make(chan bool, p.MaxGoroutines)
 	} else {
@@ -277,6 +364,11 @@ func (p *Proxy) Start() error {
 		return err
 	}
 
+	if p.health != nil {
+		log.Printf("Upstreams health checking is enabled, interval: %s", p.HealthCheckInterval)
+		p.health.start()
+	}
+
 	p.started = true
 	return nil
 }
@@ -327,6 +419,19 @@ func (p *Proxy) Stop() error {
 		}
 	}
 
+	if p.adminServer != nil {
+		err := p.adminServer.Close()
+		p.adminListen = nil
+		p.adminServer = nil
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close admin HTTP server"))
+		}
+	}
+
+	if p.health != nil {
+		p.health.close()
+	}
+
 	if p.maxGoroutines != nil {
 		close(p.maxGoroutines)
 	}
@@ -377,28 +482,90 @@ func (p *Proxy) Addr(proto string) net.Addr {
 // If we are looking for domain www.host.com, this method will return value of www.host.com key
 // If more specific domain value is nil, it means that domain was excluded and should be exchanged with default upstreams
 func (p *Proxy) getUpstreamsForDomain(host string) []upstream.Upstream {
-	if len(p.DomainsReservedUpstreams) == 0 {
+	domain, ok := p.getReservedDomain(host)
+	if !ok {
 		return p.Upstreams
 	}
+	if domain == SearchDomains {
+		return p.getSearchDomainsUpstreams(host)
+	}
+	return p.DomainsReservedUpstreams[domain]
+}
+
+// getStrategyForDomain returns the strategy of the upstreams group that is used for the domain
+// (see getUpstreamsForDomain).
+func (p *Proxy) getStrategyForDomain(host string) UpstreamStrategy {
+	if domain, ok := p.getReservedDomain(host); ok {
+		if s, ok := p.DomainsReservedStrategies[domain]; ok {
+			return s
+		}
+	}
+	return p.upstreamStrategy()
+}
+
+// getReservedDomain returns the key of DomainsReservedUpstreams that matches the host
+// or false if the host should be exchanged with the default upstreams.
+func (p *Proxy) getReservedDomain(host string) (string, bool) {
+	if len(p.DomainsReservedUpstreams) == 0 {
+		return "", false
+	}
 
 	dotsCount := strings.Count(host, ".")
 	if dotsCount < 2 {
-		return p.DomainsReservedUpstreams[UnqualifiedNames]
+		return UnqualifiedNames, true
 	}
 
 	for i := 1; i <= dotsCount; i++ {
 		h := strings.SplitAfterN(host, ".", i)
-		name := h[i-1]
-		if u, ok := p.DomainsReservedUpstreams[strings.ToLower(name)]; ok {
+		name := strings.ToLower(h[i-1])
+		if u, ok := p.DomainsReservedUpstreams[name]; ok {
 			if u == nil {
 				// domain was excluded from reserved upstreams querying
-				return p.Upstreams
+				return "", false
 			}
-			return u
+			return name, true
 		}
 	}
 
-	return p.Upstreams
+	if len(p.getSearchDomainsUpstreams(host)) != 0 {
+		return SearchDomains, true
+	}
+	return "", false
+}
+
+// getSearchDomainsUpstreams returns the upstreams reserved for their search domains (see SearchDomains)
+// that have one of them matching the host
+func (p *Proxy) getSearchDomainsUpstreams(host string) []upstream.Upstream {
+	host = strings.ToLower(host)
+	var upstreams []upstream.Upstream
+	for _, u := range p.DomainsReservedUpstreams[SearchDomains] {
+		sdu, ok := u.(upstream.SearchDomainsUpstream)
+		if !ok {
+			continue
+		}
+		for _, domain := range sdu.SearchDomains() {
+			domain = strings.ToLower(strings.TrimSuffix(domain, ".") + ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				upstreams = append(upstreams, u)
+				break
+			}
+		}
+	}
+	return upstreams
+}
+
+// upstreamStrategy returns the strategy of the groups that have no strategy configured
+func (p *Proxy) upstreamStrategy() UpstreamStrategy {
+	if p.UpstreamStrategy != nil {
+		return p.UpstreamStrategy
+	}
+
+	p.strategyLock.Lock()
+	defer p.strategyLock.Unlock()
+	if p.defaultStrategy == nil {
+		p.defaultStrategy = NewLowestLatencyStrategy(defaultEWMAWeight)
+	}
+	return p.defaultStrategy
 }
 
 // Set EDNS Client-Subnet data in DNS request
@@ -440,30 +607,26 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 	}
 
 	if p.replyFromCache(d) {
+		if p.ResponseHandler != nil {
+			p.ResponseHandler(d, nil)
+		}
 		return nil
 	}
 
 	// Get custom upstreams first -- note that they might be empty
 	upstreams := d.Upstreams
+	var strategy UpstreamStrategy
 	if len(upstreams) == 0 {
 		// get upstreams for the specified hostname
 		upstreams = p.getUpstreamsForDomain(d.Req.Question[0].Name)
+		strategy = p.getStrategyForDomain(d.Req.Question[0].Name)
 	}
 
 	// execute the DNS request
-	startTime := time.Now()
-	reply, u, err := p.exchange(d.Req, upstreams)
-	if p.isEmptyAAAAResponse(reply, d.Req) {
-		reply, u, err = p.checkDNS64(d.Req, reply, upstreams)
-	}
-
-	rtt := int(time.Since(startTime) / time.Millisecond)
-	log.Tracef("RTT: %d ms", rtt)
-
-	if err != nil && p.Fallbacks != nil {
-		log.Tracef("Using the fallback upstream due to %s", err)
-		reply, u, err = upstream.ExchangeParallel(p.Fallbacks, d.Req)
-	}
+	// identical requests that are already in-flight share the same upstream exchange
+	reply, u, err := p.exchangeCoalesced(d, func() (*dns.Msg, upstream.Upstream, error) {
+		return p.exchangeWithFallback(d.Req, upstreams, strategy)
+	})
 
 	// set Upstream that resolved DNS request to DNSContext
 	if reply != nil {
@@ -487,51 +650,112 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 	return err
 }
 
-func (p *Proxy) exchange(req *dns.Msg, upstreams []upstream.Upstream) (reply *dns.Msg, u upstream.Upstream, err error) {
+// exchangeWithFallback sends the request to the upstreams (see exchange) and then to the fallback upstreams if they failed
+func (p *Proxy) exchangeWithFallback(req *dns.Msg, upstreams []upstream.Upstream, strategy UpstreamStrategy) (*dns.Msg, upstream.Upstream, error) {
+	startTime := time.Now()
+	reply, u, err := p.exchange(req, upstreams, strategy)
+	if p.isEmptyAAAAResponse(reply, req) {
+		reply, u, err = p.checkDNS64(req, reply, upstreams, strategy)
+	}
+
+	rtt := int(time.Since(startTime) / time.Millisecond)
+	log.Tracef("RTT: %d ms", rtt)
+
+	if (err != nil || p.isFallbackRcode(reply)) && p.Fallbacks != nil {
+		if err != nil {
+			log.Tracef("Using the fallback upstream due to %s", err)
+		} else {
+			log.Tracef("Using the fallback upstream due to %s response", dns.RcodeToString[reply.Rcode])
+		}
+
+		// the fallback response is used only if it's better
+		fallbackReply, fallbackUpstream, fallbackErr := p.exchangeParallel(p.Fallbacks, req)
+		if err != nil || (fallbackErr == nil && !p.isFallbackRcode(fallbackReply)) {
+			reply, u, err = fallbackReply, fallbackUpstream, fallbackErr
+		}
+	}
+	return reply, u, err
+}
+
+// exchangeParallel sends the request to all the upstreams at once (see upstream.ExchangeParallelEx)
+func (p *Proxy) exchangeParallel(upstreams []upstream.Upstream, req *dns.Msg) (*dns.Msg, upstream.Upstream, error) {
+	var reply *dns.Msg
+	var u upstream.Upstream
+	var err error
+	if len(p.FallbackRcodes) == 0 {
+		reply, u, err = upstream.ExchangeParallel(p.withStats(upstreams), req)
+	} else {
+		reply, u, err = upstream.ExchangeParallelEx(p.withStats(upstreams), req, p.FallbackRcodes)
+	}
+	return reply, withoutStats(u), err
+}
+
+// isFallbackRcode checks if the response code of the reply is considered as a failure (see Config.FallbackRcodes)
+func (p *Proxy) isFallbackRcode(reply *dns.Msg) bool {
+	if reply == nil {
+		return false
+	}
+	for _, rcode := range p.FallbackRcodes {
+		if reply.Rcode == rcode {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange sends the request to the upstreams in the order chosen by the strategy
+// (or to all of them at once if AllServers is set) and returns the first successful response.
+// If strategy is nil, the default one is used (see Config.UpstreamStrategy).
+func (p *Proxy) exchange(req *dns.Msg, upstreams []upstream.Upstream, strategy UpstreamStrategy) (reply *dns.Msg, u upstream.Upstream, err error) {
+	upstreams = p.healthyUpstreams(upstreams)
+
+	if p.fastestAddr != nil && isAddrRequest(req) {
+		reply, u, err = p.fastestAddr.exchangeFastest(req, p.withStats(upstreams))
+		return reply, withoutStats(u), err
+	}
+
 	if p.AllServers {
-		reply, u, err = upstream.ExchangeParallel(upstreams, req)
-		return
+		return p.exchangeParallel(upstreams, req)
 	}
 
-	if len(upstreams) == 1 {
-		u = upstreams[0]
-		reply, _, err = exchangeWithUpstream(u, req)
-		return
+	if strategy == nil {
+		strategy = p.upstreamStrategy()
 	}
 
-	// sort upstreams by rtt from fast to slow
-	sortedUpstreams := p.getSortedUpstreams(upstreams)
+	ordered := strategy.Order(upstreams)
+	if p.HedgeDelay > 0 && len(ordered) > 1 {
+		return p.exchangeHedged(req, ordered, strategy)
+	}
 
 	errs := []error{}
-	for _, dnsUpstream := range sortedUpstreams {
+	var failure *dns.Msg // the first response with one of FallbackRcodes
+	var failureUpstream upstream.Upstream
+	for _, dnsUpstream := range ordered {
 		reply, elapsed, err := exchangeWithUpstream(dnsUpstream, req)
+		p.reportHealth(dnsUpstream, reply, err)
+		p.recordStats(dnsUpstream, time.Duration(elapsed)*time.Millisecond, reply, err)
+		strategy.Update(dnsUpstream, time.Duration(elapsed)*time.Millisecond, err)
+		if err == nil && p.isFallbackRcode(reply) {
+			log.Tracef("upstream %s responded to %s with %s", dnsUpstream.Address(), req.Question[0].String(), dns.RcodeToString[reply.Rcode])
+			if failure == nil {
+				failure, failureUpstream = reply, dnsUpstream
+			}
+			continue
+		}
 		if err == nil {
-			p.updateRtt(dnsUpstream.Address(), elapsed)
 			return reply, dnsUpstream, err
 		}
 		errs = append(errs, err)
-		p.updateRtt(dnsUpstream.Address(), int(defaultTimeout/time.Millisecond))
+	}
+	if failure != nil {
+		return failure, failureUpstream, nil
+	}
+	if len(errs) == 1 {
+		return nil, nil, errs[0]
 	}
 	return nil, nil, errorx.DecorateMany("all upstreams failed to exchange request", errs...)
 }
 
-func (p *Proxy) getSortedUpstreams(u []upstream.Upstream) []upstream.Upstream {
-	// clone upstreams list to avoid race conditions
-	p.rttLock.Lock()
-	clone := make([]upstream.Upstream, len(u))
-	copy(clone, u)
-
-	sort.Slice(clone, func(i, j int) bool {
-		if p.upstreamRttStats[clone[i].Address()] < p.upstreamRttStats[clone[j].Address()] {
-			return true
-		}
-		return false
-	})
-	p.rttLock.Unlock()
-
-	return clone
-}
-
 // exchangeWithUpstream returns result of Exchange with elapsed time
 func exchangeWithUpstream(u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, error) {
 	startTime := time.Now()
@@ -545,16 +769,6 @@ func exchangeWithUpstream(u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, err
 	return reply, elapsed, err
 }
 
-// updateRtt updates rtt in upstreamRttStats for given address
-func (p *Proxy) updateRtt(address string, rtt int) {
-	p.rttLock.Lock()
-	if p.upstreamRttStats == nil {
-		p.upstreamRttStats = map[string]int{}
-	}
-	p.upstreamRttStats[address] = (p.upstreamRttStats[address] + rtt) / 2
-	p.rttLock.Unlock()
-}
-
 // validateConfig verifies that the supplied configuration is valid and returns an error if it's not
 func (p *Proxy) validateConfig() error {
 	if p.started {
@@ -580,6 +794,11 @@ func (p *Proxy) validateConfig() error {
 		return errors.New("no default upstreams specified")
 	}
 
+	err := p.validateAdminConfig()
+	if err != nil {
+		return err
+	}
+
 	if p.Ratelimit > 0 {
 		log.Printf("Ratelimit is enabled and set to %d rps", p.Ratelimit)
 	}
@@ -641,6 +860,13 @@ func (p *Proxy) startListeners() error {
 		}
 	}
 
+	if p.AdminListenAddr != nil {
+		err := p.startAdminListener()
+		if err != nil {
+			return err
+		}
+	}
+
 	if p.udpListen != nil {
 		go p.udpPacketLoop(p.udpListen)
 	}
@@ -1,12 +1,15 @@
 package proxy
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
 // Get response from general or subnet cache
-// Return TRUE if response is found in cache
+// Return TRUE if response is found in cache (DNSContext.FromCache is set then)
 func (p *Proxy) replyFromCache(d *DNSContext) bool {
 	if p.cache == nil || len(d.Upstreams) > 0 {
 		// Do not use cache if:
@@ -19,6 +22,7 @@ func (p *Proxy) replyFromCache(d *DNSContext) bool {
 		val, ok := p.cache.Get(d.Req)
 		if ok && val != nil {
 			d.Res = val
+			d.FromCache = true
 			log.Tracef("Serving cached response")
 			return true
 		}
@@ -29,6 +33,7 @@ func (p *Proxy) replyFromCache(d *DNSContext) bool {
 		val, ok := p.cacheSubnet.GetWithSubnet(d.Req, d.ecsReqIP, d.ecsReqMask)
 		if ok && val != nil {
 			d.Res = val
+			d.FromCache = true
 			log.Debug("Serving response from subnet cache")
 			return true
 		}
@@ -36,6 +41,7 @@ func (p *Proxy) replyFromCache(d *DNSContext) bool {
 		val, ok := p.cache.Get(d.Req)
 		if ok && val != nil {
 			d.Res = val
+			d.FromCache = true
 			log.Debug("Serving response from general cache")
 			return true
 		}
@@ -74,3 +80,95 @@ func (p *Proxy) setInCache(d *DNSContext, resp *dns.Msg) {
 		p.cache.Set(resp) // use general cache
 	}
 }
+
+// CacheEntry describes a DNS response stored in the cache
+type CacheEntry struct {
+	Name   string `json:"name"`             // question name
+	Type   string `json:"type"`             // question type
+	DO     bool   `json:"do"`               // DNSSEC OK flag
+	Subnet string `json:"subnet,omitempty"` // ECS subnet the response is valid for (subnet cache only)
+	TTL    uint32 `json:"ttl"`              // remaining TTL (in seconds)
+}
+
+// CacheEntries returns the list of the responses stored in the general and subnet caches
+func (p *Proxy) CacheEntries() []CacheEntry {
+	entries := []CacheEntry{}
+	if p.cache != nil {
+		for _, item := range p.cache.list() {
+			entries = append(entries, newCacheEntry(item, false))
+		}
+	}
+	if p.cacheSubnet != nil {
+		for _, item := range p.cacheSubnet.list() {
+			entries = append(entries, newCacheEntry(item, true))
+		}
+	}
+	return entries
+}
+
+// FlushCache removes all the responses from the general and subnet caches
+// Returns the number of removed entries
+func (p *Proxy) FlushCache() int {
+	n := 0
+	if p.cache != nil {
+		n += p.cache.clear()
+	}
+	if p.cacheSubnet != nil {
+		n += p.cacheSubnet.clear()
+	}
+	if n > 0 {
+		log.Printf("Flushed %d cache entries", n)
+	}
+	return n
+}
+
+// FlushCacheName removes the responses for the specified name (of all types) from the general and subnet caches
+// If subdomains is true, the responses for all the subdomains of this name are removed as well
+// Returns the number of removed entries
+func (p *Proxy) FlushCacheName(name string, subdomains bool) int {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	n := 0
+	if p.cache != nil {
+		n += p.cache.delName(name, subdomains)
+	}
+	if p.cacheSubnet != nil {
+		n += p.cacheSubnet.delName(name, subdomains)
+	}
+	if n > 0 {
+		log.Printf("Flushed %d cache entries for %s", n, name)
+	}
+	return n
+}
+
+// matchCacheName checks if the lowercase question name is the specified name
+// (or its subdomain if subdomains is true)
+func matchCacheName(qName, name string, subdomains bool) bool {
+	if qName == name {
+		return true
+	}
+	if !subdomains {
+		return false
+	}
+	return name == "." || strings.HasSuffix(qName, "."+name)
+}
+
+// newCacheEntry converts the cached item to a CacheEntry
+func newCacheEntry(item cacheItem, subnet bool) CacheEntry {
+	q := item.msg.Question[0]
+	e := CacheEntry{
+		Name: q.Name,
+		Type: dns.Type(q.Qtype).String(),
+		TTL:  item.ttl,
+	}
+	if opt := item.msg.IsEdns0(); opt != nil {
+		e.DO = opt.Do()
+	}
+	if subnet {
+		ip, _, scope := parseECS(item.msg)
+		if ip != nil {
+			e.Subnet = fmt.Sprintf("%s/%d", ip, scope)
+		}
+	}
+	return e
+}
@@ -14,6 +14,7 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -217,8 +218,70 @@ func TestGetUpstreamsForDomain(t *testing.T) {
 	assertUpstreamsForDomain(t, dnsproxy, 0, "maps.google.com.", []string{})
 }
 
+func TestResolvConfUpstreamsForDomain(t *testing.T) {
+	dnsproxy := createTestProxy(t, nil)
+	f, err := ioutil.TempFile("", "resolv.conf")
+	if err != nil {
+		t.Fatalf("cannot create resolv.conf: %s", err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("search lan\nnameserver 192.168.1.1\n")
+	_ = f.Close()
+
+	resolvConf := "resolvconf://" + f.Name()
+	upstreams := []string{resolvConf, "[/corp/]" + resolvConf, "8.8.8.8"}
+	config, err := ParseUpstreamsConfig(upstreams, []string{}, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Error while upstream config parsing: %s", err)
+	}
+	dnsproxy.Upstreams = config.Upstreams
+	dnsproxy.DomainsReservedUpstreams = config.DomainReservedUpstreams
+
+	// the search domains and unqualified names are reserved unless the domains are specified
+	assertUpstreamsForDomain(t, dnsproxy, 1, "printer.lan.", []string{resolvConf})
+	assertUpstreamsForDomain(t, dnsproxy, 1, "printer.", []string{resolvConf})
+	assertUpstreamsForDomain(t, dnsproxy, 1, "host.corp.", []string{resolvConf})
+	assertUpstreamsForDomain(t, dnsproxy, 1, "example.org.", []string{"8.8.8.8:53"})
+}
+
+// testSearchDomainsUpstream is a SearchDomainsUpstream with the search domains that can be changed
+type testSearchDomainsUpstream struct {
+	upstream.Upstream
+	search []string
+}
+
+func (u *testSearchDomainsUpstream) SearchDomains() []string { return u.search }
+
+func TestSearchDomainsChange(t *testing.T) {
+	dnsproxy := createTestProxy(t, nil)
+	u := &testSearchDomainsUpstream{search: []string{"lan"}}
+	config, err := ParseUpstreamsConfigEx([]string{"local", "[/office.home/]4.3.2.1", "8.8.8.8"}, []string{}, time.Second,
+		func(address string, opts upstream.Options) (upstream.Upstream, error) {
+			if address == "local" {
+				u.Upstream, _ = upstream.AddressToUpstream("1.2.3.4", opts)
+				return u, nil
+			}
+			return upstream.AddressToUpstream(address, opts)
+		})
+	if err != nil {
+		t.Fatalf("Error while upstream config parsing: %s", err)
+	}
+	dnsproxy.Upstreams = config.Upstreams
+	dnsproxy.DomainsReservedUpstreams = config.DomainReservedUpstreams
+
+	assertUpstreamsForDomain(t, dnsproxy, 1, "printer.LAN.", []string{"1.2.3.4:53"})
+	assertUpstreamsForDomain(t, dnsproxy, 1, "printer.home.", []string{"8.8.8.8:53"})
+
+	// the changed search domains are used right away, the explicitly specified domains take priority
+	u.search = []string{"home."}
+	assertUpstreamsForDomain(t, dnsproxy, 1, "printer.lan.", []string{"8.8.8.8:53"})
+	assertUpstreamsForDomain(t, dnsproxy, 1, "printer.home.", []string{"1.2.3.4:53"})
+	assertUpstreamsForDomain(t, dnsproxy, 1, "printer.office.home.", []string{"4.3.2.1:53"})
+	assertUpstreamsForDomain(t, dnsproxy, 1, "printer.", []string{"1.2.3.4:53"})
+}
+
 func TestUpstreamsSort(t *testing.T) {
-	testProxy := createTestProxy(t, nil)
+	strategy := NewLowestLatencyStrategy(defaultEWMAWeight)
 	upstreams := []upstream.Upstream{}
 
 	// there are 4 upstreams in configuration
@@ -231,14 +294,12 @@ func TestUpstreamsSort(t *testing.T) {
 		upstreams = append(upstreams, up)
 	}
 
-	// create upstreamRttStats for 3 upstreams
-	upstreamRttStats := map[string]int{}
-	upstreamRttStats["1.1.1.1:53"] = 10
-	upstreamRttStats["2.3.4.5:53"] = 20
-	upstreamRttStats["1.2.3.4:53"] = 30
-	testProxy.upstreamRttStats = upstreamRttStats
+	// record rtt for 3 upstreams
+	strategy.Update(upstreams[1], 10*time.Millisecond, nil)
+	strategy.Update(upstreams[2], 20*time.Millisecond, nil)
+	strategy.Update(upstreams[0], 30*time.Millisecond, nil)
 
-	sortedUpstreams := testProxy.getSortedUpstreams(upstreams)
+	sortedUpstreams := strategy.Order(upstreams)
 
 	// upstream without rtt stats means `zero rtt`; this upstream should be the first one after sorting
 	if sortedUpstreams[0].Address() != "8.8.8.8:53" {
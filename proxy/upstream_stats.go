@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// Classes of the upstream errors (see UpstreamStats.Errors)
+const (
+	UpstreamErrorTimeout = "timeout" // the upstream didn't respond in time
+	UpstreamErrorNetwork = "network" // connection refused, reset, etc
+	UpstreamErrorTLS     = "tls"     // TLS handshake or certificate verification failed
+	UpstreamErrorRcode   = "rcode"   // the upstream responded with a failure response code (not NOERROR or NXDOMAIN)
+	UpstreamErrorOther   = "other"
+)
+
+// UpstreamStats contains the counters of an upstream
+type UpstreamStats struct {
+	Address   string `json:"address"`   // upstream address
+	Queries   uint64 `json:"queries"`   // number of the exchanges with the upstream
+	Successes uint64 `json:"successes"` // number of the successful exchanges
+
+	// Errors is the number of the failed exchanges by class:
+	// "timeout", "network", "tls", "rcode", "other"
+	Errors map[string]uint64 `json:"errors"`
+
+	// Latency percentiles of the recent successful exchanges in milliseconds
+	// They are 0 until there are any successful exchanges.
+	LatencyP50 float64 `json:"latency_p50_ms"`
+	LatencyP90 float64 `json:"latency_p90_ms"`
+	LatencyP99 float64 `json:"latency_p99_ms"`
+
+	LastError     string     `json:"last_error,omitempty"`      // the last exchange error
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"` // time of the last exchange error, nil if there's none
+}
+
+// upstreamCounters contains the counters of a single upstream
+type upstreamCounters struct {
+	queries       uint64
+	successes     uint64
+	errors        map[string]uint64
+	rtt           rttWindow // recent RTT of the successful exchanges
+	lastError     error
+	lastErrorTime time.Time
+}
+
+// upstreamStats keeps the counters of the configured upstreams
+// The set of the upstreams is fixed when the proxy is initialized so the counters are reset on reconfiguration.
+type upstreamStats struct {
+	upstreams  map[upstream.Upstream]*upstreamCounters
+	order      []upstream.Upstream // upstreams in the order they were configured
+	sync.Mutex                     // protects the counters
+}
+
+// newUpstreamStats creates the counters for all the upstreams from the proxy configuration
+func newUpstreamStats(config *Config) *upstreamStats {
+	s := &upstreamStats{upstreams: map[upstream.Upstream]*upstreamCounters{}}
+	s.add(config.Upstreams)
+	s.add(config.Fallbacks)
+	for _, upstreams := range config.DomainsReservedUpstreams {
+		s.add(upstreams)
+	}
+	return s
+}
+
+// add adds the upstreams to the stats
+func (s *upstreamStats) add(upstreams []upstream.Upstream) {
+	for _, u := range upstreams {
+		if _, ok := s.upstreams[u]; ok {
+			continue
+		}
+		s.upstreams[u] = &upstreamCounters{errors: map[string]uint64{}}
+		s.order = append(s.order, u)
+	}
+}
+
+// record records the result of an exchange with the upstream
+// Unknown upstreams (i.e. custom upstreams from DNSContext) are ignored.
+func (s *upstreamStats) record(u upstream.Upstream, rtt time.Duration, reply *dns.Msg, err error) {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.upstreams[u]
+	if !ok {
+		return
+	}
+
+	c.queries++
+	if err == nil && reply != nil && reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+		err = rcodeError(reply.Rcode)
+	}
+	if err == nil {
+		c.successes++
+		c.rtt.add(rtt)
+		return
+	}
+	c.errors[upstreamErrorClass(err)]++
+	c.lastError = err
+	c.lastErrorTime = time.Now()
+}
+
+// state returns the counters of all the upstreams
+func (s *upstreamStats) state() []UpstreamStats {
+	s.Lock()
+	defer s.Unlock()
+
+	state := make([]UpstreamStats, 0, len(s.order))
+	for _, u := range s.order {
+		c := s.upstreams[u]
+		us := UpstreamStats{
+			Address:   u.Address(),
+			Queries:   c.queries,
+			Successes: c.successes,
+			Errors:    map[string]uint64{},
+		}
+		for class, n := range c.errors {
+			us.Errors[class] = n
+		}
+		if len(c.rtt.samples) > 0 {
+			us.LatencyP50 = durationToMs(c.rtt.percentile(0.5))
+			us.LatencyP90 = durationToMs(c.rtt.percentile(0.9))
+			us.LatencyP99 = durationToMs(c.rtt.percentile(0.99))
+		}
+		if c.lastError != nil {
+			lastErrorTime := c.lastErrorTime
+			us.LastError = c.lastError.Error()
+			us.LastErrorTime = &lastErrorTime
+		}
+		state = append(state, us)
+	}
+	return state
+}
+
+func durationToMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// upstreamErrorClass returns the class of the exchange error (see UpstreamStats.Errors)
+func upstreamErrorClass(err error) string {
+	network := false
+	for err != nil {
+		switch e := err.(type) {
+		case rcodeError:
+			return UpstreamErrorRcode
+		case x509.CertificateInvalidError, x509.HostnameError, x509.UnknownAuthorityError:
+			return UpstreamErrorTLS
+		case net.Error:
+			if e.Timeout() {
+				return UpstreamErrorTimeout
+			}
+			network = true
+		}
+		if err == context.DeadlineExceeded {
+			return UpstreamErrorTimeout
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			network = true
+		}
+		// the TLS alerts and handshake errors aren't exported
+		if strings.HasPrefix(err.Error(), "tls: ") {
+			return UpstreamErrorTLS
+		}
+
+		if e, ok := err.(*errorx.Error); ok {
+			err = e.Cause()
+		} else {
+			err = errors.Unwrap(err)
+		}
+	}
+
+	if network {
+		return UpstreamErrorNetwork
+	}
+	return UpstreamErrorOther
+}
+
+// statsUpstream records the results of the exchanges with the upstream
+// and reports them to the health checker.
+// It is used when the upstreams are queried by the upstream package (see Proxy.withStats).
+type statsUpstream struct {
+	upstream.Upstream
+	stats  *upstreamStats // nil if the stats are not collected
+	health *healthChecker // nil if the health checking is disabled
+}
+
+func (u *statsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	startTime := time.Now()
+	reply, err := u.Upstream.Exchange(m)
+	if u.stats != nil {
+		u.stats.record(u.Upstream, time.Since(startTime), reply, err)
+	}
+	if u.health != nil {
+		u.health.report(u.Upstream, reply, err)
+	}
+	return reply, err
+}
+
+// withStats wraps the upstreams so that the results of the exchanges with them are recorded
+// in the upstream stats and in the upstreams health, the same way the sequential exchanges are
+func (p *Proxy) withStats(upstreams []upstream.Upstream) []upstream.Upstream {
+	s := p.upstreamStats
+	h := p.health
+	if s == nil && h == nil {
+		return upstreams
+	}
+	wrapped := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		wrapped[i] = &statsUpstream{Upstream: u, stats: s, health: h}
+	}
+	return wrapped
+}
+
+// withoutStats returns the upstream wrapped by withStats
+func withoutStats(u upstream.Upstream) upstream.Upstream {
+	if su, ok := u.(*statsUpstream); ok {
+		return su.Upstream
+	}
+	return u
+}
+
+// recordStats records the result of an exchange with the upstream
+func (p *Proxy) recordStats(u upstream.Upstream, rtt time.Duration, reply *dns.Msg, err error) {
+	if p.upstreamStats != nil {
+		p.upstreamStats.record(u, rtt, reply, err)
+	}
+}
+
+// UpstreamStats returns the counters of the configured upstreams
+// (including the fallback and the domain-reserved upstreams) since the proxy was started.
+func (p *Proxy) UpstreamStats() []UpstreamStats {
+	p.RLock()
+	s := p.upstreamStats
+	p.RUnlock()
+	if s == nil {
+		return []UpstreamStats{}
+	}
+	return s.state()
+}
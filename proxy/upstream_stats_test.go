@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamStats(t *testing.T) {
+	bad := &flakyUpstream{addr: "bad", failing: 1}
+	good := &flakyUpstream{addr: "good"}
+	servfail := &rcodeUpstream{addr: "servfail", rcode: dns.RcodeServerFailure}
+	fallback := &flakyUpstream{addr: "fallback"}
+	reserved := &flakyUpstream{addr: "reserved"}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{bad, good}
+	dnsProxy.Fallbacks = []upstream.Upstream{fallback}
+	dnsProxy.DomainsReservedUpstreams = map[string][]upstream.Upstream{"lan.": {reserved, good}}
+	dnsProxy.UpstreamStrategy = NewStrictOrderStrategy()
+	dnsProxy.FallbackRcodes = []int{dns.RcodeServerFailure}
+	dnsProxy.Init()
+
+	// bad fails and good answers
+	_, u, err := dnsProxy.exchangeWithFallback(createHostTestMessage("google.com"), dnsProxy.Upstreams, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, good, u)
+
+	// the fallback answers instead of the failing upstreams
+	_, u, err = dnsProxy.exchangeWithFallback(createHostTestMessage("google.com"), []upstream.Upstream{bad, servfail}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, fallback, u)
+
+	// the domain-reserved upstreams
+	_, u, err = dnsProxy.exchangeWithFallback(createHostTestMessage("host.lan"), dnsProxy.getUpstreamsForDomain("host.lan."), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, reserved, u)
+
+	stats := dnsProxy.UpstreamStats()
+	assert.Len(t, stats, 4) // servfail isn't configured
+
+	assert.Equal(t, "bad", stats[0].Address)
+	assert.Equal(t, uint64(2), stats[0].Queries)
+	assert.Equal(t, uint64(0), stats[0].Successes)
+	assert.Equal(t, map[string]uint64{UpstreamErrorOther: 2}, stats[0].Errors)
+	assert.Equal(t, "upstream is down", stats[0].LastError)
+	assert.False(t, stats[0].LastErrorTime.IsZero())
+
+	// the time is omitted if there are no errors
+	data, err := json.Marshal(stats[1])
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "last_error")
+	assert.Equal(t, float64(0), stats[0].LatencyP50)
+
+	assert.Equal(t, "good", stats[1].Address)
+	assert.Equal(t, uint64(1), stats[1].Queries)
+	assert.Equal(t, uint64(1), stats[1].Successes)
+	assert.Empty(t, stats[1].Errors)
+	assert.Empty(t, stats[1].LastError)
+
+	assert.Equal(t, "fallback", stats[2].Address)
+	assert.Equal(t, uint64(1), stats[2].Successes)
+	assert.Equal(t, "reserved", stats[3].Address)
+	assert.Equal(t, uint64(1), stats[3].Successes)
+
+	// the counters are reset on reconfiguration
+	dnsProxy.Upstreams = []upstream.Upstream{good}
+	dnsProxy.Init()
+	stats = dnsProxy.UpstreamStats()
+	assert.Len(t, stats, 3)
+	assert.Equal(t, "good", stats[0].Address)
+	assert.Equal(t, uint64(0), stats[0].Queries)
+	assert.Equal(t, "reserved", stats[2].Address)
+	assert.Equal(t, uint64(0), stats[2].Queries)
+}
+
+func TestUpstreamStatsRcode(t *testing.T) {
+	servfail := &rcodeUpstream{addr: "servfail", rcode: dns.RcodeServerFailure}
+	// servfail answers first so that it's recorded before the exchange is over
+	nxdomain := &rcodeUpstream{addr: "nxdomain", rcode: dns.RcodeNameError, delay: 50 * time.Millisecond}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{servfail, nxdomain}
+	dnsProxy.AllServers = true
+	dnsProxy.Init()
+
+	// the parallel exchanges are recorded as well
+	_, u, err := dnsProxy.exchangeWithFallback(createHostTestMessage("google.com"), dnsProxy.Upstreams, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, nxdomain, u)
+
+	stats := dnsProxy.UpstreamStats()
+	assert.Equal(t, map[string]uint64{UpstreamErrorRcode: 1}, stats[0].Errors)
+	assert.Equal(t, uint64(1), stats[1].Successes)
+	assert.True(t, stats[1].LatencyP99 >= stats[1].LatencyP50)
+}
+
+// timeoutError is a net.Error that is a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestUpstreamErrorClass(t *testing.T) {
+	refused := &net.OpError{Op: "read", Net: "udp", Err: errors.New("connection refused")}
+
+	assert.Equal(t, UpstreamErrorTimeout, upstreamErrorClass(timeoutError{}))
+	assert.Equal(t, UpstreamErrorTimeout, upstreamErrorClass(errorx.Decorate(timeoutError{}, "failed to exchange")))
+	assert.Equal(t, UpstreamErrorTimeout, upstreamErrorClass(context.DeadlineExceeded))
+	assert.Equal(t, UpstreamErrorNetwork, upstreamErrorClass(errorx.Decorate(refused, "failed to exchange")))
+	assert.Equal(t, UpstreamErrorNetwork, upstreamErrorClass(io.EOF))
+	assert.Equal(t, UpstreamErrorTLS, upstreamErrorClass(errorx.Decorate(errors.New("tls: handshake failure"), "couldn't connect")))
+	assert.Equal(t, UpstreamErrorRcode, upstreamErrorClass(rcodeError(dns.RcodeRefused)))
+	assert.Equal(t, UpstreamErrorOther, upstreamErrorClass(errors.New("no upstream specified")))
+}
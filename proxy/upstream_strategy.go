@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// Names of the built-in upstream selection strategies (see NewUpstreamStrategy)
+const (
+	StrategyLowestLatency  = "lowest_latency"
+	StrategyRoundRobin     = "round_robin"
+	StrategyWeightedRandom = "weighted_random"
+	StrategyStrictOrder    = "strict_order"
+)
+
+// defaultEWMAWeight is the weight of a new RTT sample in the lowest-latency strategy
+const defaultEWMAWeight = 0.3
+
+// UpstreamStrategy decides in which order the upstreams of a group are tried
+// Implementations must be safe for concurrent use.
+type UpstreamStrategy interface {
+	// Order returns the upstreams in the order they should be tried
+	// It must not modify the upstreams slice.
+	Order(upstreams []upstream.Upstream) []upstream.Upstream
+
+	// Update records the result of an exchange with the upstream
+	// rtt is the time the exchange took, err is nil if it was successful.
+	Update(u upstream.Upstream, rtt time.Duration, err error)
+}
+
+// NewUpstreamStrategy creates a built-in strategy by its name
+func NewUpstreamStrategy(name string) (UpstreamStrategy, error) {
+	switch name {
+	case StrategyLowestLatency:
+		return NewLowestLatencyStrategy(defaultEWMAWeight), nil
+	case StrategyRoundRobin:
+		return NewRoundRobinStrategy(), nil
+	case StrategyWeightedRandom:
+		return NewWeightedRandomStrategy(nil), nil
+	case StrategyStrictOrder:
+		return NewStrictOrderStrategy(), nil
+	}
+	return nil, fmt.Errorf("unknown upstream strategy: %s", name)
+}
+
+// ParseUpstreamStrategies parses the strategies configuration
+// default strategy syntax: <strategyName>
+// reserved domains strategy syntax: [/domain1/../domainN/]<strategyName>
+// The domains must be the same as in the upstreams configuration (see ParseUpstreamsConfig).
+// Returns the default strategy (nil if it's not specified) and the map of the reserved domains strategies.
+func ParseUpstreamStrategies(strategiesConfig []string) (UpstreamStrategy, map[string]UpstreamStrategy, error) {
+	var defaultStrategy UpstreamStrategy
+	domainStrategies := map[string]UpstreamStrategy{}
+
+	for _, s := range strategiesConfig {
+		hosts := []string{}
+		if strings.HasPrefix(s, "[/") {
+			domainsAndStrategy := strings.Split(strings.TrimPrefix(s, "[/"), "/]")
+			if len(domainsAndStrategy) != 2 {
+				return nil, nil, fmt.Errorf("wrong upstream strategy specification: %s", s)
+			}
+			for _, host := range strings.Split(domainsAndStrategy[0], "/") {
+				if host != "" {
+					hosts = append(hosts, strings.ToLower(host+"."))
+				} else {
+					hosts = append(hosts, UnqualifiedNames)
+				}
+			}
+			s = domainsAndStrategy[1]
+		}
+
+		// every group has its own strategy instance
+		strategy, err := NewUpstreamStrategy(s)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(hosts) == 0 {
+			defaultStrategy = strategy
+			continue
+		}
+		for _, host := range hosts {
+			domainStrategies[host] = strategy
+		}
+	}
+	return defaultStrategy, domainStrategies, nil
+}
+
+// lowestLatencyStrategy tries the upstreams from fast to slow
+// The latency is an exponentially weighted moving average of the exchanges RTT.
+// Failed exchanges count as if they took defaultTimeout.
+type lowestLatencyStrategy struct {
+	weight float64            // weight of a new sample
+	rtt    map[string]float64 // upstream address -> average RTT in milliseconds
+	sync.Mutex
+}
+
+// NewLowestLatencyStrategy creates a strategy that tries the upstreams with the lowest average RTT first
+// weight is the weight of a new RTT sample in the moving average, from 0 to 1.
+// The upstreams that have not been used yet are tried first.
+func NewLowestLatencyStrategy(weight float64) UpstreamStrategy {
+	if weight <= 0 || weight > 1 {
+		weight = defaultEWMAWeight
+	}
+	return &lowestLatencyStrategy{weight: weight, rtt: map[string]float64{}}
+}
+
+func (s *lowestLatencyStrategy) Order(upstreams []upstream.Upstream) []upstream.Upstream {
+	s.Lock()
+	defer s.Unlock()
+
+	// clone upstreams list to avoid race conditions
+	sorted := make([]upstream.Upstream, len(upstreams))
+	copy(sorted, upstreams)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return s.rtt[sorted[i].Address()] < s.rtt[sorted[j].Address()]
+	})
+	return sorted
+}
+
+func (s *lowestLatencyStrategy) Update(u upstream.Upstream, rtt time.Duration, err error) {
+	if err != nil {
+		rtt = defaultTimeout
+	}
+	sample := float64(rtt) / float64(time.Millisecond)
+
+	s.Lock()
+	defer s.Unlock()
+	old, ok := s.rtt[u.Address()]
+	if !ok {
+		s.rtt[u.Address()] = sample
+		return
+	}
+	s.rtt[u.Address()] = s.weight*sample + (1-s.weight)*old
+}
+
+// roundRobinStrategy starts every exchange with the next upstream
+type roundRobinStrategy struct {
+	next int
+	sync.Mutex
+}
+
+// NewRoundRobinStrategy creates a strategy that distributes the requests evenly among the upstreams
+// If the first upstream fails, the rest are tried in the configured order.
+func NewRoundRobinStrategy() UpstreamStrategy {
+	return &roundRobinStrategy{}
+}
+
+func (s *roundRobinStrategy) Order(upstreams []upstream.Upstream) []upstream.Upstream {
+	if len(upstreams) == 0 {
+		return upstreams
+	}
+
+	s.Lock()
+	first := s.next % len(upstreams)
+	s.next = first + 1
+	s.Unlock()
+
+	ordered := make([]upstream.Upstream, 0, len(upstreams))
+	ordered = append(ordered, upstreams[first:]...)
+	return append(ordered, upstreams[:first]...)
+}
+
+func (s *roundRobinStrategy) Update(upstream.Upstream, time.Duration, error) {}
+
+// weightedRandomStrategy orders the upstreams randomly according to their weights
+type weightedRandomStrategy struct {
+	weights map[string]int // upstream address -> weight
+	rand    *rand.Rand
+	sync.Mutex
+}
+
+// NewWeightedRandomStrategy creates a strategy that picks the upstreams randomly
+// with probability proportional to their weights (upstream address -> weight).
+// The upstreams that are not in the weights map have their own weight (see upstream.Options.Weight)
+// or the weight of 1 if it's not set.
+func NewWeightedRandomStrategy(weights map[string]int) UpstreamStrategy {
+	return &weightedRandomStrategy{
+		weights: weights,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// weight returns the weight of the upstream
+func (s *weightedRandomStrategy) weight(u upstream.Upstream) int {
+	if w, ok := s.weights[u.Address()]; ok {
+		if w < 0 {
+			return 0
+		}
+		return w
+	}
+	if wu, ok := u.(upstream.WeightedUpstream); ok && wu.Weight() > 0 {
+		return wu.Weight()
+	}
+	return 1
+}
+
+func (s *weightedRandomStrategy) Order(upstreams []upstream.Upstream) []upstream.Upstream {
+	rest := make([]upstream.Upstream, len(upstreams))
+	copy(rest, upstreams)
+	total := 0
+	for _, u := range rest {
+		total += s.weight(u)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// weighted sampling without replacement
+	ordered := make([]upstream.Upstream, 0, len(upstreams))
+	for len(rest) > 0 {
+		i := 0
+		if total > 0 {
+			r := s.rand.Intn(total)
+			for ; i < len(rest)-1; i++ {
+				r -= s.weight(rest[i])
+				if r < 0 {
+					break
+				}
+			}
+		}
+		total -= s.weight(rest[i])
+		ordered = append(ordered, rest[i])
+		rest = append(rest[:i], rest[i+1:]...)
+	}
+	return ordered
+}
+
+func (s *weightedRandomStrategy) Update(upstream.Upstream, time.Duration, error) {}
+
+// strictOrderStrategy tries the upstreams in the configured order
+type strictOrderStrategy struct{}
+
+// NewStrictOrderStrategy creates a strategy that always tries the upstreams in the configured order
+func NewStrictOrderStrategy() UpstreamStrategy {
+	return strictOrderStrategy{}
+}
+
+func (strictOrderStrategy) Order(upstreams []upstream.Upstream) []upstream.Upstream {
+	return upstreams
+}
+
+func (strictOrderStrategy) Update(upstream.Upstream, time.Duration, error) {}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundRobinStrategy(t *testing.T) {
+	a, b, c := &flakyUpstream{addr: "a"}, &flakyUpstream{addr: "b"}, &flakyUpstream{addr: "c"}
+	upstreams := []upstream.Upstream{a, b, c}
+	s := NewRoundRobinStrategy()
+
+	assert.Equal(t, []upstream.Upstream{a, b, c}, s.Order(upstreams))
+	assert.Equal(t, []upstream.Upstream{b, c, a}, s.Order(upstreams))
+	assert.Equal(t, []upstream.Upstream{c, a, b}, s.Order(upstreams))
+	assert.Equal(t, []upstream.Upstream{a, b, c}, s.Order(upstreams))
+
+	// the original list is not modified
+	assert.Equal(t, []upstream.Upstream{a, b, c}, upstreams)
+}
+
+func TestLowestLatencyStrategy(t *testing.T) {
+	a, b := &flakyUpstream{addr: "a"}, &flakyUpstream{addr: "b"}
+	upstreams := []upstream.Upstream{a, b}
+	s := NewLowestLatencyStrategy(0.5)
+
+	// unknown upstreams keep the configured order
+	assert.Equal(t, []upstream.Upstream{a, b}, s.Order(upstreams))
+
+	s.Update(a, 100*time.Millisecond, nil)
+	s.Update(b, 50*time.Millisecond, nil)
+	assert.Equal(t, []upstream.Upstream{b, a}, s.Order(upstreams))
+
+	// a failure is counted as a timeout
+	s.Update(b, time.Millisecond, errors.New("failed"))
+	assert.Equal(t, []upstream.Upstream{a, b}, s.Order(upstreams))
+
+	// the average goes down slowly
+	s.Update(b, time.Millisecond, nil)
+	assert.Equal(t, []upstream.Upstream{a, b}, s.Order(upstreams))
+}
+
+func TestWeightedRandomStrategy(t *testing.T) {
+	a, b, c := &flakyUpstream{addr: "a"}, &flakyUpstream{addr: "b"}, &flakyUpstream{addr: "c"}
+	upstreams := []upstream.Upstream{a, b, c}
+	s := NewWeightedRandomStrategy(map[string]int{"a": 8, "c": 0})
+
+	first := map[upstream.Upstream]int{}
+	for i := 0; i < 1000; i++ {
+		ordered := s.Order(upstreams)
+		assert.Len(t, ordered, 3)
+		assert.ElementsMatch(t, upstreams, ordered)
+		first[ordered[0]]++
+	}
+
+	// a should come first in ~8/9 of the cases, c never comes first
+	assert.True(t, first[a] > 800)
+	assert.True(t, first[b] > 0)
+	assert.Equal(t, 0, first[c])
+}
+
+func TestParseUpstreamStrategies(t *testing.T) {
+	defaultStrategy, domainStrategies, err := ParseUpstreamStrategies([]string{
+		"round_robin",
+		"[/google.com/local/]strict_order",
+	})
+	assert.Nil(t, err)
+	assert.IsType(t, &roundRobinStrategy{}, defaultStrategy)
+	assert.Len(t, domainStrategies, 2)
+	assert.IsType(t, strictOrderStrategy{}, domainStrategies["google.com."])
+	assert.IsType(t, strictOrderStrategy{}, domainStrategies["local."])
+
+	_, _, err = ParseUpstreamStrategies([]string{"fastest"})
+	assert.NotNil(t, err)
+	_, _, err = ParseUpstreamStrategies([]string{"[/google.com/round_robin"})
+	assert.NotNil(t, err)
+}
+
+func TestDomainReservedStrategy(t *testing.T) {
+	a, b := &flakyUpstream{addr: "a"}, &flakyUpstream{addr: "b"}
+	c, d := &flakyUpstream{addr: "c"}, &flakyUpstream{addr: "d"}
+
+	dnsProxy := Proxy{}
+	dnsProxy.Upstreams = []upstream.Upstream{a, b}
+	dnsProxy.DomainsReservedUpstreams = map[string][]upstream.Upstream{"google.com.": {c, d}}
+	dnsProxy.UpstreamStrategy = NewStrictOrderStrategy()
+	dnsProxy.DomainsReservedStrategies = map[string]UpstreamStrategy{"google.com.": NewRoundRobinStrategy()}
+	dnsProxy.Init()
+
+	for i := 0; i < 4; i++ {
+		d := DNSContext{Req: createHostTestMessage("www.google.com")}
+		assert.Nil(t, dnsProxy.Resolve(&d))
+		assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+
+		d = DNSContext{Req: createHostTestMessage("example.org")}
+		assert.Nil(t, dnsProxy.Resolve(&d))
+		assert.Equal(t, a, d.Upstream)
+	}
+
+	assert.Equal(t, int32(2), c.requests)
+	assert.Equal(t, int32(2), d.requests)
+	assert.Equal(t, int32(4), a.requests)
+	assert.Equal(t, int32(0), b.requests)
+}
@@ -0,0 +1,62 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// bindOptions specifies the local address and the network interface the upstream connections are bound to
+// (see Options.SourceIP and Options.Interface)
+type bindOptions struct {
+	sourceIP net.IP
+	iface    string
+}
+
+// newBindOptions checks the binding options
+func newBindOptions(opts Options) (bindOptions, error) {
+	b := bindOptions{sourceIP: opts.SourceIP, iface: opts.Interface}
+	if b.iface != "" {
+		if _, err := net.InterfaceByName(b.iface); err != nil {
+			return b, errorx.Decorate(err, "invalid network interface %s", b.iface)
+		}
+		if err := checkBindToDevice(); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// isSet returns true if the connections are bound to a local address or to an interface
+func (b bindOptions) isSet() bool {
+	return b.sourceIP != nil || b.iface != ""
+}
+
+// dialer creates a net.Dialer that binds the connections of the specified network ("tcp", "udp", "udp4", etc)
+func (b bindOptions) dialer(network string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   timeout,
+		DualStack: true,
+	}
+	if b.sourceIP != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: b.sourceIP}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: b.sourceIP}
+		}
+	}
+	if b.iface != "" {
+		d.Control = bindToDevice(b.iface)
+	}
+	return d
+}
+
+// dialContext returns a dialHandler that uses the bound dialers
+func (b bindOptions) dialContext(timeout time.Duration) dialHandler {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return b.dialer(network, timeout).DialContext(ctx, network, addr)
+	}
+}
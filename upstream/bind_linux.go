@@ -0,0 +1,26 @@
+// +build linux
+
+package upstream
+
+import (
+	"syscall"
+)
+
+// bindToDevice returns a net.Dialer control function that binds the socket to the network interface with SO_BINDTODEVICE
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
+
+// checkBindToDevice checks if the sockets can be bound to a network interface
+func checkBindToDevice() error {
+	return nil
+}
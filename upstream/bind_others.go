@@ -0,0 +1,18 @@
+// +build !linux
+
+package upstream
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDevice is not supported on this OS, see checkBindToDevice
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// checkBindToDevice checks if the sockets can be bound to a network interface
+func checkBindToDevice() error {
+	return errors.New("binding to a network interface is supported on Linux only, use the source IP instead")
+}
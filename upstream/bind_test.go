@@ -0,0 +1,116 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamSourceIP(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("127.0.0.2 is not available on this OS")
+	}
+
+	// UDP server that records the clients addresses
+	var clients []string
+	var lock sync.Mutex
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	srv := &dns.Server{PacketConn: udpConn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		lock.Lock()
+		clients = append(clients, w.RemoteAddr().(*net.UDPAddr).IP.String())
+		lock.Unlock()
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{8, 8, 8, 8},
+		}}
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	u, err := AddressToUpstream("dns://"+udpConn.LocalAddr().String()+"?source=127.0.0.2", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	resp, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+	lock.Lock()
+	assert.Equal(t, []string{"127.0.0.2"}, clients)
+	lock.Unlock()
+
+	// the address family specific networks are bound too
+	b := bindOptions{sourceIP: net.ParseIP("127.0.0.2")}
+	conn, err := b.dialContext(time.Second)(context.Background(), "udp4", udpConn.LocalAddr().String())
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.2", conn.LocalAddr().(*net.UDPAddr).IP.String())
+	_ = conn.Close()
+
+	tcpSrv := newTestTCPServer(t)
+	defer tcpSrv.close()
+	u, err = AddressToUpstream("tcp://"+tcpSrv.addr(), Options{Timeout: time.Second, SourceIP: net.ParseIP("127.0.0.2")})
+	assert.Nil(t, err)
+	resp, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+	assert.Equal(t, []string{"127.0.0.2"}, tcpSrv.clientIPs())
+
+	dotSrv := newTestDoTServer(t, "dns.corp")
+	defer dotSrv.close()
+	u, err = AddressToUpstream("tls://127.0.0.1:"+strconv.Itoa(dotSrv.port())+"?sni=dns.corp&insecure=true&source=127.0.0.2",
+		Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	resp, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+	dotSrv.Lock()
+	assert.Equal(t, []string{"127.0.0.2"}, dotSrv.clientIPs)
+	dotSrv.Unlock()
+
+	// the DNSCrypt query, the certificate is fetched by the library
+	cryptSrv := newTestDNSCryptServer(t)
+	defer cryptSrv.close()
+	u, err = AddressToUpstream(cryptSrv.stamp.String(), Options{Timeout: time.Second, SourceIP: net.ParseIP("127.0.0.2")})
+	assert.Nil(t, err)
+	resp, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+	received := cryptSrv.received()
+	if assert.Equal(t, 2, len(received)) {
+		assert.True(t, strings.HasPrefix(received[0], "127.0.0.1:"), received[0])
+		assert.True(t, strings.HasPrefix(received[1], "127.0.0.2:"), received[1])
+	}
+
+	_, err = AddressToUpstream("tcp://"+tcpSrv.addr()+"?source=invalid", Options{})
+	assert.NotNil(t, err)
+	_, err = AddressToUpstream("tcp://"+tcpSrv.addr()+"?interface=nonexistent0", Options{})
+	assert.NotNil(t, err)
+}
+
+func TestUpstreamInterface(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		_, err := AddressToUpstream("tcp://127.0.0.1:53?interface=lo", Options{})
+		assert.NotNil(t, err)
+		return
+	}
+
+	tcpSrv := newTestTCPServer(t)
+	defer tcpSrv.close()
+	u, err := AddressToUpstream("tcp://"+tcpSrv.addr()+"?interface=lo", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	resp, err := u.Exchange(createTestMessage())
+	if err != nil && strings.Contains(err.Error(), "operation not permitted") {
+		t.Skip("SO_BINDTODEVICE requires CAP_NET_RAW")
+	}
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+}
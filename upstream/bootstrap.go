@@ -18,6 +18,12 @@ import (
 	"github.com/miekg/dns"
 )
 
+const (
+	defaultBootstrapTTL      = 5 * time.Minute  // for the addresses resolved by the system resolver that doesn't report the TTL
+	minBootstrapTTL          = 30 * time.Second // minimum lifetime of the resolved addresses, also the retry interval if re-resolving fails
+	maxBootstrapDialFailures = 3                // the addresses are re-resolved after this number of the failed dials in a row
+)
+
 // RootCAs is the CertPool that must be used by all upstreams
 // Redefining RootCAs makes sense on iOS to overcome the 15MB memory limit of the NEPacketTunnelProvider
 // nolint
@@ -28,7 +34,18 @@ type bootstrapper struct {
 	resolvers      []*Resolver   // list of Resolvers to use to resolve hostname, if necessary
 	timeout        time.Duration // resolution duration (shared with the upstream) (0 == infinite timeout)
 	dialContext    dialHandler   // specifies the dial function for creating unencrypted TCP connections.
+	proxyDial      dialHandler   // dials the connections through the proxy (see Options.Proxy), nil if there's none
+	bind           bindOptions   // local address and interface of the connections
 	resolvedConfig *tls.Config
+	weight         int        // upstream weight (see Options.Weight)
+	tlsOptions     tlsOptions // per-upstream TLS settings
+	preferIPv6     bool       // IPv6 addresses are dialed first (see Options.PreferIPv6)
+
+	// the addresses the hostname is resolved to, they are re-resolved when they expire
+	resolved     []string  // the last known good addresses
+	expire       time.Time // resolved must be re-resolved after this time
+	resolving    bool      // another goroutine is re-resolving the addresses
+	dialFailures int       // number of the failed dials in a row
 	sync.RWMutex
 }
 
@@ -40,54 +57,120 @@ type Resolver struct {
 }
 
 // toBootResolved creates a new bootstrapper that already contains resolved config.
-// This can be done only in the case when we already know the resolver IP address.
+// This can be done only in the case when we already know the resolver IP address (opts.ServerIP).
 // timeout is also used for establishing TCP connections
-func toBootResolved(address string, serverIP net.IP, timeout time.Duration) (*bootstrapper, error) {
+func toBootResolved(address string, opts Options) (*bootstrapper, error) {
 	// get a host without port
 	host, port, err := getAddressHostPort(address)
 	if err != nil {
 		return nil, fmt.Errorf("bootstrapper requires port in address %s", address)
 	}
 
-	// Upgrade lock to protect n.resolved
-	resolverAddress := net.JoinHostPort(serverIP.String(), port)
+	tlsOpts, err := newTLSOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	bind, err := newBindOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	proxyDial, err := createProxyDial(opts, bind)
+	if err != nil {
+		return nil, err
+	}
 
-	return &bootstrapper{
-		address:        address,
-		dialContext:    createDialContext([]string{resolverAddress}, timeout),
-		resolvedConfig: createTLSConfig(host),
-		timeout:        timeout,
-	}, nil
+	// Upgrade lock to protect n.resolved
+	resolverAddress := net.JoinHostPort(opts.ServerIP.String(), port)
+
+	n := &bootstrapper{
+		address:    address,
+		proxyDial:  proxyDial,
+		bind:       bind,
+		timeout:    opts.Timeout,
+		weight:     opts.Weight,
+		tlsOptions: tlsOpts,
+		preferIPv6: opts.PreferIPv6,
+	}
+	n.dialContext = createDialContext([]string{resolverAddress}, n.baseDial(), n.preferIPv6)
+	n.resolvedConfig = n.createTLSConfig(host)
+	return n, nil
 }
 
 // toBoot initializes a new bootstrapper instance
 // address -- original resolver address string (i.e. tls://one.one.one.one:853)
-// bootstrapAddr -- a list of bootstrap DNS resolvers' addresses
-// timeout -- DNS query timeout
-func toBoot(address string, bootstrapAddr []string, timeout time.Duration) *bootstrapper {
+// opts.Bootstrap -- a list of bootstrap DNS resolvers' addresses
+// opts.Timeout -- DNS query timeout
+func toBoot(address string, opts Options) (*bootstrapper, error) {
+	tlsOpts, err := newTLSOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	bind, err := newBindOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	proxyDial, err := createProxyDial(opts, bind)
+	if err != nil {
+		return nil, err
+	}
+
 	resolvers := []*Resolver{}
-	if bootstrapAddr != nil && len(bootstrapAddr) != 0 {
+	if opts.Bootstrap != nil && len(opts.Bootstrap) != 0 {
 		// Create a list of resolvers for parallel lookup
-		for _, boot := range bootstrapAddr {
-			r := NewResolver(boot, timeout)
+		// The bootstrap DNS queries are sent from the same local address and interface
+		bootOpts := Options{Timeout: opts.Timeout, SourceIP: opts.SourceIP, Interface: opts.Interface}
+		for _, boot := range opts.Bootstrap {
+			r := newResolver(boot, bootOpts)
 			resolvers = append(resolvers, r)
 		}
 	} else {
 		// nil resolver if the default one
-		resolvers = append(resolvers, NewResolver("", timeout))
+		resolvers = append(resolvers, NewResolver("", opts.Timeout))
 	}
 
 	return &bootstrapper{
-		address:   address,
-		resolvers: resolvers,
-		timeout:   timeout,
+		address:    address,
+		resolvers:  resolvers,
+		proxyDial:  proxyDial,
+		bind:       bind,
+		timeout:    opts.Timeout,
+		weight:     opts.Weight,
+		tlsOptions: tlsOpts,
+		preferIPv6: opts.PreferIPv6,
+	}, nil
+}
+
+// createProxyDial creates the dial function for the proxy specified in the options, if any
+// The connections to the proxy are bound as specified in bind.
+func createProxyDial(opts Options, bind bindOptions) (dialHandler, error) {
+	if opts.Proxy == "" {
+		return nil, nil
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = dialTimeout
 	}
+	return newProxyDialer(opts.Proxy, bind.dialer("tcp", timeout))
+}
+
+// baseDial returns the function that opens the connections to the resolved addresses:
+// either through the proxy or directly from the bound local address
+func (n *bootstrapper) baseDial() dialHandler {
+	if n.proxyDial != nil {
+		return n.proxyDial
+	}
+	return n.bind.dialContext(n.timeout)
 }
 
 // NewResolver creates an instance of Resolver structure with defined net.Resolver and it's address
 // resolverAddress is address of net.Resolver
 // The host in the address parameter of Dial func will always be a literal IP address (from documentation)
 func NewResolver(resolverAddress string, timeout time.Duration) *Resolver {
+	return newResolver(resolverAddress, Options{Timeout: timeout})
+}
+
+// newResolver creates an instance of Resolver with the specified options (see NewResolver)
+func newResolver(resolverAddress string, opts Options) *Resolver {
 	r := &Resolver{}
 
 	// set default net.Resolver as a resolver if resolverAddress is empty
@@ -97,9 +180,6 @@ func NewResolver(resolverAddress string, timeout time.Duration) *Resolver {
 	}
 
 	r.resolverAddress = resolverAddress
-	opts := Options{
-		Timeout: timeout,
-	}
 	var err error
 	r.upstream, err = AddressToUpstream(resolverAddress, opts)
 	if err != nil {
@@ -174,13 +254,21 @@ func (r *Resolver) resolve(host string, qtype uint16, ch chan *resultError) {
 
 // LookupIPAddr returns result of LookupIPAddr method of Resolver's net.Resolver
 func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ipAddrs, _, err := r.lookupIPAddrTTL(ctx, host)
+	return ipAddrs, err
+}
+
+// lookupIPAddrTTL resolves the host and returns the minimum TTL of the records
+// The system resolver doesn't report the TTL, so defaultBootstrapTTL is returned for it.
+func (r *Resolver) lookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
 	if r.resolver != nil {
 		// use system resolver
-		return r.resolver.LookupIPAddr(ctx, host)
+		ipAddrs, err := r.resolver.LookupIPAddr(ctx, host)
+		return ipAddrs, defaultBootstrapTTL, err
 	}
 
 	if r.upstream == nil || len(host) == 0 {
-		return []net.IPAddr{}, nil
+		return []net.IPAddr{}, 0, nil
 	}
 
 	if host[:1] != "." {
@@ -193,6 +281,7 @@ func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr,
 
 	var ipAddrs []net.IPAddr
 	var errs []error
+	var ttl uint32
 	n := 0
 wait:
 	for {
@@ -203,6 +292,7 @@ wait:
 				errs = append(errs, re.err)
 			} else {
 				proxyutil.AppendIPAddrs(&ipAddrs, re.resp.Answer)
+				ttl = minAddrTTL(ttl, re.resp.Answer)
 			}
 			n++
 			if n == 2 {
@@ -212,10 +302,23 @@ wait:
 	}
 
 	if len(ipAddrs) == 0 && len(errs) != 0 {
-		return []net.IPAddr{}, errs[0]
+		return []net.IPAddr{}, 0, errs[0]
 	}
 
-	return proxyutil.SortIPAddrs(ipAddrs), nil
+	return proxyutil.SortIPAddrs(ipAddrs), time.Duration(ttl) * time.Second, nil
+}
+
+// minAddrTTL returns the minimum TTL of the A and AAAA records, ttl == 0 means there's no TTL yet
+func minAddrTTL(ttl uint32, answer []dns.RR) uint32 {
+	for _, rr := range answer {
+		if t := rr.Header().Rrtype; t != dns.TypeA && t != dns.TypeAAAA {
+			continue
+		}
+		if ttl == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
 }
 
 // dialHandler specifies the dial function for creating unencrypted TCP connections.
@@ -252,13 +355,25 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 		n.Lock()
 		defer n.Unlock()
 
-		dialContext := createDialContext([]string{resolverAddress}, n.timeout)
+		dialContext := createDialContext([]string{resolverAddress}, n.baseDial(), n.preferIPv6)
 		n.dialContext = dialContext
-		config := createTLSConfig(host)
+		config := n.createTLSConfig(host)
 		n.resolvedConfig = config
 		return config, n.dialContext, nil
 	}
 
+	// the proxy resolves the hostname itself, the bootstrap DNS servers may be unreachable
+	if n.proxyDial != nil {
+		n.RUnlock()
+
+		n.Lock()
+		defer n.Unlock()
+
+		n.dialContext = createDialContext([]string{net.JoinHostPort(host, port)}, n.baseDial(), n.preferIPv6)
+		n.resolvedConfig = n.createTLSConfig(host)
+		return n.resolvedConfig, n.dialContext, nil
+	}
+
 	// Don't lock anymore (we can launch multiple lookup requests at a time)
 	// Otherwise, it might mess with the timeout specified for the Upstream
 	// See here: https://github.com/AdguardTeam/dnsproxy/issues/15
@@ -268,6 +383,24 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 	// if it's a hostname
 	//
 
+	resolved, ttl, err := n.lookup(host, port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	n.resolved = resolved
+	n.expire = time.Now().Add(ttl)
+	n.dialContext = n.dialResolved
+	n.resolvedConfig = n.createTLSConfig(host)
+	return n.resolvedConfig, n.dialContext, nil
+}
+
+// lookup resolves the hostname with the bootstrap resolvers
+// Returns the host:port addresses and the time they can be cached for.
+func (n *bootstrapper) lookup(host, port string) ([]string, time.Duration, error) {
 	var ctx context.Context
 	if n.timeout > 0 {
 		ctxWithTimeout, cancel := context.WithTimeout(context.TODO(), n.timeout)
@@ -277,9 +410,9 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 		ctx = context.Background()
 	}
 
-	addrs, err := LookupParallel(ctx, n.resolvers, host)
+	addrs, ttl, err := lookupParallel(ctx, n.resolvers, host)
 	if err != nil {
-		return nil, nil, errorx.Decorate(err, "failed to lookup %s", host)
+		return nil, 0, errorx.Decorate(err, "failed to lookup %s", host)
 	}
 
 	resolved := []string{}
@@ -293,55 +426,87 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 
 	if len(resolved) == 0 {
 		// couldn't find any suitable IP address
-		return nil, nil, fmt.Errorf("couldn't find any suitable IP address for host %s", host)
+		return nil, 0, fmt.Errorf("couldn't find any suitable IP address for host %s", host)
+	}
+
+	if ttl < minBootstrapTTL {
+		ttl = minBootstrapTTL
 	}
+	return resolved, ttl, nil
+}
+
+// dialResolved is the dialHandler for the resolved hostname
+// It tries the addresses one by one and re-resolves them if they are expired or if the dials keep failing.
+func (n *bootstrapper) dialResolved(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := createDialContext(n.getResolved(), n.baseDial(), n.preferIPv6)(ctx, network, addr)
 
 	n.Lock()
 	defer n.Unlock()
-
-	dialContext := createDialContext(resolved, n.timeout)
-	n.dialContext = dialContext
-	n.resolvedConfig = createTLSConfig(host)
-	return n.resolvedConfig, n.dialContext, nil
+	if err == nil {
+		n.dialFailures = 0
+		return conn, nil
+	}
+	if ctx.Err() != nil {
+		// the dial was cancelled (i.e. the hedged request has been answered by another upstream),
+		// that doesn't mean the addresses are wrong
+		return nil, err
+	}
+	n.dialFailures++
+	if n.dialFailures >= maxBootstrapDialFailures {
+		log.Tracef("%d dials to %s failed in a row, the addresses will be re-resolved", n.dialFailures, n.address)
+		n.dialFailures = 0
+		n.expire = time.Now()
+	}
+	return nil, err
 }
 
-// createDialContext returns dialContext function that tries to establish connection with all given addresses one by one
-func createDialContext(addresses []string, timeout time.Duration) (dialContext dialHandler) {
-	dialer := &net.Dialer{
-		Timeout:   timeout,
-		DualStack: true,
+// getResolved returns the resolved addresses, they are re-resolved if they are expired
+// If re-resolving fails, the last known good addresses are used.
+func (n *bootstrapper) getResolved() []string {
+	n.Lock()
+	resolved := n.resolved
+	if n.resolving || time.Now().Before(n.expire) {
+		n.Unlock()
+		return resolved
 	}
+	// the other dials use the old addresses in the meantime
+	n.resolving = true
+	n.Unlock()
 
-	dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		errs := []error{}
+	host, port, _ := getAddressHostPort(n.address)
+	newResolved, ttl, err := n.lookup(host, port)
+
+	n.Lock()
+	defer n.Unlock()
+	n.resolving = false
+	if err != nil {
+		log.Info("Failed to re-resolve %s, using the last known addresses %v: %s", n.address, n.resolved, err)
+		n.expire = time.Now().Add(minBootstrapTTL)
+		return n.resolved
+	}
+	log.Tracef("%s is re-resolved to %v", n.address, newResolved)
+	n.resolved = newResolved
+	n.expire = time.Now().Add(ttl)
+	return n.resolved
+}
 
-		// Return first connection without error
+// createDialContext returns dialContext function that establishes connection with one of the given addresses
+// The addresses are dialed in turn with a short delay like Happy Eyeballs (RFC 8305) describes,
+// the IPv4 and IPv6 addresses alternate starting with the preferred family.
+// dial opens the connections, e.g. through a proxy or from a specific local address (see bootstrapper.baseDial)
+func createDialContext(addresses []string, dial dialHandler, preferIPv6 bool) (dialContext dialHandler) {
+	addresses = interleaveAddresses(addresses, preferIPv6)
+	dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 		// Note that we're using bootstrapped resolverAddress instead of what's passed to the function
-		for _, resolverAddress := range addresses {
-			log.Tracef("Dialing to %s", resolverAddress)
-			start := time.Now()
-			con, err := dialer.DialContext(ctx, network, resolverAddress)
-			elapsed := time.Since(start) / time.Millisecond
-
-			if err == nil {
-				log.Tracef("dialer has successfully initialized connection to %s in %d milliseconds", resolverAddress, elapsed)
-				return con, err
-			}
-			errs = append(errs, err)
-			log.Tracef("dialer failed to initialize connection to %s, in %d milliseconds, cause: %s", resolverAddress, elapsed, err)
-		}
-		return nil, errorx.DecorateMany("all dialers failed to initialize connection: ", errs...)
+		return happyEyeballsDial(ctx, network, addresses, dial, happyEyeballsDelay)
 	}
 	return
 }
 
 // createTLSConfig creates a client TLS config
-func createTLSConfig(host string) *tls.Config {
-	return &tls.Config{
-		ServerName: host,
-		RootCAs:    RootCAs,
-		MinVersion: tls.VersionTLS12,
-	}
+// host is used as the server name unless it's overridden in the options (see Options.TLSServerName)
+func (n *bootstrapper) createTLSConfig(host string) *tls.Config {
+	return n.tlsOptions.createTLSConfig(host)
 }
 
 // getAddressHostPort splits resolver address into host and port
@@ -2,9 +2,12 @@ package upstream
 
 import (
 	"context"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -69,3 +72,141 @@ func TestNewResolverIsValid(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, len(addrs) == 0)
 }
+
+// testBootstrapServer is a local plain DNS server that resolves any A request to the specified IP address
+type testBootstrapServer struct {
+	*dns.Server
+
+	sync.Mutex
+	ip      net.IP
+	ttl     uint32
+	fail    bool // answer with SERVFAIL
+	queries int  // number of the A requests
+}
+
+func newTestBootstrapServer(t *testing.T) *testBootstrapServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	s := &testBootstrapServer{ip: net.IP{127, 0, 0, 1}, ttl: 60}
+	s.Server = &dns.Server{PacketConn: conn, Handler: s}
+	go func() { _ = s.ActivateAndServe() }()
+	return s
+}
+
+func (s *testBootstrapServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	if s.fail {
+		resp.Rcode = dns.RcodeServerFailure
+	} else if req.Question[0].Qtype == dns.TypeA {
+		s.queries++
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.ttl},
+			A:   s.ip,
+		}}
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func (s *testBootstrapServer) set(ip net.IP, fail bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.ip, s.fail = ip, fail
+}
+
+func (s *testBootstrapServer) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queries
+}
+
+func (s *testBootstrapServer) addr() string {
+	return s.PacketConn.LocalAddr().String()
+}
+
+func TestBootstrapReResolve(t *testing.T) {
+	bootstrap := newTestBootstrapServer(t)
+	defer func() { _ = bootstrap.Shutdown() }()
+
+	// the same port on two addresses
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l1.Close()
+	_, port, _ := net.SplitHostPort(l1.Addr().String())
+	l2, err := net.Listen("tcp", "127.0.0.2:"+port)
+	assert.Nil(t, err)
+	for _, l := range []net.Listener{l1, l2} {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				_ = conn.Close()
+			}
+		}(l)
+	}
+
+	b, err := toBoot("tls://dns.example.org:"+port, Options{Timeout: time.Second, Bootstrap: []string{bootstrap.addr()}})
+	assert.Nil(t, err)
+	_, dial, err := b.get()
+	assert.Nil(t, err)
+	assertDialed := func(ip string) {
+		t.Helper()
+		conn, err := dial(context.Background(), "tcp", "")
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Equal(t, net.JoinHostPort(ip, port), conn.RemoteAddr().String())
+		_ = conn.Close()
+	}
+	expire := func() {
+		b.Lock()
+		b.expire = time.Now()
+		b.Unlock()
+	}
+
+	// the TTL is respected
+	assertDialed("127.0.0.1")
+	assert.Equal(t, 1, bootstrap.count())
+	assert.InDelta(t, 60, time.Until(b.expire).Seconds(), 2)
+	bootstrap.set(net.IP{127, 0, 0, 2}, false)
+	assertDialed("127.0.0.1")
+	assert.Equal(t, 1, bootstrap.count())
+
+	// the addresses are re-resolved after they expire
+	expire()
+	assertDialed("127.0.0.2")
+	assert.Equal(t, 2, bootstrap.count())
+
+	// the last known addresses are used if re-resolving fails
+	bootstrap.set(net.IP{127, 0, 0, 1}, true)
+	expire()
+	assertDialed("127.0.0.2")
+	assert.InDelta(t, minBootstrapTTL.Seconds(), time.Until(b.expire).Seconds(), 2)
+
+	// the addresses are re-resolved after the dials fail
+	bootstrap.set(net.IP{127, 0, 0, 1}, false)
+	_ = l2.Close()
+	for i := 0; i < maxBootstrapDialFailures; i++ {
+		_, err = dial(context.Background(), "tcp", "")
+		assert.NotNil(t, err)
+	}
+	assertDialed("127.0.0.1")
+
+	// the cancelled dials are not counted as failures
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bootstrap.set(net.IP{127, 0, 0, 2}, false)
+	for i := 0; i < maxBootstrapDialFailures; i++ {
+		_, err = dial(ctx, "tcp", "")
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, 0, b.dialFailures)
+	assertDialed("127.0.0.1")
+}
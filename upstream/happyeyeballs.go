@@ -0,0 +1,126 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// happyEyeballsDelay is the delay between the connection attempts (RFC 8305 recommends 250ms)
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// interleaveAddresses sorts the host:port addresses for Happy Eyeballs:
+// the IPv4 and IPv6 addresses alternate starting with the preferred family, the order within each family is kept.
+// The addresses that aren't IP addresses (e.g. the ones resolved by the proxy) are considered to be of the preferred family.
+func interleaveAddresses(addresses []string, preferIPv6 bool) []string {
+	var preferred, other []string
+	for _, addr := range addresses {
+		host, _, err := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || (ip.To4() == nil) == preferIPv6 {
+			preferred = append(preferred, addr)
+		} else {
+			other = append(other, addr)
+		}
+	}
+
+	result := make([]string, 0, len(addresses))
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			result = append(result, preferred[i])
+		}
+		if i < len(other) {
+			result = append(result, other[i])
+		}
+	}
+	return result
+}
+
+// dialResult is the result of a single connection attempt
+type dialResult struct {
+	conn    net.Conn
+	address string
+	err     error
+}
+
+// happyEyeballsDial connects to the addresses in the specified order (see interleaveAddresses) like RFC 8305 describes:
+// the next attempt is started after the delay or once the previous attempt fails,
+// the first established connection is returned and the other attempts are cancelled.
+func happyEyeballsDial(ctx context.Context, network string, addresses []string, dial dialHandler, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan *dialResult, len(addresses))
+	next, running := 0, 0
+	start := func() {
+		address := addresses[next]
+		next++
+		running++
+		go func() {
+			log.Tracef("Dialing to %s", address)
+			begin := time.Now()
+			conn, err := dial(ctx, network, address)
+			elapsed := time.Since(begin) / time.Millisecond
+			if err == nil {
+				log.Tracef("dialer has successfully initialized connection to %s in %d milliseconds", address, elapsed)
+			} else {
+				log.Tracef("dialer failed to initialize connection to %s, in %d milliseconds, cause: %s", address, elapsed, err)
+			}
+			results <- &dialResult{conn: conn, address: address, err: err}
+		}()
+	}
+
+	// the timer starts the next attempt
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	restart := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+
+	var errs []error
+	start()
+	for {
+		var timeout <-chan time.Time
+		if next < len(addresses) {
+			timeout = timer.C
+		}
+
+		select {
+		case <-timeout:
+			start()
+			timer.Reset(delay)
+		case res := <-results:
+			running--
+			if res.err == nil {
+				// the other connections are closed if they are established anyway
+				go closeDialResults(results, running)
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			if next < len(addresses) {
+				start()
+				restart()
+			} else if running == 0 {
+				return nil, errorx.DecorateMany("all dialers failed to initialize connection: ", errs...)
+			}
+		}
+	}
+}
+
+// closeDialResults waits for the remaining connection attempts and closes the connections
+func closeDialResults(results chan *dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.conn != nil {
+			_ = res.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterleaveAddresses(t *testing.T) {
+	addresses := []string{"1.1.1.1:853", "1.0.0.1:853", "[2606:4700::1111]:853", "[2606:4700::1001]:853", "8.8.8.8:853"}
+	assert.Equal(t, []string{"1.1.1.1:853", "[2606:4700::1111]:853", "1.0.0.1:853", "[2606:4700::1001]:853", "8.8.8.8:853"},
+		interleaveAddresses(addresses, false))
+	assert.Equal(t, []string{"[2606:4700::1111]:853", "1.1.1.1:853", "[2606:4700::1001]:853", "1.0.0.1:853", "8.8.8.8:853"},
+		interleaveAddresses(addresses, true))
+}
+
+// testDialer pretends to connect to the addresses: the black-holed ones hang until the context is cancelled,
+// the refused ones fail immediately, and the others succeed after the delay even if the context is cancelled
+type testDialer struct {
+	blackHoled map[string]bool
+	refused    map[string]bool
+	delay      time.Duration
+
+	sync.Mutex
+	dialed []string
+	closed int
+}
+
+type testDialerConn struct {
+	net.Conn
+	d *testDialer
+}
+
+func (c *testDialerConn) Close() error {
+	c.d.Lock()
+	defer c.d.Unlock()
+	c.d.closed++
+	return nil
+}
+
+func (d *testDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.Lock()
+	d.dialed = append(d.dialed, addr)
+	d.Unlock()
+
+	switch {
+	case d.blackHoled[addr]:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case d.refused[addr]:
+		return nil, errors.New("connection refused")
+	}
+	time.Sleep(d.delay)
+	return &testDialerConn{d: d}, nil
+}
+
+func (d *testDialer) state() (dialed []string, closed int) {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string{}, d.dialed...), d.closed
+}
+
+func TestHappyEyeballsDial(t *testing.T) {
+	addresses := []string{"1.1.1.1:853", "[2606:4700::1111]:853", "1.0.0.1:853"}
+
+	// the black-holed IPv4 address doesn't delay the connection
+	d := &testDialer{blackHoled: map[string]bool{"1.1.1.1:853": true}}
+	start := time.Now()
+	conn, err := happyEyeballsDial(context.Background(), "tcp", addresses, d.dial, 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.NotNil(t, conn)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 50*time.Millisecond && elapsed < time.Second, elapsed.String())
+	dialed, _ := d.state()
+	assert.Equal(t, []string{"1.1.1.1:853", "[2606:4700::1111]:853"}, dialed)
+
+	// the next address is dialed right after the failure
+	d = &testDialer{refused: map[string]bool{"1.1.1.1:853": true, "[2606:4700::1111]:853": true}}
+	start = time.Now()
+	_, err = happyEyeballsDial(context.Background(), "tcp", addresses, d.dial, time.Second)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	dialed, _ = d.state()
+	assert.Equal(t, addresses, dialed)
+
+	// the slower connections are closed
+	d = &testDialer{delay: 100 * time.Millisecond}
+	_, err = happyEyeballsDial(context.Background(), "tcp", addresses, d.dial, 10*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+	dialed, closed := d.state()
+	assert.Equal(t, addresses, dialed)
+	assert.Equal(t, 2, closed)
+
+	// all addresses fail
+	d = &testDialer{refused: map[string]bool{"1.1.1.1:853": true, "[2606:4700::1111]:853": true, "1.0.0.1:853": true}}
+	_, err = happyEyeballsDial(context.Background(), "tcp", addresses, d.dial, 10*time.Millisecond)
+	assert.NotNil(t, err)
+
+	// the context is respected
+	d = &testDialer{blackHoled: map[string]bool{"1.1.1.1:853": true, "[2606:4700::1111]:853": true, "1.0.0.1:853": true}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = happyEyeballsDial(ctx, "tcp", addresses, d.dial, 10*time.Millisecond)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,139 @@
+package upstream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE (RFC 9180) in the base mode with the only cipher suite that is required by ODoH:
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+const (
+	hpkeKEMX25519SHA256 = 0x0020
+	hpkeKDFSHA256       = 0x0001
+	hpkeAEADAES128GCM   = 0x0001
+
+	hpkeNk      = 16 // AEAD key size
+	hpkeNn      = 12 // AEAD nonce size
+	hpkeNh      = 32 // KDF output size
+	hpkeKeySize = 32 // X25519 keys size
+)
+
+var (
+	hpkeKEMSuiteID = []byte{'K', 'E', 'M', 0x00, 0x20}
+	hpkeSuiteID    = []byte{'H', 'P', 'K', 'E', 0x00, 0x20, 0x00, 0x01, 0x00, 0x01}
+)
+
+// hpkeContext is the HPKE encryption context that is used for a single message
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+// hpkeSetupBaseS creates the sender's context for the recipient's public key
+// Returns the encapsulated key that must be sent to the recipient.
+func hpkeSetupBaseS(pkR, info []byte) (enc []byte, ctx *hpkeContext, err error) {
+	if len(pkR) != hpkeKeySize {
+		return nil, nil, errors.New("invalid HPKE public key size")
+	}
+
+	var skE, pkE, pk, dh [hpkeKeySize]byte
+	if _, err = io.ReadFull(rand.Reader, skE[:]); err != nil {
+		return nil, nil, err
+	}
+	curve25519.ScalarBaseMult(&pkE, &skE)
+	copy(pk[:], pkR)
+	curve25519.ScalarMult(&dh, &skE, &pk)
+	if dh == [hpkeKeySize]byte{} {
+		return nil, nil, errors.New("invalid HPKE public key")
+	}
+
+	enc = pkE[:]
+	kemContext := append(append([]byte{}, enc...), pkR...)
+	sharedSecret := hpkeExtractAndExpand(dh[:], kemContext)
+	ctx, err = hpkeKeySchedule(sharedSecret, info)
+	return enc, ctx, err
+}
+
+// hpkeExtractAndExpand derives the KEM shared secret from the Diffie-Hellman result
+func hpkeExtractAndExpand(dh, kemContext []byte) []byte {
+	prk := hpkeLabeledExtract(hpkeKEMSuiteID, nil, "eae_prk", dh)
+	return hpkeLabeledExpand(hpkeKEMSuiteID, prk, "shared_secret", kemContext, hpkeNh)
+}
+
+// hpkeKeySchedule derives the encryption context from the KEM shared secret (base mode)
+func hpkeKeySchedule(sharedSecret, info []byte) (*hpkeContext, error) {
+	pskIDHash := hpkeLabeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := hpkeLabeledExtract(hpkeSuiteID, nil, "info_hash", info)
+	keyScheduleContext := append(append([]byte{0x00}, pskIDHash...), infoHash...)
+
+	secret := hpkeLabeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	key := hpkeLabeledExpand(hpkeSuiteID, secret, "key", keyScheduleContext, hpkeNk)
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      hpkeLabeledExpand(hpkeSuiteID, secret, "base_nonce", keyScheduleContext, hpkeNn),
+		exporterSecret: hpkeLabeledExpand(hpkeSuiteID, secret, "exp", keyScheduleContext, hpkeNh),
+	}, nil
+}
+
+// seal encrypts the only message of the context (the sequence number is 0, so the nonce is the base one)
+func (c *hpkeContext) seal(aad, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.baseNonce, plaintext, aad)
+}
+
+// open decrypts the only message of the context
+func (c *hpkeContext) open(aad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.baseNonce, ciphertext, aad)
+}
+
+// export derives a secret of the specified length from the context
+func (c *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return hpkeLabeledExpand(hpkeSuiteID, c.exporterSecret, "sec", exporterContext, length)
+}
+
+func hpkeLabeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte("HPKE-v1"), suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+func hpkeLabeledExpand(suiteID, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := make([]byte, 2, 2+7+len(suiteID)+len(label)+len(info))
+	binary.BigEndian.PutUint16(labeledInfo, uint16(length))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	return hkdfExpand(prk, labeledInfo, length)
+}
+
+// hkdfExpand is HKDF-Expand with SHA-256
+func hkdfExpand(prk, info []byte, length int) []byte {
+	out := make([]byte, length)
+	// the length is always small enough, so the reader can't fail
+	_, _ = io.ReadFull(hkdf.Expand(sha256.New, prk, info), out)
+	return out
+}
+
+// newAESGCM creates an AES-GCM AEAD with the specified key
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
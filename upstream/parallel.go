@@ -20,8 +20,16 @@ type exchangeResult struct {
 
 // ExchangeParallel function is called to parallel exchange dns request by many upstreams
 // First answer without error will be returned
+// SERVFAIL answers are returned only if there are no better ones (see ExchangeParallelEx)
 // We will return nil and error if count of errors equals count of upstreams
 func ExchangeParallel(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
+	return ExchangeParallelEx(u, req, []int{dns.RcodeServerFailure})
+}
+
+// ExchangeParallelEx is an extended version of ExchangeParallel() which has a custom list of the response codes
+// that are considered as failures. The first answer without error and with other response code will be returned.
+// If there are no such answers, the first answer with one of the failure response codes will be returned.
+func ExchangeParallelEx(u []Upstream, req *dns.Msg, failureRcodes []int) (*dns.Msg, Upstream, error) {
 	size := len(u)
 
 	if size == 0 {
@@ -42,24 +50,87 @@ func ExchangeParallel(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
 	}
 
 	errs := []error{}
-	for {
-		select {
-		case rep := <-ch:
-			reply := rep.reply
-			err := rep.err
-			if err != nil {
-				errs = append(errs, err)
-			}
+	var failure *exchangeResult // the first answer with a failure response code
+	for i := 0; i < size; i++ {
+		rep := <-ch
+		if rep.err != nil {
+			errs = append(errs, rep.err)
+			continue
+		}
+		if rep.reply == nil {
+			continue
+		}
 
-			if len(errs) == size {
-				return nil, nil, errorx.DecorateMany("all upstreams failed to exchange", errs...)
-			}
+		if !isFailureRcode(rep.reply, failureRcodes) {
+			return rep.reply, rep.upstream, nil
+		}
+		if failure == nil {
+			failure = rep
+		}
+	}
 
-			if reply != nil && err == nil {
-				return reply, rep.upstream, nil
-			}
+	if failure != nil {
+		return failure.reply, failure.upstream, nil
+	}
+	return nil, nil, errorx.DecorateMany("all upstreams failed to exchange", errs...)
+}
+
+// isFailureRcode checks if the response code of the reply is one of the specified ones
+func isFailureRcode(reply *dns.Msg, rcodes []int) bool {
+	for _, rcode := range rcodes {
+		if reply.Rcode == rcode {
+			return true
 		}
 	}
+	return false
+}
+
+// ExchangeAllResult is the successful result of an exchange with one of the upstreams
+type ExchangeAllResult struct {
+	Resp     *dns.Msg // DNS response
+	Upstream Upstream // Upstream that resolved the request
+}
+
+// ExchangeAll sends the request to all the upstreams in parallel and waits for all of them
+// Returns the successful results in the order they were received
+// or nil and error if all the upstreams failed
+func ExchangeAll(u []Upstream, req *dns.Msg) ([]ExchangeAllResult, error) {
+	size := len(u)
+
+	if size == 0 {
+		return nil, errors.New("no upstream specified")
+	}
+
+	if size == 1 {
+		reply, err := exchange(u[0], req)
+		if err != nil {
+			return nil, err
+		}
+		return []ExchangeAllResult{{Resp: reply, Upstream: u[0]}}, nil
+	}
+
+	ch := make(chan *exchangeResult, size)
+	for _, f := range u {
+		go exchangeAsync(f, req, ch)
+	}
+
+	errs := []error{}
+	results := []ExchangeAllResult{}
+	for i := 0; i < size; i++ {
+		rep := <-ch
+		if rep.err != nil {
+			errs = append(errs, rep.err)
+			continue
+		}
+		if rep.reply != nil {
+			results = append(results, ExchangeAllResult{Resp: rep.reply, Upstream: rep.upstream})
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, errorx.DecorateMany("all upstreams failed to exchange", errs...)
+	}
+	return results, nil
 }
 
 // exchangeAsync tries to resolve DNS request with one upstream and send result to resp channel
@@ -86,22 +157,28 @@ func exchange(u Upstream, req *dns.Msg) (*dns.Msg, error) {
 
 // lookupResult is a structure that represents result of lookup
 type lookupResult struct {
-	address []net.IPAddr // List of IP addresses
-	err     error        // Error
+	address []net.IPAddr  // List of IP addresses
+	ttl     time.Duration // Minimum TTL of the addresses
+	err     error         // Error
 }
 
 // LookupParallel starts parallel lookup for host ip with many Resolvers
 // First answer without error will be returned
 // Return nil and error if count of errors equals count of resolvers
 func LookupParallel(ctx context.Context, resolvers []*Resolver, host string) ([]net.IPAddr, error) {
+	address, _, err := lookupParallel(ctx, resolvers, host)
+	return address, err
+}
+
+// lookupParallel is LookupParallel that also returns the TTL of the addresses
+func lookupParallel(ctx context.Context, resolvers []*Resolver, host string) ([]net.IPAddr, time.Duration, error) {
 	size := len(resolvers)
 
 	if size == 0 {
-		return nil, errors.New("no resolvers specified")
+		return nil, 0, errors.New("no resolvers specified")
 	}
 	if size == 1 {
-		address, err := lookup(ctx, resolvers[0], host)
-		return address, err
+		return lookup(ctx, resolvers[0], host)
 	}
 
 	// Size of channel must accommodate results of lookups from all resolvers
@@ -123,11 +200,11 @@ func LookupParallel(ctx context.Context, resolvers []*Resolver, host string) ([]
 			}
 
 			if len(errs) == size {
-				return nil, errorx.DecorateMany("all resolvers failed to lookup", errs...)
+				return nil, 0, errorx.DecorateMany("all resolvers failed to lookup", errs...)
 			}
 
 			if addr != nil && err == nil {
-				return addr, nil
+				return addr, result.ttl, nil
 			}
 		}
 	}
@@ -135,21 +212,22 @@ func LookupParallel(ctx context.Context, resolvers []*Resolver, host string) ([]
 
 // lookupAsync tries to lookup for host ip with one Resolver and sends lookupResult to res channel
 func lookupAsync(ctx context.Context, r *Resolver, host string, res chan *lookupResult) {
-	address, err := lookup(ctx, r, host)
+	address, ttl, err := lookup(ctx, r, host)
 	res <- &lookupResult{
 		err:     err,
 		address: address,
+		ttl:     ttl,
 	}
 }
 
-func lookup(ctx context.Context, r *Resolver, host string) ([]net.IPAddr, error) {
+func lookup(ctx context.Context, r *Resolver, host string) ([]net.IPAddr, time.Duration, error) {
 	start := time.Now()
-	address, err := r.LookupIPAddr(ctx, host)
+	address, ttl, err := r.lookupIPAddrTTL(ctx, host)
 	elapsed := time.Since(start) / time.Millisecond
 	if err != nil {
 		log.Tracef("failed to lookup for %s in %d milliseconds using %s: %s", host, elapsed, r.resolverAddress, err)
 	} else {
 		log.Tracef("successfully finished lookup for %s in %d milliseconds using %s. Result : %s", host, elapsed, r.resolverAddress, address)
 	}
-	return address, err
+	return address, ttl, err
 }
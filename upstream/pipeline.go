@@ -0,0 +1,384 @@
+package upstream
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultMaxConns    = 4                // default maximum number of the pooled connections
+	defaultIdleTimeout = 30 * time.Second // default idle connections timeout
+
+	// maxPipelineTimeouts is the number of the queries in a row that timed out without any response over the connection
+	// after which the connection is considered dead and closed
+	maxPipelineTimeouts = 3
+)
+
+// pipelineConn is a stream connection that is used to send several DNS queries at once
+// The queries are written to the connection one by one, and the responses are matched by their IDs
+// in a separate goroutine, so they may come in any order.
+type pipelineConn struct {
+	conn        *dns.Conn
+	idleTimeout time.Duration
+
+	writeLock sync.Mutex // serializes the writes
+
+	lock     sync.Mutex
+	pending  map[uint16]chan *dns.Msg // queries in flight by their IDs
+	timeouts int                      // number of the queries that timed out since the last response
+	err      error                    // the reason the connection was closed, nil if it's alive
+
+	// readDeadline is the idle deadline or the latest deadline of the queries in flight, plus the idle timeout
+	readDeadline time.Time
+	// unbounded is the number of the queries in flight without a deadline, the reads have no deadline while there are any
+	unbounded int
+}
+
+// newPipelineConn starts reading the responses from the connection
+func newPipelineConn(conn net.Conn, idleTimeout time.Duration) *pipelineConn {
+	c := &pipelineConn{
+		conn:         &dns.Conn{Conn: conn},
+		idleTimeout:  idleTimeout,
+		pending:      map[uint16]chan *dns.Msg{},
+		readDeadline: time.Now().Add(idleTimeout),
+	}
+	_ = conn.SetReadDeadline(c.readDeadline)
+	go c.readLoop()
+	return c
+}
+
+// exchange sends the query and waits for the response
+// The query ID is replaced so that it does not clash with other queries in flight,
+// the original ID is restored in the response.
+func (c *pipelineConn) exchange(ctx context.Context, m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	req := m.Copy()
+	ch := make(chan *dns.Msg, 1)
+
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	req.Id = c.newID()
+	c.pending[req.Id] = ch
+	// the query has no deadline if there's neither timeout nor context deadline
+	deadline, ok := ctx.Deadline()
+	if timeout > 0 {
+		deadline, ok = time.Now().Add(timeout), true
+	}
+	c.extendReadDeadline(deadline, ok)
+	c.lock.Unlock()
+	defer c.remove(req.Id, !ok)
+
+	c.writeLock.Lock()
+	if timeout > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	err := c.conn.WriteMsg(req)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case reply := <-ch:
+		if reply == nil {
+			return nil, c.closeErr()
+		}
+		reply.Id = m.Id
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeoutCh:
+		err = errorx.TimeoutElapsed.New("no response from %s in %s", c.conn.RemoteAddr(), timeout)
+		c.timedOut(err)
+		return nil, err
+	}
+}
+
+// timedOut closes the connection if there were too many timeouts since the last response,
+// otherwise a dead connection would be kept alive by the new queries
+func (c *pipelineConn) timedOut(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.timeouts++
+	if c.timeouts >= maxPipelineTimeouts {
+		c.closeLocked(err)
+	}
+}
+
+// newID returns a random ID that is not used by the queries in flight
+// c.lock must be held.
+func (c *pipelineConn) newID() uint16 {
+	for {
+		// nolint:gosec
+		id := uint16(rand.Uint32())
+		if _, ok := c.pending[id]; !ok {
+			return id
+		}
+	}
+}
+
+// extendReadDeadline makes the reads wait for the response to the query with the specified deadline
+// The connection is closed by the reader if there are no queries for the idle timeout,
+// so the idle timeout is counted after the deadline. c.lock must be held.
+func (c *pipelineConn) extendReadDeadline(deadline time.Time, ok bool) {
+	if !ok {
+		c.unbounded++
+		if c.unbounded == 1 {
+			_ = c.conn.SetReadDeadline(time.Time{})
+		}
+		return
+	}
+
+	deadline = deadline.Add(c.idleTimeout)
+	if deadline.After(c.readDeadline) {
+		c.readDeadline = deadline
+		if c.unbounded == 0 {
+			_ = c.conn.SetReadDeadline(deadline)
+		}
+	}
+}
+
+// remove stops waiting for the response with the specified ID
+// The idle timeout is counted again when there are no queries without a deadline left.
+func (c *pipelineConn) remove(id uint16, unbounded bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pending, id)
+	if !unbounded {
+		return
+	}
+
+	c.unbounded--
+	if c.unbounded == 0 {
+		if idle := time.Now().Add(c.idleTimeout); idle.After(c.readDeadline) {
+			c.readDeadline = idle
+		}
+		_ = c.conn.SetReadDeadline(c.readDeadline)
+	}
+}
+
+// readLoop reads the responses and passes them to the queries until the connection is closed
+func (c *pipelineConn) readLoop() {
+	for {
+		reply, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		c.lock.Lock()
+		ch, ok := c.pending[reply.Id]
+		delete(c.pending, reply.Id)
+		c.timeouts = 0
+		c.lock.Unlock()
+
+		if ok {
+			ch <- reply
+		} else {
+			log.Tracef("Dropping an unexpected response from %s with ID %d", c.conn.RemoteAddr(), reply.Id)
+		}
+	}
+}
+
+// close closes the connection and interrupts the queries in flight
+func (c *pipelineConn) close(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closeLocked(err)
+}
+
+// closeLocked closes the connection, c.lock must be held
+func (c *pipelineConn) closeLocked(err error) {
+	if c.err != nil {
+		return
+	}
+
+	log.Tracef("Closing the connection to %s: %s", c.conn.RemoteAddr(), err)
+	c.err = errorx.Decorate(err, "connection to %s closed", c.conn.RemoteAddr())
+	_ = c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// closeErr returns the reason the connection was closed
+func (c *pipelineConn) closeErr() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// state returns the number of the queries in flight and whether the connection is alive
+func (c *pipelineConn) state() (inFlight int, alive bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.pending), c.err == nil
+}
+
+// pipelinePool is a pool of the persistent connections to an upstream
+// A new connection is created only if all existing connections are busy and the pool is not full,
+// otherwise the queries are pipelined over the least loaded connection.
+type pipelinePool struct {
+	dial        func(ctx context.Context) (net.Conn, error)
+	maxConns    int
+	idleTimeout time.Duration
+
+	lock    sync.Mutex
+	cond    *sync.Cond // signals that a connection has been dialed
+	conns   []*pipelineConn
+	dialing int // number of the connections being dialed
+
+	dialErr      error // error of the last failed dial
+	dialFailures int   // number of the failed dials, the waiters return dialErr if it changes
+}
+
+// newPipelinePool creates a new pool, see Options.MaxConns and Options.IdleTimeout
+func newPipelinePool(dial func(ctx context.Context) (net.Conn, error), maxConns int, idleTimeout time.Duration) *pipelinePool {
+	if maxConns <= 0 {
+		maxConns = defaultMaxConns
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	p := &pipelinePool{dial: dial, maxConns: maxConns, idleTimeout: idleTimeout}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+// exchange sends the query over one of the pooled connections
+// If the connection turns out to be closed (e.g. by the server), the query is retried over another one.
+// The timed out queries are not retried.
+func (p *pipelinePool) exchange(ctx context.Context, m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.exchange(ctx, m, timeout)
+	if err == nil || ctx.Err() != nil || errorx.IsOfType(err, errorx.TimeoutElapsed) {
+		return reply, err
+	}
+	if _, alive := c.state(); alive {
+		return nil, err
+	}
+
+	log.Tracef("The pooled connection is closed due to %s, retrying", err)
+	c, err = p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(ctx, m, timeout)
+}
+
+// get returns an idle connection, dials a new one if there are none and the pool is not full,
+// or returns the least loaded connection
+// It gives up waiting for the connections being dialed when the context is done or when one of the dials fails,
+// so that the queries don't wait for the failing dials one after another.
+func (p *pipelinePool) get(ctx context.Context) (*pipelineConn, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	dialFailures := p.dialFailures
+
+	var stop chan struct{}
+	defer func() {
+		if stop != nil {
+			close(stop)
+		}
+	}()
+
+	for {
+		best, bestInFlight := p.leastLoaded()
+		full := len(p.conns)+p.dialing >= p.maxConns
+		if best != nil && (bestInFlight == 0 || full) {
+			return best, nil
+		}
+		if p.dialFailures != dialFailures {
+			return nil, p.dialErr
+		}
+		if !full {
+			return p.create(ctx)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// all the connections are being dialed, wait for them or for the context
+		if stop == nil && ctx.Done() != nil {
+			stop = make(chan struct{})
+			go p.wakeOnDone(ctx, stop)
+		}
+		p.cond.Wait()
+	}
+}
+
+// wakeOnDone wakes up the goroutines waiting in get when the context is done
+func (p *pipelinePool) wakeOnDone(ctx context.Context, stop <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		p.lock.Lock()
+		p.cond.Broadcast()
+		p.lock.Unlock()
+	case <-stop:
+	}
+}
+
+// leastLoaded removes the closed connections and returns the one with the fewest queries in flight
+// p.lock must be held.
+func (p *pipelinePool) leastLoaded() (best *pipelineConn, bestInFlight int) {
+	alive := p.conns[:0]
+	for _, c := range p.conns {
+		inFlight, ok := c.state()
+		if !ok {
+			continue
+		}
+		alive = append(alive, c)
+		if best == nil || inFlight < bestInFlight {
+			best, bestInFlight = c, inFlight
+		}
+	}
+	for i := len(alive); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+	p.conns = alive
+	return best, bestInFlight
+}
+
+// create dials a new connection and adds it to the pool
+// p.lock must be held, it's released while dialing.
+func (p *pipelinePool) create(ctx context.Context) (*pipelineConn, error) {
+	p.dialing++
+	p.lock.Unlock()
+	conn, err := p.dial(ctx)
+	p.lock.Lock()
+	p.dialing--
+	defer p.cond.Broadcast()
+
+	if err != nil {
+		p.dialErr = err
+		p.dialFailures++
+		return nil, err
+	}
+	c := newPipelineConn(conn, p.idleTimeout)
+	p.conns = append(p.conns, c)
+	return c, nil
+}
@@ -0,0 +1,338 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTCPServer is a local plain DNS server that answers A requests with 8.8.8.8 (see assertResponse)
+// The requests for "slow." are answered after a delay, so the responses may come out of order.
+type testTCPServer struct {
+	listener net.Listener
+	accepted int32 // number of the accepted connections
+
+	conns []net.Conn
+	sync.Mutex
+}
+
+// clientIPs returns the IP addresses of the accepted connections
+func (s *testTCPServer) clientIPs() []string {
+	s.Lock()
+	defer s.Unlock()
+	ips := []string{}
+	for _, c := range s.conns {
+		ips = append(ips, c.RemoteAddr().(*net.TCPAddr).IP.String())
+	}
+	return ips
+}
+
+func newTestTCPServer(t *testing.T) *testTCPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	s := &testTCPServer{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.accepted, 1)
+			s.Lock()
+			s.conns = append(s.conns, conn)
+			s.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testTCPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &dns.Conn{Conn: conn}
+	var writeLock sync.Mutex
+	for {
+		req, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+		go func() {
+			if req.Question[0].Name == "slow." {
+				time.Sleep(200 * time.Millisecond)
+			}
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+				A:   net.IP{8, 8, 8, 8},
+			})
+			writeLock.Lock()
+			_ = c.WriteMsg(resp)
+			writeLock.Unlock()
+		}()
+	}
+}
+
+func (s *testTCPServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// closeConns closes the accepted connections
+func (s *testTCPServer) closeConns() {
+	s.Lock()
+	defer s.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testTCPServer) close() {
+	_ = s.listener.Close()
+	s.closeConns()
+}
+
+func TestTCPPoolReuse(t *testing.T) {
+	srv := newTestTCPServer(t)
+	defer srv.close()
+
+	u, err := AddressToUpstream("tcp://"+srv.addr(), Options{Timeout: time.Second})
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		req := createTestMessage()
+		resp, err := u.Exchange(req)
+		assert.Nil(t, err)
+		assertResponse(t, resp)
+		assert.Equal(t, req.Id, resp.Id)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&srv.accepted))
+
+	// the connection closed by the server is replaced
+	srv.closeConns()
+	resp, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&srv.accepted))
+}
+
+func TestTCPPoolPipelining(t *testing.T) {
+	srv := newTestTCPServer(t)
+	defer srv.close()
+
+	u, err := AddressToUpstream("tcp://"+srv.addr()+"?max_conns=1", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		req := createTestMessage()
+		req.Question[0].Name = "slow."
+		resp, err := u.Exchange(req)
+		assert.Nil(t, err)
+		if resp != nil {
+			assert.Equal(t, "slow.", resp.Question[0].Name)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the fast query is answered while the slow one is still in flight over the same connection
+	resp, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+	select {
+	case <-slowDone:
+		t.Fatalf("the slow query must still be in flight")
+	default:
+	}
+
+	<-slowDone
+	assert.Equal(t, int32(1), atomic.LoadInt32(&srv.accepted))
+}
+
+func TestTCPPoolIdleTimeout(t *testing.T) {
+	srv := newTestTCPServer(t)
+	defer srv.close()
+
+	u, err := AddressToUpstream("tcp://"+srv.addr()+"?idle_timeout=100ms", Options{Timeout: 100 * time.Millisecond})
+	assert.Nil(t, err)
+
+	resp, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+
+	pool := u.(*plainDNS).pool()
+	assert.Eventually(t, func() bool {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		_, alive := pool.conns[0].state()
+		return !alive
+	}, time.Second, 20*time.Millisecond)
+
+	resp, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&srv.accepted))
+}
+
+func TestTCPPoolNoTimeout(t *testing.T) {
+	srv := newTestTCPServer(t)
+	defer srv.close()
+
+	// the query without a timeout waits for the response longer than the idle timeout
+	u, err := AddressToUpstream("tcp://"+srv.addr()+"?idle_timeout=100ms", Options{})
+	assert.Nil(t, err)
+	req := createTestMessage()
+	req.Question[0].Name = "slow."
+	resp, err := u.Exchange(req)
+	assert.Nil(t, err)
+	if resp != nil {
+		assert.Equal(t, "slow.", resp.Question[0].Name)
+	}
+
+	// the idle connection is closed anyway
+	pool := u.(*plainDNS).pool()
+	assert.Eventually(t, func() bool {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		_, alive := pool.conns[0].state()
+		return !alive
+	}, time.Second, 20*time.Millisecond)
+}
+
+func TestTCPTruncated(t *testing.T) {
+	srv := newTestTCPServer(t)
+	defer srv.close()
+
+	// the UDP server on the same port truncates all the responses
+	udpConn, err := net.ListenPacket("udp", srv.addr())
+	assert.Nil(t, err)
+	udpSrv := &dns.Server{PacketConn: udpConn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Truncated = true
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = udpSrv.ActivateAndServe() }()
+	defer udpSrv.Shutdown()
+
+	u, err := AddressToUpstream(srv.addr(), Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		resp, err := u.Exchange(createTestMessage())
+		assert.Nil(t, err)
+		assertResponse(t, resp)
+	}
+
+	// the truncated queries are retried over new connections that are not pooled
+	assert.Equal(t, int32(2), atomic.LoadInt32(&srv.accepted))
+	assert.Nil(t, u.(*plainDNS).tcpPool)
+}
+
+func TestTCPPoolDeadConn(t *testing.T) {
+	// the server accepts the connections and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			defer conn.Close()
+		}
+	}()
+
+	u, err := AddressToUpstream("tcp://"+l.Addr().String(), Options{Timeout: 100 * time.Millisecond})
+	assert.Nil(t, err)
+
+	for i := 0; i < maxPipelineTimeouts; i++ {
+		_, err = u.Exchange(createTestMessage())
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&accepted))
+
+	// the dead connection is closed and replaced
+	pool := u.(*plainDNS).pool()
+	pool.lock.Lock()
+	_, alive := pool.conns[0].state()
+	pool.lock.Unlock()
+	assert.False(t, alive)
+
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&accepted))
+}
+
+func TestTCPPoolGetContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		<-release
+		return nil, errors.New("dial failed")
+	}
+	pool := newPipelinePool(dial, 1, 0)
+
+	// the only connection is being dialed
+	go func() { _, _ = pool.get(context.Background()) }()
+	assert.Eventually(t, func() bool {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		return pool.dialing == 1
+	}, time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := pool.get(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestTCPPoolGetDialFailed(t *testing.T) {
+	release := make(chan struct{})
+	var dials int32
+	dial := func(ctx context.Context) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		<-release
+		return nil, errors.New("dial failed")
+	}
+	pool := newPipelinePool(dial, 1, 0)
+
+	// the only connection is being dialed
+	go func() { _, _ = pool.get(context.Background()) }()
+	assert.Eventually(t, func() bool {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		return pool.dialing == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the waiter gets the dial error instead of dialing once again
+	errCh := make(chan error)
+	go func() {
+		_, err := pool.get(context.Background())
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-errCh:
+		assert.EqualError(t, err, "dial failed")
+	case <-time.After(time.Second):
+		t.Fatalf("the waiter is not woken up")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+}
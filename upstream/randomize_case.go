@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxCaseMismatches is the number of the replies in a row that don't preserve the query name case
+// after which the upstream is considered to not support the case randomization (see Options.RandomizeCase)
+const maxCaseMismatches = 3
+
+// caseDisabledPeriod is the time the case randomization is disabled for after the upstream has been detected
+// to not preserve the query name case, the upstream is checked again after that
+const caseDisabledPeriod = 10 * time.Minute
+
+// the ways the upstreams that don't preserve the query name case change it
+const (
+	caseFoldingLower int32 = iota + 1 // the name is lowercased
+	caseFoldingUpper                  // the name is uppercased
+)
+
+// errCaseMismatch is returned when the case of the question in the reply doesn't match the query
+var errCaseMismatch = errors.New("the question case in the reply doesn't match the query")
+
+// randomizeCase randomly changes the case of the letters in the name (DNS 0x20 encoding)
+func randomizeCase(name string) string {
+	random := make([]byte, len(name))
+	_, _ = rand.Read(random)
+
+	b := []byte(name)
+	for i, c := range b {
+		if (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') && random[i]&1 == 1 {
+			b[i] ^= 0x20
+		}
+	}
+	return string(b)
+}
+
+// hasLetters checks if the case of the name can be randomized
+func hasLetters(name string) bool {
+	return strings.IndexFunc(name, func(c rune) bool {
+		return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}) >= 0
+}
+
+// restoreCase replaces the randomized name with the original one in the reply
+// The owner names of the records that are the same as the question name are restored too.
+func restoreCase(reply *dns.Msg, randomized, original string) {
+	for i := range reply.Question {
+		if reply.Question[i].Name == randomized {
+			reply.Question[i].Name = original
+		}
+	}
+	for _, rrs := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); strings.EqualFold(hdr.Name, randomized) {
+				hdr.Name = original
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package upstream
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCaseServer is a local plain DNS server that answers A requests with 8.8.8.8
+// and either preserves the query name case or lowercases it, or refuses the requests without the question
+// The replies can be altered further with modify.
+type testCaseServer struct {
+	*dns.Server
+	lowercase bool
+	refuse    bool
+	modify    func(resp *dns.Msg)
+
+	sync.Mutex
+	names []string // the received query names
+}
+
+func newTestCaseServer(t *testing.T, lowercase, refuse bool) *testCaseServer {
+	return newTestModifyingServer(t, &testCaseServer{lowercase: lowercase, refuse: refuse})
+}
+
+// newTestModifyingServer starts the test server s that alters the replies with s.modify
+func newTestModifyingServer(t *testing.T, s *testCaseServer) *testCaseServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	s.Server = &dns.Server{PacketConn: conn, Handler: s}
+	go func() { _ = s.ActivateAndServe() }()
+	return s
+}
+
+func (s *testCaseServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	s.names = append(s.names, req.Question[0].Name)
+	s.Unlock()
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	if s.refuse {
+		resp.Rcode = dns.RcodeRefused
+		resp.Question = nil
+		_ = w.WriteMsg(resp)
+		return
+	}
+	if s.lowercase {
+		resp.Question[0].Name = strings.ToLower(resp.Question[0].Name)
+	}
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: resp.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{8, 8, 8, 8},
+	}}
+	if s.modify != nil {
+		s.modify(resp)
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func (s *testCaseServer) received() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.names...)
+}
+
+func TestRandomizeCase(t *testing.T) {
+	const name = "www.Example-1.com."
+	randomized := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		r := randomizeCase(name)
+		assert.True(t, strings.EqualFold(name, r))
+		assert.Equal(t, "-1", r[11:13])
+		randomized[r] = true
+	}
+	assert.True(t, len(randomized) > 1)
+
+	assert.True(t, hasLetters("example.org."))
+	assert.False(t, hasLetters("."))
+	assert.False(t, hasLetters("1.2.3.4."))
+}
+
+func TestPlainRandomizeCase(t *testing.T) {
+	srv := newTestCaseServer(t, false, false)
+	defer func() { _ = srv.Shutdown() }()
+
+	u, err := AddressToUpstream(srv.PacketConn.LocalAddr().String(), Options{Timeout: time.Second, RandomizeCase: true})
+	assert.Nil(t, err)
+
+	for i := 0; i < 5; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("www.Google-DNS.com.", dns.TypeA)
+		reply, err := u.Exchange(req)
+		assert.Nil(t, err)
+		// the original case is restored
+		assert.Equal(t, "www.Google-DNS.com.", reply.Question[0].Name)
+		assert.Equal(t, "www.Google-DNS.com.", reply.Answer[0].Header().Name)
+		assert.Equal(t, "www.Google-DNS.com.", req.Question[0].Name)
+	}
+
+	// the server saw the randomized names
+	randomized := map[string]bool{}
+	for _, name := range srv.received() {
+		assert.True(t, strings.EqualFold("www.Google-DNS.com.", name))
+		randomized[name] = true
+	}
+	assert.True(t, len(randomized) > 1)
+}
+
+func TestPlainRandomizeCaseMismatch(t *testing.T) {
+	srv := newTestCaseServer(t, true, false)
+	defer func() { _ = srv.Shutdown() }()
+
+	u, err := AddressToUpstream("dns://"+srv.PacketConn.LocalAddr().String()+"?randomize_case=true", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+
+	req := &dns.Msg{}
+	req.SetQuestion("WWW.GOOGLE.COM.", dns.TypeA)
+
+	// the replies that don't preserve the case are rejected
+	for i := 0; i < maxCaseMismatches; i++ {
+		_, err = u.Exchange(req)
+		assert.Equal(t, errCaseMismatch, err)
+	}
+
+	// and then the randomization is disabled for the upstream
+	reply, err := u.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "www.google.com.", reply.Question[0].Name)
+	names := srv.received()
+	assert.Equal(t, "WWW.GOOGLE.COM.", names[len(names)-1])
+}
+
+func TestPlainRandomizeCaseNoQuestion(t *testing.T) {
+	srv := newTestCaseServer(t, false, true)
+	defer func() { _ = srv.Shutdown() }()
+
+	u, err := AddressToUpstream(srv.PacketConn.LocalAddr().String(), Options{Timeout: time.Second, RandomizeCase: true})
+	assert.Nil(t, err)
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.Google.com.", dns.TypeA)
+	for i := 0; i <= maxCaseMismatches; i++ {
+		reply, err := u.Exchange(req)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+		assert.Equal(t, []dns.Question{req.Question[0]}, reply.Question)
+	}
+	// the randomization is still enabled
+	assert.False(t, u.(*plainDNS).caseRandomizationDisabled())
+}
+
+func TestPlainRandomizeCaseSpoofed(t *testing.T) {
+	testCases := map[string]func(resp *dns.Msg){
+		// a reply without the question that carries the records
+		"no question": func(resp *dns.Msg) {
+			resp.Question = nil
+		},
+		"no question with authority": func(resp *dns.Msg) {
+			resp.Question = nil
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns, resp.Answer = resp.Answer, nil
+		},
+		"several questions": func(resp *dns.Msg) {
+			resp.Question = append(resp.Question, dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		},
+		// a random case doesn't count towards disabling the randomization
+		"random case": func(resp *dns.Msg) {
+			resp.Question[0].Name = randomizeCase(resp.Question[0].Name)
+			for resp.Question[0].Name == strings.ToLower(resp.Question[0].Name) ||
+				resp.Question[0].Name == strings.ToUpper(resp.Question[0].Name) {
+				resp.Question[0].Name = randomizeCase(resp.Question[0].Name)
+			}
+		},
+	}
+
+	for name, modify := range testCases {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestModifyingServer(t, &testCaseServer{modify: modify})
+			defer func() { _ = srv.Shutdown() }()
+
+			u, err := AddressToUpstream(srv.PacketConn.LocalAddr().String(), Options{Timeout: time.Second, RandomizeCase: true})
+			assert.Nil(t, err)
+
+			req := &dns.Msg{}
+			req.SetQuestion("www.Google-DNS.com.", dns.TypeA)
+			for i := 0; i <= maxCaseMismatches; i++ {
+				_, err = u.Exchange(req)
+				assert.Equal(t, errCaseMismatch, err)
+			}
+			assert.False(t, u.(*plainDNS).caseRandomizationDisabled())
+		})
+	}
+}
+
+func TestPlainRandomizeCaseReenabled(t *testing.T) {
+	srv := newTestCaseServer(t, true, false)
+	defer func() { _ = srv.Shutdown() }()
+
+	u, err := AddressToUpstream(srv.PacketConn.LocalAddr().String(), Options{Timeout: time.Second, RandomizeCase: true})
+	assert.Nil(t, err)
+	p := u.(*plainDNS)
+
+	req := &dns.Msg{}
+	req.SetQuestion("WWW.GOOGLE.COM.", dns.TypeA)
+	for i := 0; i < maxCaseMismatches; i++ {
+		_, _ = u.Exchange(req)
+	}
+	assert.True(t, p.caseRandomizationDisabled())
+
+	// the upstream is checked again after the cool-down
+	atomic.StoreInt64(&p.caseDisabledUntil, time.Now().Add(-time.Second).UnixNano())
+	assert.False(t, p.caseRandomizationDisabled())
+	_, err = u.Exchange(req)
+	assert.Equal(t, errCaseMismatch, err)
+}
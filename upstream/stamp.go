@@ -0,0 +1,208 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/joomcode/errorx"
+)
+
+// StampOptions are the DNS stamp fields that can't be derived from the upstream address (see AddressToStamp)
+type StampOptions struct {
+	// ServerIP is the server IP address. The hostname is resolved by the client if it's not set (not used for plain DNS).
+	ServerIP net.IP
+
+	// Hashes are the SHA-256 digests of the TBS certificates from the server's certificate chain (DOT and DOH only)
+	Hashes [][]byte
+
+	// The server informal properties
+	DNSSEC   bool // the server does the DNSSEC validation
+	NoLog    bool // the server doesn't record logs
+	NoFilter bool // the server doesn't intentionally block domains
+}
+
+// props returns the server informal properties
+func (o StampOptions) props() dnsstamps.ServerInformalProperties {
+	var props dnsstamps.ServerInformalProperties
+	if o.DNSSEC {
+		props |= dnsstamps.ServerInformalPropertyDNSSEC
+	}
+	if o.NoLog {
+		props |= dnsstamps.ServerInformalPropertyNoLog
+	}
+	if o.NoFilter {
+		props |= dnsstamps.ServerInformalPropertyNoFilter
+	}
+	return props
+}
+
+// AddressToStamp converts the upstream address to a DNS stamp (see AddressToUpstream for the supported addresses)
+// * 8.8.8.8:53, dns://8.8.8.8, tcp://8.8.8.8 -- plain DNS stamp (the server must be an IP address)
+// * tls://dns.adguard.com -- DNS-over-TLS stamp
+// * https://dns.adguard.com/dns-query -- DNS-over-HTTPS stamp
+// * odoh://odoh.cloudflare-dns.com/dns-query -- Oblivious DNS-over-HTTPS target stamp
+// * sdns://... -- the stamp with the options applied (the ones that are set override the stamp fields),
+// it's the only way to specify a DNSCrypt server
+// The upstream options in the URL query parameters (see urlOptions) can't be encoded and are ignored.
+func AddressToStamp(address string, opts StampOptions) (string, error) {
+	if !strings.Contains(address, "://") {
+		address = "dns://" + address
+	}
+	upstreamURL, err := url.Parse(address)
+	if err != nil {
+		return "", errorx.Decorate(err, "failed to parse %s", address)
+	}
+	if upstreamURL.Scheme != "sdns" {
+		if _, err = urlOptions(upstreamURL, Options{}); err != nil {
+			return "", errorx.Decorate(err, "invalid options in %s", address)
+		}
+	}
+
+	stamp := dnsstamps.ServerStamp{Props: opts.props(), Hashes: opts.Hashes}
+	switch upstreamURL.Scheme {
+	case "sdns":
+		return restamp(address, opts)
+	case "dns", "tcp":
+		ip := net.ParseIP(upstreamURL.Hostname())
+		if ip == nil {
+			return "", fmt.Errorf("plain DNS server must be an IP address: %s", address)
+		}
+		stamp.Proto = dnsstamps.StampProtoTypePlain
+		stamp.ServerAddrStr = getHostWithPort(upstreamURL, "53")
+		stamp.Hashes = nil
+	case "tls":
+		stamp.Proto = dnsstamps.StampProtoTypeTLS
+		stamp.ProviderName = hostWithoutDefaultPort(upstreamURL, "853")
+		stamp.ServerAddrStr = stampServerAddr(upstreamURL, opts.ServerIP, "853")
+	case "https":
+		stamp.Proto = dnsstamps.StampProtoTypeDoH
+		stamp.ProviderName = hostWithoutDefaultPort(upstreamURL, "443")
+		stamp.ServerAddrStr = stampServerAddr(upstreamURL, opts.ServerIP, "443")
+		stamp.Path = stampPath(upstreamURL)
+	case "odoh":
+		return odohTargetStamp(hostWithoutDefaultPort(upstreamURL, "443"), stampPath(upstreamURL), opts.props()), nil
+	default:
+		return "", fmt.Errorf("%s upstreams can't be converted to a DNS stamp", upstreamURL.Scheme)
+	}
+
+	if stamp.ProviderName == "" && stamp.Proto != dnsstamps.StampProtoTypePlain {
+		return "", fmt.Errorf("no hostname in %s", address)
+	}
+	return stamp.String(), nil
+}
+
+// restamp applies the options to the DNS stamp
+func restamp(address string, opts StampOptions) (string, error) {
+	proto, raw, err := stampProto(address)
+	if err != nil {
+		return "", errorx.Decorate(err, "failed to parse %s", address)
+	}
+	switch proto {
+	case stampProtoTypeODoHTarget:
+		if len(raw) < 8 {
+			return "", fmt.Errorf("failed to parse %s: stamp is too short", address)
+		}
+		host, rest, err := readStampLP(raw[8:])
+		if err != nil {
+			return "", errorx.Decorate(err, "failed to parse %s", address)
+		}
+		path, _, err := readStampLP(rest)
+		if err != nil {
+			return "", errorx.Decorate(err, "failed to parse %s", address)
+		}
+		props := opts.props()
+		if props == 0 {
+			props = dnsstamps.ServerInformalProperties(binary.LittleEndian.Uint64(raw[:8]))
+		}
+		return odohTargetStamp(host, path, props), nil
+	case stampProtoTypeODoHRelay, stampProtoTypeDNSCryptRelay:
+		return "", fmt.Errorf("relay stamps are not upstreams: %s", address)
+	}
+
+	stamp, err := dnsstamps.NewServerStampFromString(address)
+	if err != nil {
+		return "", errorx.Decorate(err, "failed to parse %s", address)
+	}
+	if props := opts.props(); props != 0 {
+		stamp.Props = props
+	}
+	if len(opts.Hashes) > 0 && (stamp.Proto == dnsstamps.StampProtoTypeDoH || stamp.Proto == dnsstamps.StampProtoTypeTLS) {
+		stamp.Hashes = opts.Hashes
+	}
+	if opts.ServerIP != nil && stamp.Proto != dnsstamps.StampProtoTypePlain {
+		port := ""
+		if _, p, err := net.SplitHostPort(stamp.ServerAddrStr); err == nil {
+			port = p
+		}
+		stamp.ServerAddrStr = joinStampAddr(opts.ServerIP, port)
+	}
+	return stamp.String(), nil
+}
+
+// hostWithoutDefaultPort returns the URL host with the port unless it's the default one
+func hostWithoutDefaultPort(u *url.URL, defaultPort string) string {
+	if u.Port() == defaultPort {
+		return strings.TrimSuffix(u.Host, ":"+defaultPort)
+	}
+	return u.Host
+}
+
+// stampServerAddr returns the stamp server address: the server IP or the URL host if it's an IP address
+// The port is kept only if it's not the default one.
+func stampServerAddr(u *url.URL, serverIP net.IP, defaultPort string) string {
+	if serverIP == nil {
+		serverIP = net.ParseIP(u.Hostname())
+		if serverIP == nil {
+			return ""
+		}
+	}
+	port := u.Port()
+	if port == defaultPort {
+		port = ""
+	}
+	return joinStampAddr(serverIP, port)
+}
+
+// joinStampAddr returns the IP address with the port if it's set, the IPv6 addresses are enclosed in brackets
+func joinStampAddr(ip net.IP, port string) string {
+	if port != "" {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
+
+// stampPath returns the URL path with the query string (the upstream options are removed by urlOptions)
+func stampPath(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return path
+}
+
+// odohTargetStamp returns the ODoH target stamp:
+// 0x05 || props || LP(hostname [:port]) || LP(path)
+func odohTargetStamp(host, path string, props dnsstamps.ServerInformalProperties) string {
+	raw := make([]byte, 9)
+	raw[0] = stampProtoTypeODoHTarget
+	binary.LittleEndian.PutUint64(raw[1:], uint64(props))
+	raw = appendStampLP(raw, host)
+	raw = appendStampLP(raw, path)
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// appendStampLP appends the string with a 1-byte length prefix
+func appendStampLP(data []byte, value string) []byte {
+	return append(append(data, byte(len(value))), value...)
+}
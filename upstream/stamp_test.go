@@ -0,0 +1,108 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"net"
+	"testing"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressToStamp(t *testing.T) {
+	hash := make([]byte, 32)
+	hash[0] = 1
+
+	testCases := []struct {
+		address string
+		opts    StampOptions
+		stamp   dnsstamps.ServerStamp
+	}{{
+		address: "8.8.8.8",
+		opts:    StampOptions{DNSSEC: true},
+		stamp:   dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypePlain, ServerAddrStr: "8.8.8.8:53", Props: dnsstamps.ServerInformalPropertyDNSSEC},
+	}, {
+		address: "tcp://[2001:db8::1]:5353?timeout=1s",
+		stamp:   dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypePlain, ServerAddrStr: "[2001:db8::1]:5353"},
+	}, {
+		address: "tls://dns.adguard.com",
+		opts:    StampOptions{ServerIP: net.IP{176, 103, 130, 130}, NoLog: true, Hashes: [][]byte{hash}},
+		stamp: dnsstamps.ServerStamp{
+			Proto:         dnsstamps.StampProtoTypeTLS,
+			ServerAddrStr: "176.103.130.130",
+			ProviderName:  "dns.adguard.com",
+			Hashes:        [][]byte{hash},
+			Props:         dnsstamps.ServerInformalPropertyNoLog,
+		},
+	}, {
+		address: "tls://1.1.1.1:8853",
+		stamp:   dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeTLS, ServerAddrStr: "1.1.1.1:8853", ProviderName: "1.1.1.1:8853"},
+	}, {
+		address: "https://dns.adguard.com:443/dns-query?bootstrap=8.8.8.8&ct=1",
+		opts:    StampOptions{ServerIP: net.ParseIP("2a00:5a60::ad1:ff"), NoFilter: true},
+		stamp: dnsstamps.ServerStamp{
+			Proto:         dnsstamps.StampProtoTypeDoH,
+			ServerAddrStr: "[2a00:5a60::ad1:ff]:443",
+			ProviderName:  "dns.adguard.com",
+			Path:          "/dns-query?ct=1",
+			Props:         dnsstamps.ServerInformalPropertyNoFilter,
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.address, func(t *testing.T) {
+			str, err := AddressToStamp(tc.address, tc.opts)
+			assert.Nil(t, err)
+			// dnsstamps decodes the DOT stamps with a wrong default port so the strings are compared
+			assert.Equal(t, tc.stamp.String(), str)
+		})
+	}
+}
+
+func TestAddressToStampODoH(t *testing.T) {
+	str, err := AddressToStamp("odoh://odoh.cloudflare-dns.com/dns-query", StampOptions{NoLog: true})
+	assert.Nil(t, err)
+	targetURL, err := parseODoHTargetStamp(str)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://odoh.cloudflare-dns.com/dns-query", targetURL)
+
+	// the stamp properties are kept unless they are overridden
+	restamped, err := AddressToStamp(str, StampOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, str, restamped)
+	restamped, err = AddressToStamp(str, StampOptions{DNSSEC: true})
+	assert.Nil(t, err)
+	assert.NotEqual(t, str, restamped)
+}
+
+func TestAddressToStampDNSCrypt(t *testing.T) {
+	address := "sdns://AQIAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20"
+	original, err := dnsstamps.NewServerStampFromString(address)
+	assert.Nil(t, err)
+
+	str, err := AddressToStamp(address, StampOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, address, str)
+
+	str, err = AddressToStamp(address, StampOptions{ServerIP: net.IP{176, 103, 130, 131}, NoFilter: true})
+	assert.Nil(t, err)
+	stamp, err := dnsstamps.NewServerStampFromString(str)
+	assert.Nil(t, err)
+	assert.Equal(t, "176.103.130.131:5443", stamp.ServerAddrStr)
+	assert.Equal(t, dnsstamps.ServerInformalPropertyNoFilter, stamp.Props)
+	assert.Equal(t, original.ServerPk, stamp.ServerPk)
+	assert.Equal(t, original.ProviderName, stamp.ProviderName)
+}
+
+func TestAddressToStampInvalid(t *testing.T) {
+	relayStamp := appendStampLP([]byte{stampProtoTypeDNSCryptRelay}, "192.0.2.1:443")
+	for _, address := range []string{
+		"dns.example",
+		"tls://",
+		"resolvconf:///etc/resolv.conf",
+		"sdns://" + base64.RawURLEncoding.EncodeToString(relayStamp),
+	} {
+		_, err := AddressToStamp(address, StampOptions{})
+		assert.NotNil(t, err, address)
+	}
+}
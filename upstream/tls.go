@@ -0,0 +1,150 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/joomcode/errorx"
+)
+
+// PinMismatchError is returned when none of the server certificates matches the SPKI pins (see Options.SPKIPins).
+// It may be a sign of a TLS interception.
+type PinMismatchError struct {
+	ServerName string   // TLS server name
+	Hashes     []string // SPKI hashes of the server certificates
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("none of the %s certificates matches the SPKI pins, certificates SPKI: %s", e.ServerName, strings.Join(e.Hashes, ", "))
+}
+
+// IsPinMismatch checks if the error returned by an upstream is caused by an SPKI pin mismatch
+func IsPinMismatch(err error) bool {
+	for err != nil {
+		if _, ok := err.(*PinMismatchError); ok {
+			return true
+		}
+
+		switch e := err.(type) {
+		case *errorx.Error:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// tlsOptions are the per-upstream TLS settings
+type tlsOptions struct {
+	serverName         string          // overrides the TLS server name (see Options.TLSServerName)
+	insecureSkipVerify bool            // disables the server certificate verification (see Options.InsecureSkipVerify)
+	rootCAs            *x509.CertPool  // trusted CAs (see Options.CAFiles), if nil, RootCAs are used
+	spkiPins           map[string]bool // SPKI pins (see Options.SPKIPins)
+
+	sessionCache tls.ClientSessionCache // TLS sessions cache that allows resuming the sessions when re-dialing
+}
+
+// newTLSOptions loads the TLS settings from the upstream options
+func newTLSOptions(opts Options) (tlsOptions, error) {
+	t := tlsOptions{
+		serverName:         opts.TLSServerName,
+		insecureSkipVerify: opts.InsecureSkipVerify,
+		sessionCache:       tls.NewLRUClientSessionCache(0),
+	}
+
+	if len(opts.CAFiles) > 0 {
+		t.rootCAs = x509.NewCertPool()
+		for _, f := range opts.CAFiles {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				return t, errorx.Decorate(err, "couldn't read CA file %s", f)
+			}
+			if !t.rootCAs.AppendCertsFromPEM(data) {
+				return t, fmt.Errorf("no certificates found in CA file %s", f)
+			}
+		}
+	}
+
+	if len(opts.SPKIPins) > 0 {
+		t.spkiPins = map[string]bool{}
+		for _, pin := range opts.SPKIPins {
+			hash, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(hash) != sha256.Size {
+				return t, fmt.Errorf("invalid SPKI pin %s: must be a base64-encoded SHA-256 hash", pin)
+			}
+			t.spkiPins[pin] = true
+		}
+	}
+
+	return t, nil
+}
+
+// createTLSConfig creates a client TLS config
+// host is used as the server name unless it's overridden (see Options.TLSServerName)
+func (t tlsOptions) createTLSConfig(host string) *tls.Config {
+	config := &tls.Config{
+		ServerName:         host,
+		RootCAs:            RootCAs,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: t.insecureSkipVerify, // nolint
+		ClientSessionCache: t.sessionCache,
+	}
+	if t.serverName != "" {
+		config.ServerName = t.serverName
+	}
+	if t.rootCAs != nil {
+		config.RootCAs = t.rootCAs
+	}
+	if len(t.spkiPins) > 0 {
+		serverName := config.ServerName
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return t.verifyPins(serverName, rawCerts, verifiedChains)
+		}
+	}
+	return config
+}
+
+// verifyPins checks that one of the certificates matches one of the SPKI pins
+// The certificates of the verified chains are checked. If the verification is disabled, only the leaf
+// certificate is checked, the other certificates are chosen by the server and prove nothing.
+func (t tlsOptions) verifyPins(serverName string, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var certs []*x509.Certificate
+	for _, chain := range verifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(verifiedChains) == 0 && len(rawCerts) > 0 {
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return errorx.Decorate(err, "couldn't parse the server certificate")
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return errors.New("no server certificates")
+	}
+
+	hashes := make([]string, 0, len(certs))
+	for _, cert := range certs {
+		hash := SPKIHash(cert)
+		if t.spkiPins[hash] {
+			return nil
+		}
+		hashes = append(hashes, hash)
+	}
+	return &PinMismatchError{ServerName: serverName, Hashes: hashes}
+}
+
+// SPKIHash returns the base64-encoded SHA-256 hash of the certificate's SubjectPublicKeyInfo (see Options.SPKIPins)
+func SPKIHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
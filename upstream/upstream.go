@@ -2,9 +2,13 @@
 package upstream
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +23,33 @@ type Upstream interface {
 	Address() string
 }
 
+// ContextUpstream is an Upstream that supports cancelling an exchange in progress
+type ContextUpstream interface {
+	Upstream
+
+	// ExchangeContext is the same as Exchange, but it is interrupted as soon as the context is done
+	ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+}
+
+// ExchangeContext sends the request to the upstream and returns either its response
+// or the context error as soon as the context is done.
+// The exchange itself is cancelled only if the upstream implements ContextUpstream,
+// otherwise it continues in the background and its result is discarded.
+func ExchangeContext(ctx context.Context, u Upstream, m *dns.Msg) (*dns.Msg, error) {
+	if cu, ok := u.(ContextUpstream); ok {
+		return cu.ExchangeContext(ctx, m)
+	}
+
+	ch := make(chan *exchangeResult, 1)
+	go exchangeAsync(u, m, ch)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		return res.reply, res.err
+	}
+}
+
 // Options for AddressToUpstream func
 type Options struct {
 	// Bootstrap is a list of DNS servers to be used to resolve DOH/DOT hostnames (if any)
@@ -32,6 +63,92 @@ type Options struct {
 	// ServerIP allows specifying the resolver's IP address. In the case if it's specified,
 	// bootstrap DNS servers won't be used at all.
 	ServerIP net.IP
+
+	// Weight is the upstream weight for the weighted random selection (see WeightedUpstream).
+	// 0 means the default weight.
+	Weight int
+
+	// TLSServerName is the server name that is sent in the TLS handshake (SNI)
+	// and verified in the server certificate (DOT and DOH only). If empty, the upstream hostname is used.
+	TLSServerName string
+
+	// InsecureSkipVerify disables the server certificate verification (DOT and DOH only).
+	// Use it for testing only. The SPKI pins are checked anyway, but only the leaf certificate can match them then.
+	InsecureSkipVerify bool
+
+	// CAFiles are the paths to the PEM-encoded CA certificates that are trusted
+	// instead of RootCAs when verifying the server certificate (DOT and DOH only).
+	CAFiles []string
+
+	// SPKIPins is a set of base64-encoded SHA-256 hashes of the certificates' SubjectPublicKeyInfo (DOT and DOH only).
+	// If set, one of the certificates of the verified chain must match one of the pins, otherwise PinMismatchError
+	// is returned. If InsecureSkipVerify is set, the leaf certificate must match one of the pins.
+	SPKIPins []string
+
+	// MaxConns is the maximum number of the persistent TCP connections to a plain DNS upstream.
+	// The queries are pipelined over them. 0 means the default value.
+	// The truncated UDP responses are retried over new connections that are not kept.
+	MaxConns int
+
+	// IdleTimeout is the time after which an idle persistent connection is closed.
+	// 0 means the default value.
+	IdleTimeout time.Duration
+
+	// DoHMethod is the HTTP method of the DOH requests: GET (default) or POST
+	DoHMethod string
+
+	// DoHHeaders are the additional HTTP headers of the DOH requests, e.g. Authorization or User-Agent
+	DoHHeaders http.Header
+
+	// DoHHTTPVersion is the HTTP version of the DOH requests: 2 (default) or 1.1
+	DoHHTTPVersion string
+
+	// DoHDisableWarmUp disables the DOH warm-up query that is sent before the first DNS query.
+	// The warm-up makes the first concurrent queries share a single connection.
+	DoHDisableWarmUp bool
+
+	// Proxy is the URL of the proxy server that the upstream connections are tunneled through:
+	// socks5://[user:password@]host[:port] or http://[user:password@]host[:port] (HTTP CONNECT).
+	// DOT, DOH, and plain DNS over TCP upstreams are supported, the hostnames are resolved by the proxy.
+	// DNSCrypt upstreams are used over TCP through the proxy, the certificate is fetched directly.
+	Proxy string
+
+	// SourceIP is the local IP address the upstream connections are sent from
+	SourceIP net.IP
+
+	// Interface is the name of the network interface the upstream connections are bound to (SO_BINDTODEVICE).
+	// It's supported on Linux only.
+	Interface string
+
+	// ODoHRelay is the relay that the Oblivious DOH queries are sent through:
+	// https://relay.example/proxy URL or an ODoH relay stamp (sdns://...).
+	// If empty, the queries are sent to the target directly, and the target sees both the client's IP address
+	// and the queries, so ODoH is no more private than DOH then.
+	ODoHRelay string
+
+	// DNSCryptRelays are the anonymization relays that the DNSCrypt queries are sent through:
+	// relay stamps (sdns://gQ...) or IP:port addresses. The relays are used in turn,
+	// if one fails, the query is sent through the next one until Timeout. If empty, the queries are sent to the server directly.
+	// The server certificate is fetched directly in any case.
+	DNSCryptRelays []string
+
+	// PreferIPv6 makes the IPv6 addresses of the upstream be dialed first.
+	// The IPv4 and IPv6 addresses are dialed in turn with a short delay (Happy Eyeballs), IPv4 goes first by default.
+	PreferIPv6 bool
+
+	// RandomizeCase makes the case of the query name sent to the plain DNS upstreams over UDP random (DNS 0x20 encoding),
+	// so that the spoofed replies are harder to guess. The replies that don't preserve the case exactly are rejected.
+	// The upstreams that lowercase or uppercase the names are detected and the randomization is disabled for them
+	// for a while.
+	RandomizeCase bool
+}
+
+// WeightedUpstream is an Upstream that has a weight (see Options.Weight)
+type WeightedUpstream interface {
+	Upstream
+
+	// Weight returns the upstream weight or 0 if it's not set
+	Weight() int
 }
 
 // AddressToUpstream converts the specified address to an Upstream instance
@@ -39,13 +156,21 @@ type Options struct {
 // * tcp://8.8.8.8:53 -- plain DNS over TCP
 // * tls://1.1.1.1 -- DNS-over-TLS
 // * https://dns.adguard.com/dns-query -- DNS-over-HTTPS
+// * odoh://odoh.cloudflare-dns.com/dns-query -- Oblivious DNS-over-HTTPS (see Options.ODoHRelay)
 // * sdns://... -- DNS stamp (see https://dnscrypt.info/stamps-specifications)
+// * resolvconf:///etc/resolv.conf -- the nameservers from resolv.conf, the file is reloaded when it changes (see SearchDomainsUpstream)
+// The options of the upstreams with a scheme can be overridden with the URL query parameters (see urlOptions),
+// i.e. tls://1.2.3.4?sni=dns.corp&timeout=2s
 func AddressToUpstream(address string, opts Options) (Upstream, error) {
 	if strings.Contains(address, "://") {
 		upstreamURL, err := url.Parse(address)
 		if err != nil {
 			return nil, errorx.Decorate(err, "failed to parse %s", address)
 		}
+		opts, err = urlOptions(upstreamURL, opts)
+		if err != nil {
+			return nil, errorx.Decorate(err, "invalid options in %s", address)
+		}
 		return urlToUpstream(upstreamURL, opts)
 	}
 
@@ -55,16 +180,128 @@ func AddressToUpstream(address string, opts Options) (Upstream, error) {
 		// doesn't have port, default to 53
 		address = net.JoinHostPort(address, "53")
 	}
-	return &plainDNS{address: address, timeout: opts.Timeout}, nil
+	return newPlainDNS(address, opts, false)
+}
+
+// urlOptions overrides the options with the URL query parameters and removes them from the URL:
+// * timeout=2s -- upstream timeout
+// * weight=10 -- upstream weight
+// * bootstrap=8.8.8.8:53,1.1.1.1 -- bootstrap DNS servers (can be specified multiple times)
+// * sni=dns.corp -- TLS server name
+// * insecure=true -- skip the server certificate verification
+// * ca=/etc/dns/ca.pem -- trusted CA certificates file (can be specified multiple times)
+// * pin=base64hash -- SPKI pin (can be specified multiple times)
+// * max_conns=4 -- maximum number of the persistent TCP connections
+// * idle_timeout=30s -- idle connections timeout
+// * method=post -- DOH requests method
+// * header=Authorization:Bearer%20token -- additional DOH request header (can be specified multiple times)
+// * http=1.1 -- DOH HTTP version
+// * warmup=false -- disables the DOH warm-up query
+// * proxy=socks5://127.0.0.1:1080 -- proxy server URL
+// * source=192.168.1.10 -- local IP address
+// * interface=eth1 -- network interface
+// * relay=https://relay.example/proxy -- ODoH relay
+// * prefer_ipv6=true -- dial IPv6 addresses first
+// * randomize_case=true -- randomize the query name case
+// The other query parameters of the https:// and odoh:// URLs are kept intact as they belong to the path,
+// they are invalid for the other schemes.
+func urlOptions(upstreamURL *url.URL, opts Options) (Options, error) {
+	if upstreamURL.RawQuery == "" || upstreamURL.Scheme == "sdns" {
+		return opts, nil
+	}
+
+	query := upstreamURL.Query()
+	for name, values := range query {
+		value := values[len(values)-1]
+		var err error
+		switch name {
+		case "timeout":
+			opts.Timeout, err = time.ParseDuration(value)
+		case "weight":
+			opts.Weight, err = strconv.Atoi(value)
+		case "bootstrap":
+			opts.Bootstrap = nil
+			for _, v := range values {
+				opts.Bootstrap = append(opts.Bootstrap, strings.Split(v, ",")...)
+			}
+		case "sni":
+			opts.TLSServerName = value
+		case "insecure":
+			opts.InsecureSkipVerify, err = strconv.ParseBool(value)
+		case "ca":
+			opts.CAFiles = values
+		case "pin":
+			opts.SPKIPins = nil
+			for _, v := range values {
+				opts.SPKIPins = append(opts.SPKIPins, strings.Split(v, ",")...)
+			}
+		case "max_conns":
+			opts.MaxConns, err = strconv.Atoi(value)
+		case "idle_timeout":
+			opts.IdleTimeout, err = time.ParseDuration(value)
+		case "method":
+			opts.DoHMethod = value
+		case "header":
+			opts.DoHHeaders, err = parseHeaders(opts.DoHHeaders, values)
+		case "http":
+			opts.DoHHTTPVersion = value
+		case "warmup":
+			var warmUp bool
+			warmUp, err = strconv.ParseBool(value)
+			opts.DoHDisableWarmUp = !warmUp
+		case "proxy":
+			opts.Proxy = value
+		case "source":
+			opts.SourceIP = net.ParseIP(value)
+			if opts.SourceIP == nil {
+				err = errors.New("not an IP address")
+			}
+		case "interface":
+			opts.Interface = value
+		case "relay":
+			opts.ODoHRelay = value
+		case "prefer_ipv6":
+			opts.PreferIPv6, err = strconv.ParseBool(value)
+		case "randomize_case":
+			opts.RandomizeCase, err = strconv.ParseBool(value)
+		default:
+			if upstreamURL.Scheme == "https" || upstreamURL.Scheme == "odoh" {
+				continue
+			}
+			return opts, fmt.Errorf("unknown option %s", name)
+		}
+		if err != nil {
+			return opts, errorx.Decorate(err, "invalid %s value: %s", name, value)
+		}
+		query.Del(name)
+	}
+	upstreamURL.RawQuery = query.Encode()
+	return opts, nil
+}
+
+// parseHeaders adds the "Name: value" headers to the specified ones
+func parseHeaders(headers http.Header, values []string) (http.Header, error) {
+	result := http.Header{}
+	for name, v := range headers {
+		result[name] = v
+	}
+	for _, v := range values {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.New("header must be in the Name:value format")
+		}
+		result.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return result, nil
 }
 
 // urlToBoot creates an instance of the bootstrapper with the specified options
 func urlToBoot(resolverURL string, opts Options) (*bootstrapper, error) {
 	if opts.ServerIP == nil {
-		return toBoot(resolverURL, opts.Bootstrap, opts.Timeout), nil
+		return toBoot(resolverURL, opts)
 	}
 
-	return toBootResolved(resolverURL, opts.ServerIP, opts.Timeout)
+	return toBootResolved(resolverURL, opts)
 }
 
 // urlToUpstream converts a URL to an Upstream
@@ -73,9 +310,9 @@ func urlToUpstream(upstreamURL *url.URL, opts Options) (Upstream, error) {
 	case "sdns":
 		return stampToUpstream(upstreamURL.String(), opts)
 	case "dns":
-		return &plainDNS{address: getHostWithPort(upstreamURL, "53"), timeout: opts.Timeout}, nil
+		return newPlainDNS(getHostWithPort(upstreamURL, "53"), opts, false)
 	case "tcp":
-		return &plainDNS{address: getHostWithPort(upstreamURL, "53"), timeout: opts.Timeout, preferTCP: true}, nil
+		return newPlainDNS(getHostWithPort(upstreamURL, "53"), opts, true)
 	case "tls":
 		resolverURL := getHostWithPort(upstreamURL, "853")
 		b, err := urlToBoot(resolverURL, opts)
@@ -83,7 +320,7 @@ func urlToUpstream(upstreamURL *url.URL, opts Options) (Upstream, error) {
 			return nil, errorx.Decorate(err, "couldn't create tls bootstrapper")
 		}
 
-		return &dnsOverTLS{boot: b}, nil
+		return &dnsOverTLS{boot: b, pool: newTLSPool(b, opts)}, nil
 	case "https":
 		if upstreamURL.Port() == "" {
 			upstreamURL.Host += ":443"
@@ -95,15 +332,42 @@ func urlToUpstream(upstreamURL *url.URL, opts Options) (Upstream, error) {
 			return nil, errorx.Decorate(err, "couldn't create tls bootstrapper")
 		}
 
-		return &dnsOverHTTPS{boot: b}, nil
+		return newDNSOverHTTPS(b, opts)
+	case "odoh":
+		target := *upstreamURL
+		target.Scheme = "https"
+		return newDNSOverODoH(upstreamURL.String(), &target, opts)
+	case "resolvconf":
+		return newResolvConf(upstreamURL.String(), upstreamURL.Path, opts)
 	default:
 		// assume it's plain DNS
-		return &plainDNS{address: getHostWithPort(upstreamURL, "53"), timeout: opts.Timeout}, nil
+		return newPlainDNS(getHostWithPort(upstreamURL, "53"), opts, false)
 	}
 }
 
 // stampToUpstream converts a DNS stamp to an Upstream
 func stampToUpstream(address string, opts Options) (Upstream, error) {
+	proto, _, err := stampProto(address)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to parse %s", address)
+	}
+	switch proto {
+	case stampProtoTypeODoHTarget:
+		targetURL, err := parseODoHTargetStamp(address)
+		if err != nil {
+			return nil, errorx.Decorate(err, "failed to parse %s", address)
+		}
+		target, err := url.Parse(targetURL)
+		if err != nil {
+			return nil, errorx.Decorate(err, "failed to parse %s", address)
+		}
+		return newDNSOverODoH(address, target, opts)
+	case stampProtoTypeODoHRelay:
+		return nil, fmt.Errorf("%s is an ODoH relay stamp, use it as the relay of an ODoH upstream (?relay= or Options.ODoHRelay)", address)
+	case stampProtoTypeDNSCryptRelay:
+		return nil, fmt.Errorf("%s is a DNSCrypt relay stamp, use it as a relay of the DNSCrypt upstreams (Options.DNSCryptRelays)", address)
+	}
+
 	stamp, err := dnsstamps.NewServerStampFromString(address)
 	if err != nil {
 		return nil, errorx.Decorate(err, "failed to parse %s", address)
@@ -124,9 +388,18 @@ func stampToUpstream(address string, opts Options) (Upstream, error) {
 
 	switch stamp.Proto {
 	case dnsstamps.StampProtoTypePlain:
-		return &plainDNS{address: stamp.ServerAddrStr, timeout: opts.Timeout}, nil
+		return newPlainDNS(stamp.ServerAddrStr, opts, false)
 	case dnsstamps.StampProtoTypeDNSCrypt:
-		return &dnsCrypt{boot: toBoot(address, opts.Bootstrap, opts.Timeout)}, nil
+		b, err := toBoot(address, opts)
+		if err != nil {
+			return nil, errorx.Decorate(err, "couldn't create dnscrypt bootstrapper")
+		}
+		relays, err := parseDNSCryptRelays(opts.DNSCryptRelays)
+		if err != nil {
+			return nil, err
+		}
+		// the proxies can't forward UDP, so DNSCrypt over TCP is used through them
+		return &dnsCrypt{boot: b, relays: relays, tcp: b.proxyDial != nil}, nil
 	case dnsstamps.StampProtoTypeDoH:
 		return AddressToUpstream(fmt.Sprintf("https://%s%s", stamp.ProviderName, stamp.Path), opts)
 	case dnsstamps.StampProtoTypeTLS:
@@ -1,9 +1,12 @@
 package upstream
 
 import (
+	"context"
 	"io"
+	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -17,49 +20,98 @@ import (
 //
 type dnsCrypt struct {
 	boot       *bootstrapper
-	client     *dnscrypt.Client     // DNSCrypt client properties
 	serverInfo *dnscrypt.ServerInfo // DNSCrypt server info
 
-	sync.RWMutex // protects DNSCrypt client
+	relays    []string // anonymization relays addresses (see Options.DNSCryptRelays)
+	nextRelay uint32   // the queries are sent through the relays in turn
+
+	// tcp is true if the certificate requests and the queries are sent over TCP,
+	// it's the only way to send the queries through a proxy (see Options.Proxy)
+	tcp bool
+
+	sync.RWMutex // protects DNSCrypt server info
 }
 
 func (p *dnsCrypt) Address() string { return p.boot.address }
 
+// Weight implements the WeightedUpstream interface
+func (p *dnsCrypt) Weight() int { return p.boot.weight }
+
 func (p *dnsCrypt) Exchange(m *dns.Msg) (*dns.Msg, error) {
-	reply, err := p.exchangeDNSCrypt(m)
+	// the retry and the relays failover share the same timeout
+	var deadline time.Time
+	if p.boot.timeout > 0 {
+		deadline = time.Now().Add(p.boot.timeout)
+	}
+	reply, err := p.exchangeRelays(m, deadline)
 
 	if os.IsTimeout(err) || err == io.EOF {
 		// If request times out, it is possible that the server configuration has been changed.
 		// It is safe to assume that the key was rotated (for instance, as it is described here: https://dnscrypt.pl/2017/02/26/how-key-rotation-is-automated/).
 		// We should re-fetch the server certificate info so that the new requests were not failing.
 		p.Lock()
-		p.client = nil
 		p.serverInfo = nil
 		p.Unlock()
 
-		// Retry the request one more time
-		return p.exchangeDNSCrypt(m)
+		// Retry the request one more time if there's time left
+		if _, ok := timeLeft(deadline); ok {
+			return p.exchangeRelays(m, deadline)
+		}
 	}
 
 	return reply, err
 }
 
-// exchangeDNSCrypt attempts to send the DNS query and returns the response
-func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
-	var client *dnscrypt.Client
-	var serverInfo *dnscrypt.ServerInfo
+// timeLeft returns the time left until the deadline, 0 if there's no deadline
+// ok is false if the deadline has passed.
+func timeLeft(deadline time.Time) (left time.Duration, ok bool) {
+	if deadline.IsZero() {
+		return 0, true
+	}
+	left = time.Until(deadline)
+	return left, left > 0
+}
+
+// exchangeRelays sends the DNS query through the next relay
+// If the relay fails, the other relays are tried in turn until the deadline.
+// If there are no relays, the query is sent to the server directly.
+func (p *dnsCrypt) exchangeRelays(m *dns.Msg, deadline time.Time) (*dns.Msg, error) {
+	if len(p.relays) == 0 {
+		return p.exchangeDNSCrypt(m, "", deadline)
+	}
 
+	next := int(atomic.AddUint32(&p.nextRelay, 1) - 1)
+	var reply *dns.Msg
+	var err error
+	for i := range p.relays {
+		if _, ok := timeLeft(deadline); !ok && i > 0 {
+			break
+		}
+		relay := p.relays[(next+i)%len(p.relays)]
+		reply, err = p.exchangeDNSCrypt(m, relay, deadline)
+		if err == nil {
+			return reply, nil
+		}
+		log.Tracef("Failed to exchange with %s through the relay %s: %s", p.Address(), relay, err)
+	}
+	// the last error is returned as is, so that the timeouts are detected by Exchange
+	return reply, err
+}
+
+// exchangeDNSCrypt attempts to send the DNS query through the relay (if it's not empty) and returns the response
+func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg, relay string, deadline time.Time) (*dns.Msg, error) {
 	p.RLock()
-	client = p.client
-	serverInfo = p.serverInfo
+	serverInfo := p.serverInfo
 	p.RUnlock()
 
 	now := uint32(time.Now().Unix())
-	if client == nil || serverInfo == nil || (serverInfo != nil && serverInfo.ServerCert.NotAfter < now) {
+	if serverInfo == nil || serverInfo.ServerCert.NotAfter < now {
 		p.Lock()
 
-		// Using "udp" for DNSCrypt upstreams by default
-		client = &dnscrypt.Client{Timeout: p.boot.timeout, AdjustPayloadSize: false}
+		// the certificate is fetched and validated by the dnscrypt library,
+		// UDP is used unless the upstream is used through a proxy
+		timeout, _ := timeLeft(deadline)
+		client := &dnscrypt.Client{Timeout: timeout, Proto: p.network(), AdjustPayloadSize: false}
 		si, _, err := client.Dial(p.boot.address)
 
 		if err != nil {
@@ -67,18 +119,16 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
 			return nil, errorx.Decorate(err, "failed to fetch certificate info from %s", p.Address())
 		}
 
-		p.client = client
 		p.serverInfo = si
 		serverInfo = si
 		p.Unlock()
 	}
 
-	reply, _, err := client.Exchange(m, serverInfo)
+	reply, err := p.exchangeConn(p.network(), m, serverInfo, relay, deadline)
 
-	if reply != nil && reply.Truncated {
+	if _, ok := timeLeft(deadline); ok && reply != nil && reply.Truncated && !p.tcp {
 		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
-		tcpClient := dnscrypt.Client{Timeout: p.boot.timeout, Proto: "tcp"}
-		reply, _, err = tcpClient.Exchange(m, serverInfo)
+		reply, err = p.exchangeConn("tcp", m, serverInfo, relay, deadline)
 	}
 
 	if err == nil && reply != nil && reply.Id != m.Id {
@@ -87,3 +137,57 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
 
 	return reply, err
 }
+
+// network returns the network the certificate requests and the queries are sent over
+func (p *dnsCrypt) network() string {
+	if p.tcp {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// exchangeConn sends the DNS query over a new connection that is bound as specified in the options
+// (see Options.SourceIP and Options.Interface)
+// The certificate is fetched by the dnscrypt library that can't use such a connection.
+func (p *dnsCrypt) exchangeConn(network string, m *dns.Msg, serverInfo *dnscrypt.ServerInfo, relay string, deadline time.Time) (*dns.Msg, error) {
+	conn, err := p.dialConn(network, serverInfo.ServerAddress, relay, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout, _ := timeLeft(deadline)
+	client := &dnscrypt.Client{Timeout: timeout, Proto: network, AdjustPayloadSize: false}
+	reply, _, err := client.ExchangeConn(m, serverInfo, conn)
+	return reply, err
+}
+
+// dialConn connects to the server or to the relay that forwards the queries to the server
+func (p *dnsCrypt) dialConn(network, serverAddr, relay string, deadline time.Time) (net.Conn, error) {
+	if relay == "" {
+		return p.dialAddr(network, serverAddr, deadline)
+	}
+
+	header, err := anonymizedDNSHeader(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.dialAddr(network, relay, deadline)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't connect to the relay %s", relay)
+	}
+	return &relayConn{Conn: conn, header: header, tcp: network == "tcp"}, nil
+}
+
+// dialAddr opens a bound connection, the TCP connections are tunneled through the proxy if there's one
+func (p *dnsCrypt) dialAddr(network, addr string, deadline time.Time) (net.Conn, error) {
+	if deadline.IsZero() {
+		deadline = time.Now().Add(dialTimeout)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if network != "tcp" {
+		return p.boot.bind.dialer(network, 0).DialContext(ctx, network, addr)
+	}
+	return p.boot.baseDial()(ctx, network, addr)
+}
@@ -0,0 +1,104 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/joomcode/errorx"
+)
+
+// Anonymized DNSCrypt (see https://github.com/DNSCrypt/dnscrypt-protocol/blob/master/ANONYMIZED-DNSCRYPT.txt)
+const (
+	stampProtoTypeDNSCryptRelay = 0x81
+	defaultDNSCryptRelayPort    = "443"
+)
+
+// anonymizedDNSMagic starts the queries that are sent to the relays
+var anonymizedDNSMagic = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+
+// parseDNSCryptRelays converts the relays (see Options.DNSCryptRelays) to the host:port addresses
+func parseDNSCryptRelays(relays []string) ([]string, error) {
+	var addrs []string
+	for _, relay := range relays {
+		addr := relay
+		if strings.HasPrefix(relay, "sdns://") {
+			proto, raw, err := stampProto(relay)
+			if err != nil {
+				return nil, errorx.Decorate(err, "invalid DNSCrypt relay stamp %s", relay)
+			}
+			if proto != stampProtoTypeDNSCryptRelay {
+				return nil, fmt.Errorf("not a DNSCrypt relay stamp: %s", relay)
+			}
+			// 0x81 || LP(addr)
+			addr, raw, err = readStampLP(raw)
+			if err != nil || len(raw) != 0 {
+				return nil, fmt.Errorf("invalid DNSCrypt relay stamp: %s", relay)
+			}
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = strings.Trim(addr, "[]"), defaultDNSCryptRelayPort
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("DNSCrypt relay address must be an IP address: %s", relay)
+		}
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+	return addrs, nil
+}
+
+// anonymizedDNSHeader creates the header that tells the relay where to forward the query:
+// magic || server IPv6 or IPv4-mapped address || server port
+func anonymizedDNSHeader(serverAddr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("DNSCrypt server address must be an IP address to be used with a relay: %s", serverAddr)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{}, anonymizedDNSMagic...)
+	header = append(header, ip.To16()...)
+	return append(header, byte(p>>8), byte(p)), nil
+}
+
+// relayConn is a connection to a relay that prepends the header to the queries
+// The responses are forwarded by the relay as they are.
+type relayConn struct {
+	net.Conn
+	header []byte
+	tcp    bool // the TCP queries are prefixed with their length
+}
+
+// Write prepends the header to the query
+// The whole query must be written at once, which is what the dnscrypt library does.
+func (c *relayConn) Write(b []byte) (int, error) {
+	var msg []byte
+	if c.tcp {
+		if len(b) < 2 {
+			return 0, errors.New("invalid TCP query")
+		}
+		msg = make([]byte, 2, 2+len(c.header)+len(b)-2)
+		binary.BigEndian.PutUint16(msg, uint16(len(c.header)+len(b)-2))
+		msg = append(msg, c.header...)
+		msg = append(msg, b[2:]...)
+	} else {
+		msg = append(append([]byte{}, c.header...), b...)
+	}
+
+	if _, err := c.Conn.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
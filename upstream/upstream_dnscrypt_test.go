@@ -0,0 +1,387 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// testDNSCryptServer is a local DNSCrypt server (XSalsa20Poly1305, UDP and TCP on the same port)
+// that answers A requests with 8.8.8.8 (see assertResponse)
+type testDNSCryptServer struct {
+	conn      *net.UDPConn
+	listener  net.Listener
+	stamp     dnsstamps.ServerStamp
+	secretKey [32]byte
+	publicKey [32]byte
+	signKey   ed25519.PrivateKey // the provider key the certificate is signed with
+
+	sync.Mutex
+	cert    []byte   // the certificate, it may be replaced while the server is running (see signCert)
+	clients []string // the addresses the queries came from
+}
+
+func newTestDNSCryptServer(t *testing.T) *testDNSCryptServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	providerPk, providerSk, _ := ed25519.GenerateKey(rand.Reader)
+
+	l, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+
+	s := &testDNSCryptServer{conn: conn, listener: l, signKey: providerSk}
+	_, _ = rand.Read(s.secretKey[:])
+	curve25519.ScalarBaseMult(&s.publicKey, &s.secretKey)
+	now := uint32(time.Now().Unix())
+	s.signCert(now-3600, now+3600)
+
+	s.stamp = dnsstamps.ServerStamp{
+		Proto:         dnsstamps.StampProtoTypeDNSCrypt,
+		ServerAddrStr: conn.LocalAddr().String(),
+		ServerPk:      providerPk,
+		ProviderName:  "2.dnscrypt-cert.example.org",
+	}
+	go s.serve()
+	go s.serveTCP()
+	return s
+}
+
+// signCert creates the certificate that is valid within the specified period
+func (s *testDNSCryptServer) signCert(notBefore, notAfter uint32) {
+	// DNSC || es_version || minor || signature || resolver_pk || client_magic || serial || ts_start || ts_end
+	signed := append(append([]byte{}, s.publicKey[:]...), []byte("testmagc")...)
+	signed = append(signed, 0, 0, 0, 1)
+	signed = appendUint32(signed, notBefore)
+	signed = appendUint32(signed, notAfter)
+	cert := append([]byte{'D', 'N', 'S', 'C', 0x00, 0x01, 0x00, 0x00}, ed25519.Sign(s.signKey, signed)...)
+	cert = append(cert, signed...)
+
+	s.Lock()
+	s.cert = cert
+	s.Unlock()
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func (s *testDNSCryptServer) serve() {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		s.Lock()
+		s.clients = append(s.clients, addr.String())
+		s.Unlock()
+
+		if resp := s.answer(buf[:n]); resp != nil {
+			_, _ = s.conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+// serveTCP answers the queries prefixed with their length
+func (s *testDNSCryptServer) serveTCP() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.Lock()
+		s.clients = append(s.clients, conn.RemoteAddr().String())
+		s.Unlock()
+
+		go func() {
+			defer conn.Close()
+			for {
+				var l [2]byte
+				if _, err := io.ReadFull(conn, l[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := s.answer(query)
+				if resp == nil {
+					return
+				}
+				_, _ = conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+			}
+		}()
+	}
+}
+
+// answer answers either the certificate request or the encrypted query
+func (s *testDNSCryptServer) answer(query []byte) []byte {
+	if bytes.HasPrefix(query, []byte("testmagc")) {
+		return s.answerEncrypted(query)
+	}
+	return s.answerCert(query)
+}
+
+// answerCert answers the certificate request
+func (s *testDNSCryptServer) answerCert(buf []byte) []byte {
+	req := &dns.Msg{}
+	if req.Unpack(buf) != nil || len(req.Question) != 1 {
+		return nil
+	}
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{s.certRR(req.Question[0].Name)}
+	buf, _ = resp.Pack()
+	return buf
+}
+
+// certRR returns the TXT record with the certificate
+func (s *testDNSCryptServer) certRR(name string) dns.RR {
+	s.Lock()
+	cert := s.cert
+	s.Unlock()
+
+	var escaped strings.Builder
+	for _, b := range cert {
+		_, _ = fmt.Fprintf(&escaped, "\\%03d", b)
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{escaped.String()},
+	}
+}
+
+// answerEncrypted decrypts the query and encrypts the response:
+// client_magic || client_pk || client_nonce || encrypted
+func (s *testDNSCryptServer) answerEncrypted(query []byte) []byte {
+	if len(query) < 8+32+12 {
+		return nil
+	}
+	var clientPk, sharedKey [32]byte
+	var nonce [24]byte
+	copy(clientPk[:], query[8:40])
+	copy(nonce[:], query[40:52])
+	box.Precompute(&sharedKey, &clientPk, &s.secretKey)
+	padded, ok := secretbox.Open(nil, query[52:], &nonce, &sharedKey)
+	if !ok {
+		return nil
+	}
+	req := &dns.Msg{}
+	if req.Unpack(padded[:bytes.LastIndexByte(padded, 0x80)]) != nil {
+		return nil
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{8, 8, 8, 8},
+	}}
+	buf, _ := resp.Pack()
+	buf = append(buf, 0x80)
+	for len(buf)%64 != 0 {
+		buf = append(buf, 0x00)
+	}
+
+	_, _ = rand.Read(nonce[12:])
+	msg := append([]byte("r6fnvWj8"), nonce[:]...)
+	return secretbox.Seal(msg, buf, &nonce, &sharedKey)
+}
+
+func (s *testDNSCryptServer) received() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.clients...)
+}
+
+func (s *testDNSCryptServer) close() {
+	_ = s.conn.Close()
+	_ = s.listener.Close()
+}
+
+// testDNSCryptRelay is a local anonymized DNSCrypt relay (UDP only)
+type testDNSCryptRelay struct {
+	conn *net.UDPConn
+
+	sync.Mutex
+	forwarded int
+}
+
+func newTestDNSCryptRelay(t *testing.T) *testDNSCryptRelay {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 2}})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	r := &testDNSCryptRelay{conn: conn}
+	go r.serve()
+	return r
+}
+
+func (r *testDNSCryptRelay) serve() {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < len(anonymizedDNSMagic)+18 || !bytes.HasPrefix(buf, anonymizedDNSMagic) {
+			continue
+		}
+		header := buf[len(anonymizedDNSMagic) : len(anonymizedDNSMagic)+18]
+		server := &net.UDPAddr{IP: net.IP(header[:16]), Port: int(binary.BigEndian.Uint16(header[16:]))}
+		query := append([]byte{}, buf[len(anonymizedDNSMagic)+18:n]...)
+
+		r.Lock()
+		r.forwarded++
+		r.Unlock()
+
+		go func() {
+			conn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 2}}, server)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = conn.Write(query)
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			resp := make([]byte, dns.MaxMsgSize)
+			n, err := conn.Read(resp)
+			if err == nil {
+				_, _ = r.conn.WriteToUDP(resp[:n], addr)
+			}
+		}()
+	}
+}
+
+func (r *testDNSCryptRelay) addr() string {
+	return r.conn.LocalAddr().String()
+}
+
+func (r *testDNSCryptRelay) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.forwarded
+}
+
+func (r *testDNSCryptRelay) close() {
+	_ = r.conn.Close()
+}
+
+func TestDNSCryptRelays(t *testing.T) {
+	srv := newTestDNSCryptServer(t)
+	defer srv.close()
+	relay := newTestDNSCryptRelay(t)
+	defer relay.close()
+
+	// directly to the server
+	u, err := AddressToUpstream(srv.stamp.String(), Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	checkUpstream(t, u, u.Address())
+	assert.Equal(t, 0, relay.count())
+
+	// through the relay, the server sees the relay's address only,
+	// the certificate is fetched directly
+	relayStamp := appendStampLP([]byte{stampProtoTypeDNSCryptRelay}, relay.addr())
+	before := len(srv.received())
+	u, err = AddressToUpstream(srv.stamp.String(), Options{
+		Timeout:        time.Second,
+		DNSCryptRelays: []string{"sdns://" + base64.RawURLEncoding.EncodeToString(relayStamp)},
+	})
+	assert.Nil(t, err)
+	checkUpstream(t, u, u.Address())
+	assert.Equal(t, 1, relay.count())
+	received := srv.received()[before:]
+	if assert.Equal(t, 2, len(received)) {
+		assert.True(t, strings.HasPrefix(received[0], "127.0.0.1:"))
+		assert.True(t, strings.HasPrefix(received[1], "127.0.0.2:"))
+	}
+
+	// the dead relay is skipped
+	dead, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	deadAddr := dead.LocalAddr().String()
+	_ = dead.Close()
+	u, err = AddressToUpstream(srv.stamp.String(), Options{
+		Timeout:        time.Second,
+		DNSCryptRelays: []string{deadAddr, relay.addr()},
+	})
+	assert.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		checkUpstream(t, u, u.Address())
+	}
+	assert.Equal(t, 1+4, relay.count())
+
+	// invalid relays
+	_, err = AddressToUpstream(srv.stamp.String(), Options{DNSCryptRelays: []string{"relay.example:443"}})
+	assert.NotNil(t, err)
+	relayAddr := "sdns://" + base64.RawURLEncoding.EncodeToString(relayStamp)
+	_, err = AddressToUpstream(relayAddr, Options{})
+	assert.EqualError(t, err, relayAddr+" is a DNSCrypt relay stamp, use it as a relay of the DNSCrypt upstreams (Options.DNSCryptRelays)")
+}
+
+func TestDNSCryptCertValidity(t *testing.T) {
+	srv := newTestDNSCryptServer(t)
+	defer srv.close()
+
+	now := uint32(time.Now().Unix())
+	for name, tc := range map[string]struct {
+		notBefore, notAfter uint32
+		valid               bool
+	}{
+		"valid":         {now - 3600, now + 3600, true},
+		"inverted":      {now + 3600, now - 3600, false},
+		"empty":         {now, now, false},
+		"expired":       {now - 7200, now - 3600, false},
+		"not yet valid": {now + 3600, now + 7200, false},
+	} {
+		srv.signCert(tc.notBefore, tc.notAfter)
+		u, err := AddressToUpstream(srv.stamp.String(), Options{Timeout: time.Second})
+		assert.Nil(t, err, name)
+		_, err = u.Exchange(createTestMessage())
+		if tc.valid {
+			assert.Nil(t, err, name)
+		} else {
+			assert.NotNil(t, err, name)
+		}
+	}
+}
+
+func TestDNSCryptTimeout(t *testing.T) {
+	srv := newTestDNSCryptServer(t)
+	defer srv.close()
+
+	// the relays that never answer, the failover and the retry are bounded by the timeout
+	var relays []string
+	for i := 0; i < 3; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		assert.Nil(t, err)
+		defer conn.Close()
+		relays = append(relays, conn.LocalAddr().String())
+	}
+	u, err := AddressToUpstream(srv.stamp.String(), Options{Timeout: 300 * time.Millisecond, DNSCryptRelays: relays})
+	assert.Nil(t, err)
+	start := time.Now()
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 600*time.Millisecond, time.Since(start))
+}
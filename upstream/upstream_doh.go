@@ -1,10 +1,13 @@
 package upstream
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +26,11 @@ var DohMaxConnsPerHost = 0
 type dnsOverHTTPS struct {
 	boot *bootstrapper
 
+	method        string      // HTTP method (see Options.DoHMethod)
+	headers       http.Header // additional HTTP headers (see Options.DoHHeaders)
+	http11        bool        // use HTTP/1.1 instead of HTTP/2 (see Options.DoHHTTPVersion)
+	disableWarmUp bool        // don't send the warm-up query (see Options.DoHDisableWarmUp)
+
 	// The Client's Transport typically has internal state (cached TCP
 	// connections), so Clients should be reused instead of created as
 	// needed. Clients are safe for concurrent use by multiple goroutines.
@@ -31,15 +39,76 @@ type dnsOverHTTPS struct {
 	sync.RWMutex // protects transport
 }
 
+// newDNSOverHTTPS creates a DOH upstream with the specified options
+func newDNSOverHTTPS(boot *bootstrapper, opts Options) (*dnsOverHTTPS, error) {
+	p := &dnsOverHTTPS{
+		boot:          boot,
+		method:        http.MethodGet,
+		headers:       opts.DoHHeaders,
+		disableWarmUp: opts.DoHDisableWarmUp,
+	}
+
+	switch strings.ToUpper(opts.DoHMethod) {
+	case "", http.MethodGet:
+	case http.MethodPost:
+		p.method = http.MethodPost
+	default:
+		return nil, fmt.Errorf("unsupported DOH method: %s", opts.DoHMethod)
+	}
+
+	switch opts.DoHHTTPVersion {
+	case "", "2":
+	case "1.1":
+		p.http11 = true
+	default:
+		return nil, fmt.Errorf("unsupported DOH HTTP version: %s", opts.DoHHTTPVersion)
+	}
+
+	return p, nil
+}
+
 func (p *dnsOverHTTPS) Address() string { return p.boot.address }
 
+// Weight implements the WeightedUpstream interface
+func (p *dnsOverHTTPS) Weight() int { return p.boot.weight }
+
 func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// ExchangeContext implements the ContextUpstream interface
+func (p *dnsOverHTTPS) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
 	client, err := p.getClient()
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't initialize HTTP client or transport")
 	}
 
-	r, err := p.exchangeHTTPSClient(m, client)
+	r, err := p.exchangeHTTPSClient(ctx, m, client)
+	return r, p.checkClient(ctx, client, err)
+}
+
+// do sends the HTTP request with the upstream's HTTP client and returns the response body
+// The request URL, method, and body are set by the caller, the additional headers are added here.
+func (p *dnsOverHTTPS) do(ctx context.Context, req *http.Request) ([]byte, error) {
+	client, err := p.getClient()
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't initialize HTTP client or transport")
+	}
+
+	for name, values := range p.headers {
+		req.Header[name] = values
+	}
+	body, err := p.roundTrip(client, req.WithContext(ctx))
+	return body, p.checkClient(ctx, client, err)
+}
+
+// checkClient drops the HTTP client if the request has failed, so it will be re-created for the next request
+// Returns the context error if the request was cancelled.
+func (p *dnsOverHTTPS) checkClient(ctx context.Context, client *http.Client, err error) error {
+	if ctx.Err() != nil {
+		// the request was cancelled, the connection is fine
+		return ctx.Err()
+	}
 	if err != nil {
 		p.Lock()
 		if client == p.client {
@@ -47,30 +116,65 @@ func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 		}
 		p.Unlock()
 	}
-	return r, err
+	return err
 }
 
 // exchangeHTTPSClient sends the DNS query to a DOH resolver using the specified http.Client instance
-func (p *dnsOverHTTPS) exchangeHTTPSClient(m *dns.Msg, client *http.Client) (*dns.Msg, error) {
+func (p *dnsOverHTTPS) exchangeHTTPSClient(ctx context.Context, m *dns.Msg, client *http.Client) (*dns.Msg, error) {
 	buf, err := m.Pack()
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't pack request msg")
 	}
 
-	// It appears, that GET requests are more memory-efficient with Golang implementation of HTTP/2.
-	requestURL := p.boot.address + "?dns=" + base64.RawURLEncoding.EncodeToString(buf)
-	req, err := http.NewRequest("GET", requestURL, nil)
+	var req *http.Request
+	if p.method == http.MethodPost {
+		req, err = http.NewRequest(http.MethodPost, p.boot.address, bytes.NewReader(buf))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/dns-message")
+		}
+	} else {
+		// It appears, that GET requests are more memory-efficient with Golang implementation of HTTP/2.
+		separator := "?"
+		if strings.Contains(p.boot.address, "?") {
+			separator = "&"
+		}
+		requestURL := p.boot.address + separator + "dns=" + base64.RawURLEncoding.EncodeToString(buf)
+		req, err = http.NewRequest(http.MethodGet, requestURL, nil)
+	}
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't create a HTTP request to %s", p.boot.address)
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Accept", "application/dns-message")
+	for name, values := range p.headers {
+		req.Header[name] = values
+	}
+
+	body, err := p.roundTrip(client, req)
+	if err != nil {
+		return nil, err
+	}
 
+	response := dns.Msg{}
+	err = response.Unpack(body)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't unpack DNS response from '%s': body is %s", p.boot.address, string(body))
+	}
+	if err == nil && response.Id != m.Id {
+		err = dns.ErrId
+	}
+	return &response, err
+}
+
+// roundTrip sends the HTTP request and returns the response body
+// The responses with a status code other than 200 are returned as httpStatusError.
+func (p *dnsOverHTTPS) roundTrip(client *http.Client, req *http.Request) ([]byte, error) {
 	resp, err := client.Do(req)
 	if resp != nil && resp.Body != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return nil, errorx.Decorate(err, "couldn't do a POST request to '%s'", p.boot.address)
+		return nil, errorx.Decorate(err, "couldn't do a %s request to '%s'", req.Method, p.boot.address)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -78,17 +182,19 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(m *dns.Msg, client *http.Client) (*dn
 		return nil, errorx.Decorate(err, "couldn't read body contents for '%s'", p.boot.address)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("got an unexpected HTTP status code %d from '%s'", resp.StatusCode, p.boot.address)
-	}
-	response := dns.Msg{}
-	err = response.Unpack(body)
-	if err != nil {
-		return nil, errorx.Decorate(err, "couldn't unpack DNS response from '%s': body is %s", p.boot.address, string(body))
-	}
-	if err == nil && response.Id != m.Id {
-		err = dns.ErrId
+		return nil, &httpStatusError{code: resp.StatusCode, address: p.boot.address}
 	}
-	return &response, err
+	return body, nil
+}
+
+// httpStatusError is returned when the server responds with an unexpected HTTP status code
+type httpStatusError struct {
+	code    int
+	address string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("got an unexpected HTTP status code %d from '%s'", e.code, e.address)
 }
 
 // getClient gets or lazily initializes an HTTP client (and transport) that will be used for this DOH resolver.
@@ -123,13 +229,15 @@ func (p *dnsOverHTTPS) getClient() (*http.Client, error) {
 	// This is actually important -- if there is no warmup, there's a race condition on the very first DNS query:
 	// http.Client will create numerous connections. During this warmup it'll create a new connection that will be used
 	// for processing further DNS queries.
-	req := dns.Msg{}
-	req.Id = dns.Id()
-	req.RecursionDesired = true
-	req.Question = []dns.Question{{Name: "ipv4only.arpa.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
-	_, err = p.exchangeHTTPSClient(&req, client)
-	if err != nil {
-		return nil, err
+	if !p.disableWarmUp {
+		req := dns.Msg{}
+		req.Id = dns.Id()
+		req.RecursionDesired = true
+		req.Question = []dns.Question{{Name: "ipv4only.arpa.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+		_, err = p.exchangeHTTPSClient(context.Background(), &req, client)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	p.client = client
@@ -144,6 +252,11 @@ func (p *dnsOverHTTPS) createTransport() (*http.Transport, error) {
 		return nil, errorx.Decorate(err, "couldn't bootstrap %s", p.boot.address)
 	}
 
+	if p.http11 {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+
 	transport := &http.Transport{
 		TLSClientConfig:    tlsConfig,
 		DisableCompression: true,
@@ -151,9 +264,11 @@ func (p *dnsOverHTTPS) createTransport() (*http.Transport, error) {
 		MaxConnsPerHost:    DohMaxConnsPerHost,
 		MaxIdleConns:       1,
 	}
-	// It appears that this is important to explicitly configure transport to use HTTP2
-	// Relevant issue: https://github.com/AdguardTeam/dnsproxy/issues/11
-	http2.ConfigureTransport(transport) // nolint
+	if !p.http11 {
+		// It appears that this is important to explicitly configure transport to use HTTP2
+		// Relevant issue: https://github.com/AdguardTeam/dnsproxy/issues/11
+		http2.ConfigureTransport(transport) // nolint
+	}
 
 	return transport, nil
 }
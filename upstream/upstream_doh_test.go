@@ -0,0 +1,116 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDoHServer is a local DNS-over-HTTPS server that answers A requests with 8.8.8.8 (see assertResponse)
+type testDoHServer struct {
+	*httptest.Server
+
+	requests []*http.Request // received requests
+	sync.Mutex
+}
+
+func newTestDoHServer(t *testing.T) *testDoHServer {
+	s := &testDoHServer{}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	return s
+}
+
+func (s *testDoHServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.requests = append(s.requests, r)
+	s.Unlock()
+
+	var buf []byte
+	var err error
+	if r.Method == http.MethodPost {
+		buf, err = ioutil.ReadAll(r.Body)
+	} else {
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	}
+	req := &dns.Msg{}
+	if err == nil {
+		err = req.Unpack(buf)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{8, 8, 8, 8},
+	}}
+	buf, _ = resp.Pack()
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, _ = w.Write(buf)
+}
+
+func (s *testDoHServer) received() []*http.Request {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*http.Request{}, s.requests...)
+}
+
+func TestDoHOptions(t *testing.T) {
+	srv := newTestDoHServer(t)
+	defer srv.Close()
+
+	// GET over HTTP/2 with the warm-up query
+	u, err := AddressToUpstream(srv.URL+"/dns-query?insecure=true&id=1", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	resp, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+
+	requests := srv.received()
+	assert.Equal(t, 2, len(requests))
+	r := requests[1]
+	assert.Equal(t, http.MethodGet, r.Method)
+	assert.Equal(t, 2, r.ProtoMajor)
+	assert.Equal(t, "1", r.URL.Query().Get("id"))
+
+	// POST over HTTP/1.1 with the custom headers and without the warm-up
+	srv.Lock()
+	srv.requests = nil
+	srv.Unlock()
+	u, err = AddressToUpstream(srv.URL+"/dns-query?insecure=true&method=post&http=1.1&warmup=false"+
+		"&header=Authorization:Bearer%20token&header=User-Agent:dnsproxy-test", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	resp, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+
+	requests = srv.received()
+	assert.Equal(t, 1, len(requests))
+	r = requests[0]
+	assert.Equal(t, http.MethodPost, r.Method)
+	assert.Equal(t, 1, r.ProtoMajor)
+	assert.Equal(t, "application/dns-message", r.Header.Get("Content-Type"))
+	assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+	assert.Equal(t, "dnsproxy-test", r.Header.Get("User-Agent"))
+
+	// invalid options
+	_, err = AddressToUpstream(srv.URL+"/dns-query?method=put", Options{})
+	assert.NotNil(t, err)
+	_, err = AddressToUpstream(srv.URL+"/dns-query?http=3", Options{})
+	assert.NotNil(t, err)
+	_, err = AddressToUpstream(srv.URL+"/dns-query?header=invalid", Options{})
+	assert.NotNil(t, err)
+}
@@ -1,10 +1,8 @@
 package upstream
 
 import (
-	"net"
-	"sync"
+	"context"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
@@ -15,73 +13,22 @@ import (
 type dnsOverTLS struct {
 	boot *bootstrapper
 	pool *TLSPool
-
-	sync.RWMutex // protects pool
 }
 
 func (p *dnsOverTLS) Address() string { return p.boot.address }
 
-func (p *dnsOverTLS) Exchange(m *dns.Msg) (*dns.Msg, error) {
-	var pool *TLSPool
-	p.RLock()
-	pool = p.pool
-	p.RUnlock()
-	if pool == nil {
-		p.Lock()
-		// lazy initialize it
-		p.pool = &TLSPool{boot: p.boot}
-		p.Unlock()
-	}
-
-	p.RLock()
-	poolConn, err := p.pool.Get()
-	p.RUnlock()
-	if err != nil {
-		return nil, errorx.Decorate(err, "Failed to get a connection from TLSPool to %s", p.Address())
-	}
-
-	reply, err := p.exchangeConn(poolConn, m)
-	if err != nil {
-		log.Tracef("The TLS connection is expired due to %s", err)
-
-		// The pooled connection might have been closed already (see https://github.com/AdguardTeam/dnsproxy/issues/3)
-		// So we're trying to re-connect right away here.
-		// We are forcing creation of a new connection instead of calling Get() again
-		// as there's no guarantee that other pooled connections are intact
-		p.RLock()
-		poolConn, err = p.pool.Create()
-		p.RUnlock()
-		if err != nil {
-			return nil, errorx.Decorate(err, "Failed to create a new connection from TLSPool to %s", p.Address())
-		}
+// Weight implements the WeightedUpstream interface
+func (p *dnsOverTLS) Weight() int { return p.boot.weight }
 
-		// Retry sending the DNS request
-		reply, err = p.exchangeConn(poolConn, m)
-	}
-
-	if err == nil {
-		p.RLock()
-		p.pool.Put(poolConn)
-		p.RUnlock()
-	}
-	return reply, err
+func (p *dnsOverTLS) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return p.ExchangeContext(context.Background(), m)
 }
 
-func (p *dnsOverTLS) exchangeConn(poolConn net.Conn, m *dns.Msg) (*dns.Msg, error) {
-	c := dns.Conn{Conn: poolConn}
-	err := c.WriteMsg(m)
+// ExchangeContext implements the ContextUpstream interface
+func (p *dnsOverTLS) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	reply, err := p.pool.Exchange(ctx, m)
 	if err != nil {
-		poolConn.Close()
-		return nil, errorx.Decorate(err, "Failed to send a request to %s", p.Address())
-	}
-
-	reply, err := c.ReadMsg()
-	if err != nil {
-		poolConn.Close()
-		return nil, errorx.Decorate(err, "Failed to read a request from %s", p.Address())
-	}
-	if err == nil && reply.Id != m.Id {
-		err = dns.ErrId
+		return nil, errorx.Decorate(err, "Failed to exchange with %s", p.Address())
 	}
-	return reply, err
+	return reply, nil
 }
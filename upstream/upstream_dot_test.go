@@ -0,0 +1,385 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDoTServer is a local DNS-over-TLS server that answers A requests with 8.8.8.8 (see assertResponse)
+type testDoTServer struct {
+	listener net.Listener
+	cert     *x509.Certificate
+	silent   int32 // 1 if the server reads the requests and never answers
+
+	conns       []net.Conn // the accepted connections
+	serverNames []string   // server names from the TLS handshakes
+	clientIPs   []string   // client IP addresses from the TLS handshakes
+	resumed     int        // number of the resumed TLS sessions
+	sync.Mutex
+}
+
+// newTestDoTServer starts a DoT server with a self-signed certificate for the specified name
+func newTestDoTServer(t *testing.T, name string) *testDoTServer {
+	cert, tlsCert := newTestCertificate(t, name)
+	return newTestDoTServerWithCert(t, cert, tlsCert)
+}
+
+// newTestDoTServerWithCert starts a DoT server with the specified certificate
+func newTestDoTServerWithCert(t *testing.T, cert *x509.Certificate, tlsCert tls.Certificate) *testDoTServer {
+	s := &testDoTServer{cert: cert}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			s.Lock()
+			s.serverNames = append(s.serverNames, hello.ServerName)
+			s.clientIPs = append(s.clientIPs, hello.Conn.RemoteAddr().(*net.TCPAddr).IP.String())
+			s.Unlock()
+			return nil, nil
+		},
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	s.listener = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testDoTServer) serve(conn net.Conn) {
+	defer conn.Close()
+	s.Lock()
+	s.conns = append(s.conns, conn)
+	s.Unlock()
+	tlsConn := conn.(*tls.Conn)
+	if tlsConn.Handshake() != nil {
+		return
+	}
+	if tlsConn.ConnectionState().DidResume {
+		s.Lock()
+		s.resumed++
+		s.Unlock()
+	}
+
+	c := dns.Conn{Conn: conn}
+	for {
+		req, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(&s.silent) == 1 {
+			continue
+		}
+		resp := dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{8, 8, 8, 8},
+		}}
+		if err = c.WriteMsg(&resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *testDoTServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testDoTServer) close() {
+	_ = s.listener.Close()
+}
+
+// closeConns closes the accepted connections on the server side
+func (s *testDoTServer) closeConns() {
+	s.Lock()
+	defer s.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+// handshakes returns the number of the TLS handshakes and how many of them resumed a session
+func (s *testDoTServer) handshakes() (total, resumed int) {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.serverNames), s.resumed
+}
+
+func (s *testDoTServer) lastServerName() string {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.serverNames) == 0 {
+		return ""
+	}
+	return s.serverNames[len(s.serverNames)-1]
+}
+
+// newTestCertificate generates a self-signed certificate for the specified name
+func newTestCertificate(t *testing.T, name string) (*x509.Certificate, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{Organization: []string{"AdGuard Tests"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %s", err)
+	}
+	return cert, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+func TestDoTServerName(t *testing.T) {
+	srv := newTestDoTServer(t, "dns.corp")
+	defer srv.close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.port()))
+
+	// the self-signed certificate is not trusted
+	u, err := AddressToUpstream("tls://"+addr+"?sni=dns.corp", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+	assert.Equal(t, "dns.corp", srv.lastServerName())
+
+	u, err = AddressToUpstream("tls://"+addr+"?sni=dns.corp&insecure=true", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	resp, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+	assert.Equal(t, "dns.corp", srv.lastServerName())
+}
+
+func TestDoTCAFileAndPins(t *testing.T) {
+	srv := newTestDoTServer(t, "dns.corp")
+	defer srv.close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.port()))
+
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.cert.Raw}), 0600)
+	assert.Nil(t, err)
+
+	// the certificate is trusted with the custom CA file
+	opts := Options{Timeout: time.Second, TLSServerName: "dns.corp", CAFiles: []string{caFile}}
+	u, err := AddressToUpstream("tls://"+addr, opts)
+	assert.Nil(t, err)
+	resp, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+
+	// matching pin
+	opts.SPKIPins = []string{SPKIHash(srv.cert)}
+	u, err = AddressToUpstream("tls://"+addr, opts)
+	assert.Nil(t, err)
+	resp, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+
+	// pin mismatch
+	other, _ := newTestCertificate(t, "dns.corp")
+	opts.SPKIPins = []string{SPKIHash(other)}
+	u, err = AddressToUpstream("tls://"+addr, opts)
+	assert.Nil(t, err)
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+	assert.True(t, IsPinMismatch(err))
+
+	// pins are checked even if the verification is disabled
+	u, err = AddressToUpstream("tls://"+addr+"?insecure=true&pin="+url.QueryEscape(SPKIHash(other)), Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	_, err = u.Exchange(createTestMessage())
+	assert.True(t, IsPinMismatch(err))
+
+	// invalid options
+	_, err = AddressToUpstream("tls://"+addr+"?pin=invalid", Options{})
+	assert.NotNil(t, err)
+	_, err = AddressToUpstream("tls://"+addr+"?ca="+filepath.Join(dir, "missing.pem"), Options{})
+	assert.NotNil(t, err)
+}
+
+func TestDoTPinsExtraCertificate(t *testing.T) {
+	// the server presents its own leaf certificate followed by the pinned one
+	pinned, _ := newTestCertificate(t, "dns.corp")
+	cert, tlsCert := newTestCertificate(t, "dns.corp")
+	tlsCert.Certificate = append(tlsCert.Certificate, pinned.Raw)
+	srv := newTestDoTServerWithCert(t, cert, tlsCert)
+	defer srv.close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.port()))
+
+	// only the leaf certificate is checked if the verification is disabled
+	u, err := AddressToUpstream("tls://"+addr+"?insecure=true&pin="+url.QueryEscape(SPKIHash(pinned)), Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	_, err = u.Exchange(createTestMessage())
+	assert.True(t, IsPinMismatch(err))
+
+	u, err = AddressToUpstream("tls://"+addr+"?insecure=true&pin="+url.QueryEscape(SPKIHash(cert)), Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	resp, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+}
+
+func TestDoTPipelining(t *testing.T) {
+	srv := newTestDoTServer(t, "dns.corp")
+	defer srv.close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.port()))
+
+	u, err := AddressToUpstream("tls://"+addr+"?sni=dns.corp&insecure=true&max_conns=2", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+
+	// the concurrent queries are pipelined over no more than 2 connections
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := createTestMessage()
+			resp, err := u.Exchange(req)
+			assert.Nil(t, err)
+			if resp != nil {
+				assertResponse(t, resp)
+				assert.Equal(t, req.Id, resp.Id)
+			}
+		}()
+	}
+	wg.Wait()
+
+	total, _ := srv.handshakes()
+	assert.True(t, total >= 1 && total <= 2, "handshakes: %d", total)
+}
+
+func TestDoTSessionResumption(t *testing.T) {
+	srv := newTestDoTServer(t, "dns.corp")
+	defer srv.close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.port()))
+
+	u, err := AddressToUpstream("tls://"+addr+"?sni=dns.corp&insecure=true&idle_timeout=100ms", Options{Timeout: 100 * time.Millisecond})
+	assert.Nil(t, err)
+
+	resp, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+
+	// wait for the idle connection to be closed
+	pool := u.(*dnsOverTLS).pool.pool
+	assert.Eventually(t, func() bool {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		_, alive := pool.conns[0].state()
+		return !alive
+	}, time.Second, 20*time.Millisecond)
+
+	// the new connection resumes the TLS session
+	resp, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+	total, resumed := srv.handshakes()
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 1, resumed)
+}
+
+func TestTLSPoolDeadLine(t *testing.T) {
+	srv := newTestDoTServer(t, "dns.corp")
+	defer srv.close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.port()))
+
+	u, err := AddressToUpstream("tls://"+addr+"?sni=dns.corp&insecure=true", Options{Timeout: 100 * time.Millisecond})
+	assert.Nil(t, err)
+	resp, err := u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+
+	// the connection stops answering and is closed after a few timeouts
+	atomic.StoreInt32(&srv.silent, 1)
+	for i := 0; i < maxPipelineTimeouts; i++ {
+		_, err = u.Exchange(createTestMessage())
+		assert.NotNil(t, err)
+	}
+
+	// and a new one is dialed
+	atomic.StoreInt32(&srv.silent, 0)
+	resp, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+	total, _ := srv.handshakes()
+	assert.Equal(t, 2, total)
+}
+
+func TestTLSPoolGetPut(t *testing.T) {
+	srv := newTestDoTServer(t, "dns.corp")
+	defer srv.close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.port()))
+
+	u, err := AddressToUpstream("tls://"+addr+"?sni=dns.corp&insecure=true", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	pool := u.(*dnsOverTLS).pool
+
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	c := dns.Conn{Conn: conn}
+	assert.Nil(t, c.WriteMsg(createTestMessage()))
+	resp, err := c.ReadMsg()
+	assert.Nil(t, err)
+	assertResponse(t, resp)
+
+	// the returned connection is reused
+	pool.Put(conn)
+	reused, err := pool.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, conn, reused)
+
+	// the closed one is replaced
+	_ = reused.Close()
+	pool.Put(reused)
+	conn, err = pool.Get()
+	assert.Nil(t, err)
+	assert.NotEqual(t, reused, conn)
+	_ = conn.Close()
+}
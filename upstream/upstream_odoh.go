@@ -0,0 +1,457 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Oblivious DNS-over-HTTPS (RFC 9230)
+const (
+	odohVersion         = 0x0001
+	odohMessageQuery    = 0x01
+	odohMessageResponse = 0x02
+	odohContentType     = "application/oblivious-dns-message"
+	odohConfigsPath     = "/.well-known/odohconfigs"
+	odohPaddingBlock    = 128 // the queries are padded to a multiple of this size
+)
+
+//
+// Oblivious DNS-over-HTTPS
+//
+// The queries are encrypted with the target's public key and sent through the relay,
+// so the relay doesn't see them, and the target doesn't see the client's IP address.
+type dnsOverODoH struct {
+	address string   // the original address
+	target  *url.URL // the target's DOH URL
+
+	targetDoH *dnsOverHTTPS // fetches the target's configs, sends the queries if there's no relay
+	relayDoH  *dnsOverHTTPS // sends the queries to the relay, nil if there's none
+
+	config     *odohConfig // the target's config, lazily fetched
+	configLock sync.Mutex  // protects config
+}
+
+// newDNSOverODoH creates an ODoH upstream for the target URL (https://) and the relay (see Options.ODoHRelay)
+func newDNSOverODoH(address string, target *url.URL, opts Options) (*dnsOverODoH, error) {
+	if target.Port() == "" {
+		target.Host += ":443"
+	}
+	if target.Path == "" {
+		target.Path = "/dns-query"
+	}
+
+	// the DOH upstreams are used for the HTTP requests only
+	opts.DoHDisableWarmUp = true
+
+	targetBoot, err := urlToBoot(target.String(), opts)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't create the ODoH target bootstrapper")
+	}
+	p := &dnsOverODoH{address: address, target: target}
+	p.targetDoH, err = newDNSOverHTTPS(targetBoot, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ODoHRelay == "" {
+		log.Info("ODoH upstream %s has no relay, the target sees both the client IP address and the queries", address)
+		return p, nil
+	}
+
+	// ServerIP is the target's address
+	relayOpts := opts
+	relayOpts.ServerIP = nil
+	relayURL := opts.ODoHRelay
+	if strings.HasPrefix(relayURL, "sdns://") {
+		relayURL, relayOpts.ServerIP, err = parseODoHRelayStamp(relayURL)
+		if err != nil {
+			return nil, errorx.Decorate(err, "invalid ODoH relay stamp")
+		}
+	}
+	relay, err := url.Parse(relayURL)
+	if err != nil || relay.Scheme != "https" {
+		return nil, fmt.Errorf("invalid ODoH relay URL: %s", opts.ODoHRelay)
+	}
+	if relay.Port() == "" {
+		relay.Host += ":443"
+	}
+	relayBoot, err := urlToBoot(relay.String(), relayOpts)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't create the ODoH relay bootstrapper")
+	}
+	p.relayDoH, err = newDNSOverHTTPS(relayBoot, relayOpts)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *dnsOverODoH) Address() string { return p.address }
+
+// Weight implements the WeightedUpstream interface
+func (p *dnsOverODoH) Weight() int { return p.targetDoH.boot.weight }
+
+func (p *dnsOverODoH) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// ExchangeContext implements the ContextUpstream interface
+// If the target rejects the query or the response can't be decrypted, the target's key might have been rotated,
+// so the config is re-fetched and the query is retried.
+func (p *dnsOverODoH) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	config, err := p.getConfig(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := p.exchangeConfig(ctx, m, config)
+	if err == nil || ctx.Err() != nil || !isODoHKeyError(err) {
+		return reply, err
+	}
+
+	config, err = p.getConfig(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	return p.exchangeConfig(ctx, m, config)
+}
+
+// exchangeConfig encrypts the query with the config and sends it to the target
+func (p *dnsOverODoH) exchangeConfig(ctx context.Context, m *dns.Msg, config *odohConfig) (*dns.Msg, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't pack request msg")
+	}
+	query, err := config.encryptQuery(buf)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't encrypt the ODoH query")
+	}
+
+	doh := p.targetDoH
+	requestURL := p.target.String()
+	if p.relayDoH != nil {
+		doh = p.relayDoH
+		separator := "?"
+		if strings.Contains(doh.boot.address, "?") {
+			separator = "&"
+		}
+		params := url.Values{"targethost": {p.target.Hostname()}, "targetpath": {p.target.Path}}
+		requestURL = doh.boot.address + separator + params.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, requestURL, bytes.NewReader(query.message))
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't create a HTTP request to %s", requestURL)
+	}
+	req.Header.Set("Content-Type", odohContentType)
+	req.Header.Set("Accept", odohContentType)
+
+	body, err := doh.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err = query.decryptResponse(body)
+	if err != nil {
+		return nil, &odohKeyError{err: err}
+	}
+	reply := &dns.Msg{}
+	if err = reply.Unpack(buf); err != nil {
+		return nil, errorx.Decorate(err, "couldn't unpack DNS response from %s", p.address)
+	}
+	if reply.Id != m.Id {
+		return reply, dns.ErrId
+	}
+	return reply, nil
+}
+
+// getConfig returns the target's config, it's fetched if it's not known yet or if refresh is true
+func (p *dnsOverODoH) getConfig(ctx context.Context, refresh bool) (*odohConfig, error) {
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+	if p.config != nil && !refresh {
+		return p.config, nil
+	}
+
+	configsURL := &url.URL{Scheme: "https", Host: p.target.Host, Path: odohConfigsPath}
+	req, err := http.NewRequest(http.MethodGet, configsURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.targetDoH.do(ctx, req)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't fetch the ODoH configs from %s", configsURL)
+	}
+	p.config, err = parseODoHConfigs(body)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid ODoH configs from %s", configsURL)
+	}
+	return p.config, nil
+}
+
+// odohKeyError means that the target's key might have changed
+type odohKeyError struct {
+	err error
+}
+
+func (e *odohKeyError) Error() string {
+	return fmt.Sprintf("couldn't decrypt the ODoH response: %s", e.err)
+}
+
+// isODoHKeyError checks if the config must be re-fetched after the error:
+// the target responds with 401 if the key ID is unknown, and the response can't be decrypted if the key is wrong
+func isODoHKeyError(err error) bool {
+	switch e := err.(type) {
+	case *odohKeyError:
+		return true
+	case *httpStatusError:
+		return e.code == http.StatusUnauthorized || e.code == http.StatusBadRequest
+	case *errorx.Error:
+		return isODoHKeyError(e.Cause())
+	}
+	return false
+}
+
+// odohConfig is the target's public key and its ID
+type odohConfig struct {
+	publicKey []byte
+	keyID     []byte
+}
+
+// parseODoHConfigs returns the first config with the supported version and cipher suite from ObliviousDoHConfigs
+func parseODoHConfigs(data []byte) (*odohConfig, error) {
+	configs, rest, err := readPrefixed(data)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid configs length")
+	}
+
+	for len(configs) > 0 {
+		if len(configs) < 4 {
+			return nil, errors.New("invalid config header")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		var contents []byte
+		contents, configs, err = readPrefixed(configs[2:])
+		if err != nil {
+			return nil, errors.New("invalid config length")
+		}
+		if version != odohVersion || len(contents) < 6 {
+			continue
+		}
+
+		kem := binary.BigEndian.Uint16(contents)
+		kdf := binary.BigEndian.Uint16(contents[2:])
+		aead := binary.BigEndian.Uint16(contents[4:])
+		publicKey, rest, err := readPrefixed(contents[6:])
+		if err != nil || len(rest) != 0 {
+			return nil, errors.New("invalid public key length")
+		}
+		if kem != hpkeKEMX25519SHA256 || kdf != hpkeKDFSHA256 || aead != hpkeAEADAES128GCM || len(publicKey) != hpkeKeySize {
+			continue
+		}
+
+		prk := hkdf.Extract(sha256.New, contents, nil)
+		return &odohConfig{
+			publicKey: publicKey,
+			keyID:     hkdfExpand(prk, []byte("odoh key id"), hpkeNh),
+		}, nil
+	}
+	return nil, errors.New("no supported configs")
+}
+
+// odohQuery is an encrypted query, it keeps the secrets that are necessary to decrypt the response
+type odohQuery struct {
+	message []byte // ObliviousDoHMessage
+	plain   []byte // ObliviousDoHMessagePlaintext
+	context *hpkeContext
+}
+
+// encryptQuery pads and encrypts the DNS message
+func (c *odohConfig) encryptQuery(msg []byte) (*odohQuery, error) {
+	padding := (odohPaddingBlock - (len(msg)+4)%odohPaddingBlock) % odohPaddingBlock
+	plain := appendPrefixed(nil, msg)
+	plain = appendPrefixed(plain, make([]byte, padding))
+
+	enc, context, err := hpkeSetupBaseS(c.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+	aad := appendPrefixed([]byte{odohMessageQuery}, c.keyID)
+	encrypted := append(enc, context.seal(aad, plain)...)
+
+	message := appendPrefixed([]byte{odohMessageQuery}, c.keyID)
+	message = appendPrefixed(message, encrypted)
+	return &odohQuery{message: message, plain: plain, context: context}, nil
+}
+
+// decryptResponse decrypts the ObliviousDoHMessage and returns the DNS message
+func (q *odohQuery) decryptResponse(data []byte) ([]byte, error) {
+	if len(data) < 1 || data[0] != odohMessageResponse {
+		return nil, errors.New("not a response")
+	}
+	responseNonce, rest, err := readPrefixed(data[1:])
+	if err != nil {
+		return nil, errors.New("invalid nonce")
+	}
+	encrypted, rest, err := readPrefixed(rest)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid encrypted message")
+	}
+
+	secret := q.context.export([]byte("odoh response"), hpkeNk)
+	salt := appendPrefixed(append([]byte{}, q.plain...), responseNonce)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+	aead, err := newAESGCM(hkdfExpand(prk, []byte("odoh key"), hpkeNk))
+	if err != nil {
+		return nil, err
+	}
+	aad := appendPrefixed([]byte{odohMessageResponse}, responseNonce)
+	plain, err := aead.Open(nil, hkdfExpand(prk, []byte("odoh nonce"), hpkeNn), encrypted, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, _, err := readPrefixed(plain)
+	if err != nil || len(msg) == 0 {
+		return nil, errors.New("invalid plaintext")
+	}
+	return msg, nil
+}
+
+// readPrefixed reads the data with a 2-byte length prefix and returns the rest
+func readPrefixed(data []byte) (value, rest []byte, err error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("no length")
+	}
+	l := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+l {
+		return nil, nil, errors.New("data is too short")
+	}
+	return data[2 : 2+l], data[2+l:], nil
+}
+
+// appendPrefixed appends the value with a 2-byte length prefix
+func appendPrefixed(data, value []byte) []byte {
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(value)))
+	return append(append(data, l[:]...), value...)
+}
+
+// ODoH stamps types, they are not supported by dnsstamps yet
+const (
+	stampProtoTypeODoHTarget = 0x05
+	stampProtoTypeODoHRelay  = 0x85
+)
+
+// stampProto returns the protocol type of the sdns:// stamp and its raw contents after the type
+func stampProto(stamp string) (proto byte, raw []byte, err error) {
+	if !strings.HasPrefix(stamp, "sdns://") {
+		return 0, nil, errors.New("stamps are expected to start with sdns://")
+	}
+	raw, err = base64.RawURLEncoding.DecodeString(strings.TrimPrefix(stamp, "sdns://"))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(raw) < 1 {
+		return 0, nil, errors.New("stamp is too short")
+	}
+	return raw[0], raw[1:], nil
+}
+
+// parseODoHTargetStamp returns the target's https:// URL from the ODoH target stamp:
+// 0x05 || props || LP(hostname [:port]) || LP(path)
+func parseODoHTargetStamp(stamp string) (string, error) {
+	proto, raw, err := stampProto(stamp)
+	if err != nil {
+		return "", err
+	}
+	if proto != stampProtoTypeODoHTarget {
+		return "", errors.New("not an ODoH target stamp")
+	}
+	if len(raw) < 8 {
+		return "", errors.New("stamp is too short")
+	}
+	host, raw, err := readStampLP(raw[8:])
+	if err != nil {
+		return "", err
+	}
+	path, raw, err := readStampLP(raw)
+	if err != nil || len(raw) != 0 || host == "" {
+		return "", errors.New("invalid ODoH target stamp")
+	}
+	return "https://" + host + path, nil
+}
+
+// parseODoHRelayStamp returns the relay's https:// URL and its IP address (if any) from the ODoH relay stamp:
+// 0x85 || props || LP(addr) || VLP(hash1, hash2, ...) || LP(hostname [:port]) || LP(path) [ || VLP(bootstrap_ip1, ...) ]
+func parseODoHRelayStamp(stamp string) (relayURL string, serverIP net.IP, err error) {
+	proto, raw, err := stampProto(stamp)
+	if err != nil {
+		return "", nil, err
+	}
+	if proto != stampProtoTypeODoHRelay {
+		return "", nil, errors.New("not an ODoH relay stamp")
+	}
+	if len(raw) < 8 {
+		return "", nil, errors.New("stamp is too short")
+	}
+	addr, raw, err := readStampLP(raw[8:])
+	if err != nil {
+		return "", nil, err
+	}
+	// the certificates hashes are not used, the certificates are verified as usual
+	for more := true; more; {
+		if len(raw) < 1 {
+			return "", nil, errors.New("invalid hashes")
+		}
+		more = raw[0]&0x80 != 0
+		l := int(raw[0] & 0x7f)
+		if len(raw) < 1+l {
+			return "", nil, errors.New("invalid hashes")
+		}
+		raw = raw[1+l:]
+	}
+	host, raw, err := readStampLP(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	path, _, err := readStampLP(raw)
+	if err != nil || host == "" {
+		return "", nil, errors.New("invalid ODoH relay stamp")
+	}
+
+	if addr != "" {
+		ip, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			ip = strings.Trim(addr, "[]")
+		}
+		serverIP = net.ParseIP(ip)
+		if serverIP == nil {
+			return "", nil, fmt.Errorf("invalid relay address in the stamp: %s", addr)
+		}
+	}
+	return "https://" + host + path, serverIP, nil
+}
+
+// readStampLP reads a string with a 1-byte length prefix and returns the rest
+func readStampLP(data []byte) (value string, rest []byte, err error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", nil, errors.New("stamp is too short")
+	}
+	return string(data[1 : 1+data[0]]), data[1+data[0]:], nil
+}
@@ -0,0 +1,262 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// testODoHTarget is a local ODoH target that answers A requests with 8.8.8.8 (see assertResponse)
+type testODoHTarget struct {
+	*httptest.Server
+
+	sync.Mutex
+	privateKey [hpkeKeySize]byte
+	configs    []byte // ObliviousDoHConfigs
+	keyID      []byte
+	queries    int // number of the queries that were decrypted
+}
+
+func newTestODoHTarget() *testODoHTarget {
+	s := &testODoHTarget{}
+	s.rotateKey()
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// rotateKey generates a new key pair
+func (s *testODoHTarget) rotateKey() {
+	s.Lock()
+	defer s.Unlock()
+
+	var publicKey [hpkeKeySize]byte
+	_, _ = rand.Read(s.privateKey[:])
+	curve25519.ScalarBaseMult(&publicKey, &s.privateKey)
+
+	contents := []byte{0x00, 0x20, 0x00, 0x01, 0x00, 0x01}
+	contents = appendPrefixed(contents, publicKey[:])
+	config := appendPrefixed([]byte{0x00, 0x01}, contents)
+	s.configs = appendPrefixed(nil, config)
+	s.keyID = hkdfExpand(hkdf.Extract(sha256.New, contents, nil), []byte("odoh key id"), hpkeNh)
+}
+
+func (s *testODoHTarget) handle(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.URL.Path == odohConfigsPath {
+		_, _ = w.Write(s.configs)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != odohContentType || len(body) < 1 || body[0] != odohMessageQuery {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	keyID, rest, err := readPrefixed(body[1:])
+	if err != nil || !bytes.Equal(keyID, s.keyID) {
+		http.Error(w, "unknown key", http.StatusUnauthorized)
+		return
+	}
+	encrypted, _, err := readPrefixed(rest)
+	if err != nil || len(encrypted) < hpkeKeySize {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+
+	// HPKE receiver
+	var enc, publicKey, dh [hpkeKeySize]byte
+	copy(enc[:], encrypted)
+	curve25519.ScalarBaseMult(&publicKey, &s.privateKey)
+	curve25519.ScalarMult(&dh, &s.privateKey, &enc)
+	sharedSecret := hpkeExtractAndExpand(dh[:], append(enc[:], publicKey[:]...))
+	context, _ := hpkeKeySchedule(sharedSecret, []byte("odoh query"))
+	plain, err := context.open(appendPrefixed([]byte{odohMessageQuery}, keyID), encrypted[hpkeKeySize:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buf, _, _ := readPrefixed(plain)
+	req := &dns.Msg{}
+	if err = req.Unpack(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.queries++
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{8, 8, 8, 8},
+	}}
+	buf, _ = resp.Pack()
+	responsePlain := appendPrefixed(nil, buf)
+	responsePlain = appendPrefixed(responsePlain, nil)
+
+	nonce := make([]byte, hpkeNk)
+	_, _ = rand.Read(nonce)
+	secret := context.export([]byte("odoh response"), hpkeNk)
+	prk := hkdf.Extract(sha256.New, secret, appendPrefixed(plain, nonce))
+	aead, _ := newAESGCM(hkdfExpand(prk, []byte("odoh key"), hpkeNk))
+	aad := appendPrefixed([]byte{odohMessageResponse}, nonce)
+	sealed := aead.Seal(nil, hkdfExpand(prk, []byte("odoh nonce"), hpkeNn), responsePlain, aad)
+
+	message := appendPrefixed([]byte{odohMessageResponse}, nonce)
+	message = appendPrefixed(message, sealed)
+	w.Header().Set("Content-Type", odohContentType)
+	_, _ = w.Write(message)
+}
+
+func (s *testODoHTarget) decrypted() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queries
+}
+
+// testODoHRelay is a local ODoH relay that forwards the queries to the test target
+// The target's address is known in advance, because the target's port can't be passed to the relay.
+type testODoHRelay struct {
+	*httptest.Server
+	target *testODoHTarget
+
+	sync.Mutex
+	requests []*http.Request
+}
+
+func newTestODoHRelay(target *testODoHTarget) *testODoHRelay {
+	s := &testODoHRelay{target: target}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *testODoHRelay) handle(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.requests = append(s.requests, r)
+	s.Unlock()
+
+	targetURL := s.target.URL + r.URL.Query().Get("targetpath")
+	req, _ := http.NewRequest(http.MethodPost, targetURL, r.Body)
+	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(body)
+}
+
+func (s *testODoHRelay) received() []*http.Request {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*http.Request{}, s.requests...)
+}
+
+func TestODoH(t *testing.T) {
+	target := newTestODoHTarget()
+	defer target.Close()
+	relay := newTestODoHRelay(target)
+	defer relay.Close()
+
+	targetURL, _ := url.Parse(target.URL)
+	relayURL, _ := url.Parse(relay.URL)
+
+	// directly to the target
+	u, err := AddressToUpstream("odoh://"+targetURL.Host+"/dns-query?insecure=true", Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	checkUpstream(t, u, u.Address())
+	assert.Equal(t, 1, target.decrypted())
+
+	// through the relay
+	u, err = AddressToUpstream("odoh://"+targetURL.Host+"/dns-query?insecure=true&relay="+
+		url.QueryEscape(relay.URL+"/proxy"), Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	checkUpstream(t, u, u.Address())
+	assert.Equal(t, 2, target.decrypted())
+
+	requests := relay.received()
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "/proxy", requests[0].URL.Path)
+	assert.Equal(t, "127.0.0.1", requests[0].URL.Query().Get("targethost"))
+	assert.Equal(t, "/dns-query", requests[0].URL.Query().Get("targetpath"))
+	assert.Equal(t, odohContentType, requests[0].Header.Get("Content-Type"))
+
+	// the target's key is rotated, the config must be re-fetched
+	target.rotateKey()
+	checkUpstream(t, u, u.Address())
+	assert.Equal(t, 3, target.decrypted())
+
+	// the stamps
+	targetStamp := append([]byte{stampProtoTypeODoHTarget}, make([]byte, 8)...)
+	targetStamp = appendStampLP(targetStamp, targetURL.Host)
+	targetStamp = appendStampLP(targetStamp, "/dns-query")
+	relayStamp := append([]byte{stampProtoTypeODoHRelay}, make([]byte, 8)...)
+	relayStamp = appendStampLP(relayStamp, "127.0.0.1")
+	relayStamp = append(relayStamp, 0x00) // no hashes
+	relayStamp = appendStampLP(relayStamp, "relay.example:"+relayURL.Port())
+	relayStamp = appendStampLP(relayStamp, "/proxy")
+
+	u, err = AddressToUpstream("sdns://"+base64.RawURLEncoding.EncodeToString(targetStamp), Options{
+		Timeout:            time.Second,
+		InsecureSkipVerify: true,
+		ODoHRelay:          "sdns://" + base64.RawURLEncoding.EncodeToString(relayStamp),
+	})
+	assert.Nil(t, err)
+	checkUpstream(t, u, u.Address())
+	assert.Equal(t, 4, target.decrypted())
+	// the query was rejected once after the key rotation
+	assert.Equal(t, 4, len(relay.received()))
+
+	// the relay stamp can't be used as an upstream
+	relayAddr := "sdns://" + base64.RawURLEncoding.EncodeToString(relayStamp)
+	_, err = AddressToUpstream(relayAddr, Options{})
+	assert.EqualError(t, err, relayAddr+" is an ODoH relay stamp, use it as the relay of an ODoH upstream (?relay= or Options.ODoHRelay)")
+}
+
+func TestODoHConfigs(t *testing.T) {
+	target := &testODoHTarget{}
+	target.rotateKey()
+
+	config, err := parseODoHConfigs(target.configs)
+	assert.Nil(t, err)
+	assert.Equal(t, target.keyID, config.keyID)
+
+	// unsupported configs are skipped
+	unsupported := appendPrefixed([]byte{0x00, 0x02}, []byte{0x00})
+	configs, _, _ := readPrefixed(target.configs)
+	_, err = parseODoHConfigs(appendPrefixed(nil, unsupported))
+	assert.NotNil(t, err)
+	config, err = parseODoHConfigs(appendPrefixed(nil, append(unsupported, configs...)))
+	assert.Nil(t, err)
+	assert.Equal(t, target.keyID, config.keyID)
+
+	_, err = parseODoHConfigs([]byte{0x00, 0x10, 0x00})
+	assert.NotNil(t, err)
+
+	// the queries are padded
+	query, err := config.encryptQuery(make([]byte, 30))
+	assert.Nil(t, err)
+	assert.Equal(t, odohPaddingBlock, len(query.plain))
+	assert.Equal(t, uint16(30), binary.BigEndian.Uint16(query.plain))
+}
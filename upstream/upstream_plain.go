@@ -1,6 +1,12 @@
 package upstream
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -11,28 +17,246 @@ import (
 // plain DNS
 //
 type plainDNS struct {
+	// the time (in Unix nanoseconds) until which the case randomization is disabled, 0 if it's enabled
+	// It's the first field to keep it 64-bit aligned for the atomic operations.
+	caseDisabledUntil int64
+
 	address   string
 	timeout   time.Duration
+	weight    int
 	preferTCP bool
+
+	maxConns    int           // maximum number of the persistent TCP connections (see Options.MaxConns)
+	idleTimeout time.Duration // idle TCP connections timeout (see Options.IdleTimeout)
+	proxyDial   dialHandler   // dials the TCP connections through the proxy (see Options.Proxy), nil if there's none
+	bind        bindOptions   // local address and interface of the connections
+
+	randomizeCase  bool  // randomize the query name case (see Options.RandomizeCase)
+	caseMismatches int32 // number of the replies in a row that didn't preserve the case
+	caseFolding    int32 // how the case of the last mismatching reply was changed (caseFoldingLower or caseFoldingUpper)
+
+	tcpPool     *pipelinePool // persistent TCP connections, lazily initialized
+	tcpPoolOnce sync.Once
+}
+
+// newPlainDNS creates a plain DNS upstream with the specified options
+// Only TCP upstreams can be used through a proxy.
+func newPlainDNS(address string, opts Options, preferTCP bool) (Upstream, error) {
+	bind, err := newBindOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plainDNS{
+		address:     address,
+		timeout:     opts.Timeout,
+		weight:      opts.Weight,
+		preferTCP:   preferTCP,
+		maxConns:    opts.MaxConns,
+		idleTimeout: opts.IdleTimeout,
+		bind:        bind,
+
+		randomizeCase: opts.RandomizeCase,
+	}
+
+	if opts.Proxy != "" {
+		if !preferTCP {
+			return nil, fmt.Errorf("plain DNS over UDP can't be used through a proxy, use tcp://%s instead", address)
+		}
+
+		p.proxyDial, err = newProxyDialer(opts.Proxy, bind.dialer("tcp", p.dialTimeout()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
 }
 
 // Address returns the original address that we've put in initially, not resolved one
 func (p *plainDNS) Address() string { return p.address }
 
+// Weight implements the WeightedUpstream interface
+func (p *plainDNS) Weight() int { return p.weight }
+
 func (p *plainDNS) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// ExchangeContext implements the ContextUpstream interface
+func (p *plainDNS) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
 	if p.preferTCP {
-		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
-		reply, _, tcpErr := tcpClient.Exchange(m, p.address)
-		return reply, tcpErr
+		return p.exchange(ctx, "tcp", m)
 	}
 
-	client := dns.Client{Timeout: p.timeout, UDPSize: dns.MaxMsgSize}
-	reply, _, err := client.Exchange(m, p.address)
+	reply, err := p.exchangeUDP(ctx, m)
 	if reply != nil && reply.Truncated {
+		// the connection is not kept, as the upstream is expected to be used over UDP
 		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
-		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
-		reply, _, err = tcpClient.Exchange(m, p.address)
+		reply, err = p.exchangeOnce(ctx, "tcp", m)
 	}
 
 	return reply, err
 }
+
+// exchangeUDP sends the message over UDP with the query name case randomized if it's enabled (see Options.RandomizeCase)
+// The reply is rejected if its question case doesn't match the query exactly, the original case is restored in the reply.
+// The replies without the question (i.e. REFUSED) are accepted as there's nothing to check but the ID.
+func (p *plainDNS) exchangeUDP(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if !p.randomizeCase || p.caseRandomizationDisabled() || len(m.Question) != 1 || !hasLetters(m.Question[0].Name) {
+		return p.exchange(ctx, "udp", m)
+	}
+
+	original := m.Question[0].Name
+	req := m.Copy()
+	req.Question[0].Name = randomizeCase(original)
+	reply, err := p.exchange(ctx, "udp", req)
+	if err != nil {
+		return nil, err
+	}
+
+	randomized := req.Question[0].Name
+	if len(reply.Question) == 0 {
+		// FORMERR, REFUSED, NOTIMP, etc may have no question, there's nothing to check but the ID,
+		// so such replies are accepted only if they carry no records
+		if reply.Rcode == dns.RcodeSuccess || len(reply.Answer) != 0 || len(reply.Ns) != 0 {
+			return nil, errCaseMismatch
+		}
+		reply.Question = []dns.Question{m.Question[0]}
+		restoreCase(reply, randomized, original)
+		return reply, nil
+	}
+	if len(reply.Question) != 1 {
+		return nil, errCaseMismatch
+	}
+	if reply.Question[0].Name != randomized {
+		p.caseMismatch(reply.Question[0].Name, randomized)
+		return nil, errCaseMismatch
+	}
+	atomic.StoreInt32(&p.caseMismatches, 0)
+
+	restoreCase(reply, randomized, original)
+	return reply, nil
+}
+
+// caseRandomizationDisabled checks if the case randomization is disabled for the upstream,
+// it's enabled again after caseDisabledPeriod
+func (p *plainDNS) caseRandomizationDisabled() bool {
+	until := atomic.LoadInt64(&p.caseDisabledUntil)
+	if until == 0 {
+		return false
+	}
+	if time.Now().UnixNano() < until {
+		return true
+	}
+	if atomic.CompareAndSwapInt64(&p.caseDisabledUntil, until, 0) {
+		atomic.StoreInt32(&p.caseMismatches, 0)
+		log.Info("The case randomization is enabled again for upstream %s", p.address)
+	}
+	return false
+}
+
+// caseMismatch counts the replies that don't preserve the query name case
+// Only the replies with the name lowercased or uppercased the same way every time are counted, so that
+// the spoofed replies with a random case can't disable the randomization for the upstream.
+func (p *plainDNS) caseMismatch(name, randomized string) {
+	var folding int32
+	switch name {
+	case strings.ToLower(randomized):
+		folding = caseFoldingLower
+	case strings.ToUpper(randomized):
+		folding = caseFoldingUpper
+	default:
+		atomic.StoreInt32(&p.caseMismatches, 0)
+		return
+	}
+	if atomic.SwapInt32(&p.caseFolding, folding) != folding {
+		atomic.StoreInt32(&p.caseMismatches, 0)
+	}
+
+	if atomic.AddInt32(&p.caseMismatches, 1) >= maxCaseMismatches &&
+		atomic.CompareAndSwapInt64(&p.caseDisabledUntil, 0, time.Now().Add(caseDisabledPeriod).UnixNano()) {
+		log.Info("Upstream %s doesn't preserve the query name case, the case randomization is disabled for it for %s",
+			p.address, caseDisabledPeriod)
+	}
+}
+
+// exchange sends the message over the specified network
+// TCP queries are pipelined over the persistent connections.
+func (p *plainDNS) exchange(ctx context.Context, network string, m *dns.Msg) (*dns.Msg, error) {
+	if network == "tcp" {
+		return p.pool().exchange(ctx, m, p.timeout)
+	}
+	return p.exchangeOnce(ctx, network, m)
+}
+
+// exchangeOnce sends the message over a new connection
+// The connection is closed as soon as the context is done so that the exchange is interrupted.
+func (p *plainDNS) exchangeOnce(ctx context.Context, network string, m *dns.Msg) (*dns.Msg, error) {
+	client := dns.Client{Net: network, Timeout: p.timeout, Dialer: p.bind.dialer(network, p.dialTimeout())}
+	conn, err := client.Dial(p.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	} else {
+		conn.UDPSize = dns.MaxMsgSize
+	}
+
+	if p.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(p.timeout))
+	}
+	err = conn.WriteMsg(m)
+	if err == nil {
+		var reply *dns.Msg
+		reply, err = conn.ReadMsg()
+		if err == nil && reply.Id != m.Id {
+			err = dns.ErrId
+		}
+		if err == nil {
+			return reply, nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, err
+}
+
+// pool returns the persistent TCP connections pool
+func (p *plainDNS) pool() *pipelinePool {
+	p.tcpPoolOnce.Do(func() {
+		p.tcpPool = newPipelinePool(p.dialTCP, p.maxConns, p.idleTimeout)
+	})
+	return p.tcpPool
+}
+
+// dialTCP opens a new TCP connection to the upstream
+func (p *plainDNS) dialTCP(ctx context.Context) (net.Conn, error) {
+	if p.proxyDial != nil {
+		return p.proxyDial(ctx, "tcp", p.address)
+	}
+	return p.bind.dialer("tcp", p.dialTimeout()).DialContext(ctx, "tcp", p.address)
+}
+
+// dialTimeout returns the TCP connection timeout
+func (p *plainDNS) dialTimeout() time.Duration {
+	if p.timeout == 0 {
+		return dialTimeout
+	}
+	return p.timeout
+}
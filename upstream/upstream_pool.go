@@ -9,35 +9,48 @@ import (
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
 )
 
 const dialTimeout = 10 * time.Second
 
-// TLSPool is a connections pool for the DNS-over-TLS Upstream.
+// TLSPool is a bounded connections pool for the DNS-over-TLS Upstream.
+// Every connection carries several queries at once, the responses are matched by the message IDs.
+// A new connection is opened only if all the pooled connections are busy, and there are no more than
+// Options.MaxConns of them. Idle connections are closed after Options.IdleTimeout.
+// TLS sessions are resumed when the connections are re-dialed.
 //
 // Example:
-//  pool := TLSPool{Address: "tls://1.1.1.1:853"}
-//  netConn, err := pool.Get()
-//  if err != nil {panic(err)}
-//  c := dns.Conn{Conn: netConn}
+//  pool := newTLSPool(boot, Options{})
 //  q := dns.Msg{}
 //  q.SetQuestion("google.com.", dns.TypeA)
-//  log.Println(q)
-//  err = c.WriteMsg(&q)
-//  if err != nil {panic(err)}
-//  r, err := c.ReadMsg()
+//  r, err := pool.Exchange(context.Background(), &q)
 //  if err != nil {panic(err)}
 //  log.Println(r)
-//  pool.Put(c.Conn)
 type TLSPool struct {
 	boot *bootstrapper
+	pool *pipelinePool
 
-	// connections
+	// connections returned with Put, they are not shared with the pipelined queries
 	conns      []net.Conn
 	connsMutex sync.Mutex // protects conns
 }
 
-// Get gets or creates a new TLS connection
+// newTLSPool creates a new pool with the specified options (see Options.MaxConns and Options.IdleTimeout)
+func newTLSPool(boot *bootstrapper, opts Options) *TLSPool {
+	n := &TLSPool{boot: boot}
+	n.pool = newPipelinePool(n.dial, opts.MaxConns, opts.IdleTimeout)
+	return n
+}
+
+// Exchange sends the DNS message over one of the pooled connections and waits for the response
+func (n *TLSPool) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return n.pool.exchange(ctx, m, n.boot.timeout)
+}
+
+// Get gets a connection returned with Put or creates a new one
+//
+// Deprecated: use Exchange. The connections are dedicated and aren't used for the pipelined queries.
 func (n *TLSPool) Get() (net.Conn, error) {
 	// get the connection from the slice inside the lock
 	var c net.Conn
@@ -64,22 +77,21 @@ func (n *TLSPool) Get() (net.Conn, error) {
 	return n.Create()
 }
 
-// Create creates a new connection for the pool (but not puts it there)
+// Create creates a new connection (but not puts it to the pool)
+//
+// Deprecated: use Exchange.
 func (n *TLSPool) Create() (net.Conn, error) {
-	tlsConfig, dialContext, err := n.boot.get()
+	conn, err := n.dial(context.Background())
 	if err != nil {
 		return nil, err
 	}
-
-	// we'll need a new connection, dial now
-	conn, err := tlsDial(dialContext, "tcp", tlsConfig)
-	if err != nil {
-		return nil, errorx.Decorate(err, "Failed to connect to %s", tlsConfig.ServerName)
-	}
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
 	return conn, nil
 }
 
-// Put returns connection to the pool
+// Put returns the connection created with Get or Create to the pool
+//
+// Deprecated: use Exchange.
 func (n *TLSPool) Put(c net.Conn) {
 	if c == nil {
 		return
@@ -89,10 +101,25 @@ func (n *TLSPool) Put(c net.Conn) {
 	n.connsMutex.Unlock()
 }
 
+// dial creates a new connection for the pool
+func (n *TLSPool) dial(ctx context.Context) (net.Conn, error) {
+	tlsConfig, dialContext, err := n.boot.get()
+	if err != nil {
+		return nil, err
+	}
+
+	// we'll need a new connection, dial now
+	conn, err := tlsDial(ctx, dialContext, "tcp", tlsConfig)
+	if err != nil {
+		return nil, errorx.Decorate(err, "Failed to connect to %s", tlsConfig.ServerName)
+	}
+	return conn, nil
+}
+
 // tlsDial is basically the same as tls.DialWithDialer, but we will call our own dialContext function to get connection
-func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.Conn, error) {
+func tlsDial(ctx context.Context, dialContext dialHandler, network string, config *tls.Config) (*tls.Conn, error) {
 	// we're using bootstrapped address instead of what's passed to the function
-	rawConn, err := dialContext(context.TODO(), network, "")
+	rawConn, err := dialContext(ctx, network, "")
 	if err != nil {
 		return nil, err
 	}
@@ -112,5 +139,8 @@ func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.
 		conn.Close()
 		return nil, err
 	}
+
+	// the deadlines are managed by the pool from now on
+	_ = conn.SetDeadline(time.Time{})
 	return conn, nil
 }
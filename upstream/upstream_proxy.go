@@ -0,0 +1,109 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"golang.org/x/net/proxy"
+)
+
+// newProxyDialer creates a dialHandler that opens TCP connections through the proxy server (see Options.Proxy)
+// Supported proxies are socks5://[user:password@]host[:port] and http://[user:password@]host[:port] (HTTP CONNECT).
+// forward is used to connect to the proxy.
+func newProxyDialer(proxyURL string, forward *net.Dialer) (dialHandler, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid proxy URL %s", proxyURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %s: no host", proxyURL)
+	}
+
+	var dial dialHandler
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, forward)
+		if err != nil {
+			return nil, errorx.Decorate(err, "couldn't create a SOCKS5 dialer for %s", proxyURL)
+		}
+		dial = d.(proxy.ContextDialer).DialContext
+	case "http":
+		d := &httpConnectDialer{forward: forward, proxyAddr: u.Host}
+		if u.Port() == "" {
+			d.proxyAddr = net.JoinHostPort(u.Hostname(), "80")
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+		}
+		dial = d.DialContext
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "tcp" {
+			return nil, fmt.Errorf("%s connections can't be opened through the proxy %s", network, u.Host)
+		}
+		return dial(ctx, network, addr)
+	}, nil
+}
+
+// httpConnectDialer opens TCP connections through an HTTP proxy using the CONNECT method
+type httpConnectDialer struct {
+	forward   *net.Dialer // dials the proxy
+	proxyAddr string      // host:port of the proxy
+	auth      string      // Proxy-Authorization header value, if any
+}
+
+// DialContext connects to addr through the proxy
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't connect to the proxy %s", d.proxyAddr)
+	}
+
+	// the dial timeout covers the CONNECT request too
+	deadline, ok := ctx.Deadline()
+	if !ok && d.forward.Timeout > 0 {
+		deadline = time.Now().Add(d.forward.Timeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errorx.Decorate(err, "couldn't send the CONNECT request to the proxy %s", d.proxyAddr)
+	}
+
+	// the DNS clients always speak first, so nothing can be buffered after the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, errorx.Decorate(err, "couldn't read the CONNECT response from the proxy %s", d.proxyAddr)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("the proxy %s refused to connect to %s: %s", d.proxyAddr, addr, resp.Status)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,214 @@
+package upstream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testProxy is a local SOCKS5 or HTTP CONNECT proxy without authentication
+type testProxy struct {
+	listener net.Listener
+	socks    bool
+
+	targets []string // the addresses the clients asked to connect to
+	sync.Mutex
+}
+
+func newTestProxy(t *testing.T, socks bool) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	p := &testProxy{listener: l, socks: socks}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testProxy) url() string {
+	if p.socks {
+		return "socks5://" + p.listener.Addr().String()
+	}
+	return "http://" + p.listener.Addr().String()
+}
+
+func (p *testProxy) close() {
+	_ = p.listener.Close()
+}
+
+func (p *testProxy) received() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.targets...)
+}
+
+func (p *testProxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var target string
+	var err error
+	if p.socks {
+		target, err = p.socksHandshake(conn)
+	} else {
+		target, err = p.connectHandshake(conn)
+	}
+	if err != nil {
+		return
+	}
+
+	p.Lock()
+	p.targets = append(p.targets, target)
+	p.Unlock()
+
+	upstreamConn, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstreamConn.Close()
+
+	if p.socks {
+		_, err = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	} else {
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}
+	if err != nil {
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(upstreamConn, conn)
+		_ = upstreamConn.Close()
+	}()
+	_, _ = io.Copy(conn, upstreamConn)
+}
+
+// socksHandshake reads the SOCKS5 greeting and CONNECT request (RFC 1928)
+func (p *testProxy) socksHandshake(conn net.Conn) (string, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, buf[1])); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	var host string
+	switch header[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", io.ErrUnexpectedEOF
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// connectHandshake reads the HTTP CONNECT request
+func (p *testProxy) connectHandshake(conn net.Conn) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect {
+		return "", io.ErrUnexpectedEOF
+	}
+	return req.Host, nil
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	tcpSrv := newTestTCPServer(t)
+	defer tcpSrv.close()
+	dotSrv := newTestDoTServer(t, "dns.corp")
+	defer dotSrv.close()
+	dotAddr := net.JoinHostPort("localhost", strconv.Itoa(dotSrv.port()))
+	dohSrv := newTestDoHServer(t)
+	defer dohSrv.Close()
+	cryptSrv := newTestDNSCryptServer(t)
+	defer cryptSrv.close()
+	cryptAddr := cryptSrv.stamp.ServerAddrStr
+
+	for _, socks := range []bool{true, false} {
+		p := newTestProxy(t, socks)
+
+		// plain DNS over TCP
+		u, err := AddressToUpstream("tcp://"+tcpSrv.addr(), Options{Timeout: time.Second, Proxy: p.url()})
+		assert.Nil(t, err)
+		resp, err := u.Exchange(createTestMessage())
+		assert.Nil(t, err)
+		assertResponse(t, resp)
+
+		// DNS-over-TLS, the hostname is resolved by the proxy
+		u, err = AddressToUpstream("tls://"+dotAddr+"?sni=dns.corp&insecure=true&proxy="+url.QueryEscape(p.url()),
+			Options{Timeout: time.Second, Bootstrap: []string{"127.0.0.1:1"}})
+		assert.Nil(t, err)
+		resp, err = u.Exchange(createTestMessage())
+		assert.Nil(t, err)
+		assertResponse(t, resp)
+
+		// DNS-over-HTTPS
+		u, err = AddressToUpstream(dohSrv.URL+"/dns-query?insecure=true&warmup=false", Options{Timeout: time.Second, Proxy: p.url()})
+		assert.Nil(t, err)
+		resp, err = u.Exchange(createTestMessage())
+		assert.Nil(t, err)
+		assertResponse(t, resp)
+
+		// DNSCrypt over TCP, the certificate is fetched directly
+		u, err = AddressToUpstream(cryptSrv.stamp.String(), Options{Timeout: time.Second, Proxy: p.url()})
+		assert.Nil(t, err)
+		resp, err = u.Exchange(createTestMessage())
+		assert.Nil(t, err)
+		assertResponse(t, resp)
+
+		assert.Equal(t, []string{tcpSrv.addr(), dotAddr, dohSrv.Listener.Addr().String(), cryptAddr}, p.received())
+		p.close()
+	}
+
+	// plain DNS over UDP can't be used through a proxy
+	_, err := AddressToUpstream("8.8.8.8", Options{Proxy: "socks5://127.0.0.1:1080"})
+	assert.NotNil(t, err)
+
+	// unsupported proxy
+	_, err = AddressToUpstream("tcp://8.8.8.8", Options{Proxy: "ftp://127.0.0.1"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,191 @@
+package upstream
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultResolvConfPath   = "/etc/resolv.conf"
+	resolvConfCheckInterval = time.Second // the file is checked for changes not more often than this
+)
+
+// SearchDomainsUpstream is an Upstream that is meant for the specific domains only,
+// e.g. the local network's nameservers (see AddressToUpstream, resolvconf://)
+type SearchDomainsUpstream interface {
+	Upstream
+
+	// SearchDomains returns the domains that should be resolved with this upstream
+	SearchDomains() []string
+}
+
+//
+// resolv.conf
+//
+// The queries are sent to the nameservers from the file in turn, the file is re-read when it changes.
+type resolvConf struct {
+	address string  // the original address
+	path    string  // the resolv.conf path
+	opts    Options // the nameservers options
+
+	lock        sync.Mutex
+	nameservers []Upstream
+	search      []string
+	modTime     time.Time // the file's modification time when it was read
+	size        int64     // the file's size when it was read
+	checked     time.Time // last time the file was checked for changes
+}
+
+// newResolvConf reads the nameservers and the search domains from the file
+func newResolvConf(address, path string, opts Options) (*resolvConf, error) {
+	if path == "" {
+		path = defaultResolvConfPath
+	}
+	p := &resolvConf{address: address, path: path, opts: opts}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.load(fi); err != nil {
+		return nil, err
+	}
+	if len(p.nameservers) == 0 {
+		log.Info("No nameservers in %s yet", path)
+	}
+	return p, nil
+}
+
+func (p *resolvConf) Address() string { return p.address }
+
+// SearchDomains implements the SearchDomainsUpstream interface
+func (p *resolvConf) SearchDomains() []string {
+	p.reload()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string{}, p.search...)
+}
+
+func (p *resolvConf) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	p.reload()
+	p.lock.Lock()
+	nameservers := p.nameservers
+	p.lock.Unlock()
+
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("no nameservers in %s", p.path)
+	}
+
+	var errs []error
+	for _, u := range nameservers {
+		reply, err := u.Exchange(m)
+		if err == nil {
+			return reply, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errorx.DecorateMany(fmt.Sprintf("all nameservers from %s failed", p.path), errs...)
+}
+
+// reload re-reads the file if it's changed
+// If the file can't be read, the last known nameservers are used.
+func (p *resolvConf) reload() {
+	p.lock.Lock()
+	if time.Since(p.checked) < resolvConfCheckInterval {
+		p.lock.Unlock()
+		return
+	}
+	p.checked = time.Now()
+	modTime, size := p.modTime, p.size
+	p.lock.Unlock()
+
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		log.Debug("Couldn't check %s for changes: %s", p.path, err)
+		return
+	}
+	if fi.ModTime().Equal(modTime) && fi.Size() == size {
+		return
+	}
+	if err = p.load(fi); err != nil {
+		log.Info("Couldn't reload %s, using the last known nameservers: %s", p.path, err)
+		return
+	}
+	log.Info("Reloaded %s", p.path)
+}
+
+// load reads the file, fi is its state before reading
+func (p *resolvConf) load(fi os.FileInfo) error {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	addrs, search, err := parseResolvConf(data)
+	if err != nil {
+		return errorx.Decorate(err, "invalid %s", p.path)
+	}
+
+	var nameservers []Upstream
+	for _, addr := range addrs {
+		u, err := newPlainDNS(addr, p.opts, false)
+		if err != nil {
+			return err
+		}
+		nameservers = append(nameservers, u)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.nameservers = nameservers
+	p.search = search
+	p.modTime, p.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+// parseResolvConf returns the nameservers addresses (host:port) and the search domains from resolv.conf
+// The nameservers are IP addresses, the port may be specified as [IP]:port.
+// The last of the search and domain lines wins.
+func parseResolvConf(data []byte) (nameservers, search []string, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			addr := fields[1]
+			if host, port, err := net.SplitHostPort(addr); err == nil && strings.HasPrefix(addr, "[") {
+				addr = net.JoinHostPort(host, port)
+			} else {
+				addr = net.JoinHostPort(addr, "53")
+			}
+			host, _, _ := net.SplitHostPort(addr)
+			// the IPv6 addresses may have a zone
+			if net.ParseIP(strings.SplitN(host, "%", 2)[0]) == nil {
+				return nil, nil, fmt.Errorf("invalid nameserver %s", fields[1])
+			}
+			nameservers = append(nameservers, addr)
+		case "search":
+			search = fields[1:]
+		case "domain":
+			search = fields[1:2]
+		}
+	}
+	return nameservers, search, scanner.Err()
+}
@@ -0,0 +1,84 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	data := `# generated by dhcpcd
+domain corp.example
+search lan home.arpa ; the last one wins
+nameserver 192.168.1.1
+nameserver fe80::1%eth0
+nameserver [::1]:5353
+options edns0
+`
+	nameservers, search, err := parseResolvConf([]byte(data))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.1.1:53", "[fe80::1%eth0]:53", "[::1]:5353"}, nameservers)
+	assert.Equal(t, []string{"lan", "home.arpa"}, search)
+
+	_, _, err = parseResolvConf([]byte("nameserver dns.example\n"))
+	assert.NotNil(t, err)
+}
+
+func TestResolvConf(t *testing.T) {
+	s1 := newTestBootstrapServer(t)
+	defer func() { _ = s1.Shutdown() }()
+	s2 := newTestBootstrapServer(t)
+	defer func() { _ = s2.Shutdown() }()
+
+	dir, err := ioutil.TempDir("", "resolvconf")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resolv.conf")
+	write := func(data string) {
+		assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	write("search lan\nnameserver [127.0.0.1]:" + port(s1.addr()) + "\n")
+
+	u, err := AddressToUpstream("resolvconf://"+path+"?timeout=1s", Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, "resolvconf://"+path, u.Address())
+	assert.Equal(t, []string{"lan"}, u.(SearchDomainsUpstream).SearchDomains())
+
+	req := &dns.Msg{}
+	req.SetQuestion("printer.lan.", dns.TypeA)
+	_, err = u.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, s1.count())
+
+	// the file is changed, the new nameservers are used in turn
+	dead, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	_ = dead.Close()
+	write("search home.arpa\nnameserver [127.0.0.1]:" + port(dead.LocalAddr().String()) + "\nnameserver [127.0.0.1]:" + port(s2.addr()) + "\n")
+	u.(*resolvConf).checked = time.Time{}
+	_, err = u.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, s1.count())
+	assert.Equal(t, 1, s2.count())
+	assert.Equal(t, []string{"home.arpa"}, u.(SearchDomainsUpstream).SearchDomains())
+
+	// the invalid file is ignored
+	write("nameserver dns.example\n")
+	u.(*resolvConf).checked = time.Time{}
+	_, err = u.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, s2.count())
+
+	_, err = AddressToUpstream("resolvconf://"+filepath.Join(dir, "nonexistent"), Options{})
+	assert.NotNil(t, err)
+}
+
+func port(addr string) string {
+	_, p, _ := net.SplitHostPort(addr)
+	return p
+}
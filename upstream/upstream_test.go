@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -97,7 +99,11 @@ func TestUpstreamRace(t *testing.T) {
 }
 
 func TestTLSPoolReconnect(t *testing.T) {
-	u, err := AddressToUpstream("tls://one.one.one.one", Options{Bootstrap: []string{"8.8.8.8:53"}, Timeout: timeout})
+	srv := newTestDoTServer(t, "dns.corp")
+	defer srv.close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.port()))
+
+	u, err := AddressToUpstream("tls://"+addr+"?sni=dns.corp&insecure=true", Options{Timeout: timeout})
 	if err != nil {
 		t.Fatalf("cannot create upstream: %s", err)
 	}
@@ -110,11 +116,8 @@ func TestTLSPoolReconnect(t *testing.T) {
 	}
 	assertResponse(t, reply)
 
-	// Now let's close the pooled connection and return it back to the pool
-	p := u.(*dnsOverTLS)
-	conn, _ := p.pool.Get()
-	conn.Close()
-	p.pool.Put(conn)
+	// Now let's close the connection on the server side
+	srv.closeConns()
 
 	// Send the second test message
 	req = createTestMessage()
@@ -124,68 +127,9 @@ func TestTLSPoolReconnect(t *testing.T) {
 	}
 	assertResponse(t, reply)
 
-	// Now assert that the number of connections in the pool is not changed
-	if len(p.pool.conns) != 1 {
-		t.Fatal("wrong number of pooled connections")
-	}
-}
-
-func TestTLSPoolDeadLine(t *testing.T) {
-	// Create TLS upstream
-	u, err := AddressToUpstream("tls://one.one.one.one", Options{Bootstrap: []string{"8.8.8.8:53"}, Timeout: timeout})
-	if err != nil {
-		t.Fatalf("cannot create upstream: %s", err)
-	}
-
-	// Send the first test message
-	req := createTestMessage()
-	response, err := u.Exchange(req)
-	if err != nil {
-		t.Fatalf("first DNS message failed: %s", err)
-	}
-	assertResponse(t, response)
-
-	p := u.(*dnsOverTLS)
-
-	// Now let's get connection from the pool and use it
-	conn, err := p.pool.Get()
-	if err != nil {
-		t.Fatalf("couldn't get connection from pool: %s", err)
-	}
-	response, err = p.exchangeConn(conn, req)
-	if err != nil {
-		t.Fatalf("first DNS message failed: %s", err)
-	}
-	assertResponse(t, response)
-
-	// Update connection's deadLine and put it back to the pool
-	err = conn.SetDeadline(time.Now().Add(10 * time.Hour))
-	if err != nil {
-		t.Fatalf("can't set new deadLine for connection. Looks like it's already closed: %s", err)
-	}
-	p.pool.Put(conn)
-
-	// Get connection from the pool and reuse it
-	conn, err = p.pool.Get()
-	if err != nil {
-		t.Fatalf("couldn't get connection from pool: %s", err)
-	}
-	response, err = p.exchangeConn(conn, req)
-	if err != nil {
-		t.Fatalf("first DNS message failed: %s", err)
-	}
-	assertResponse(t, response)
-
-	// Set connection's deadLine to the past and try to reuse it
-	err = conn.SetDeadline(time.Now().Add(-10 * time.Hour))
-	if err != nil {
-		t.Fatalf("can't set new deadLine for connection. Looks like it's already closed: %s", err)
-	}
-
-	// Connection with expired deadLine can't be used
-	response, err = p.exchangeConn(conn, req)
-	if err == nil {
-		t.Fatalf("this connection should be already closed, got response %s", response)
+	// Now assert that a single new connection has been dialed
+	if total, _ := srv.handshakes(); total != 2 {
+		t.Fatalf("wrong number of connections: %d", total)
 	}
 }
 
@@ -260,7 +204,7 @@ func TestDialContext(t *testing.T) {
 		},
 	}
 	for _, test := range resolved {
-		dialContext := createDialContext(test.addresses, 2*time.Second)
+		dialContext := createDialContext(test.addresses, bindOptions{}.dialContext(2*time.Second), false)
 		_, err := dialContext(context.TODO(), "tcp", "")
 		if err != nil {
 			t.Fatalf("Couldn't dial to %s: %s", test.host, err)
@@ -543,3 +487,81 @@ func assertResponse(t *testing.T, reply *dns.Msg) {
 		t.Fatalf("DNS upstream returned wrong answer type instead of A: %v", reply.Answer[0])
 	}
 }
+
+func TestPlainExchangeContext(t *testing.T) {
+	// the server never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer conn.Close()
+
+	u, err := AddressToUpstream(conn.LocalAddr().String(), Options{Timeout: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = ExchangeContext(ctx, u, createTestMessage())
+	if err != context.DeadlineExceeded {
+		t.Fatalf("the exchange must have been cancelled: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the exchange took too long: %v", elapsed)
+	}
+}
+
+func TestUpstreamURLOptions(t *testing.T) {
+	u, err := AddressToUpstream("tls://1.2.3.4?sni=dns.corp&timeout=2s&weight=5&insecure=1&bootstrap=8.8.8.8,1.1.1.1", Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	dot, ok := u.(*dnsOverTLS)
+	if !ok {
+		t.Fatalf("wrong upstream type: %T", u)
+	}
+	if dot.Address() != "1.2.3.4:853" || dot.Weight() != 5 || dot.boot.timeout != 2*time.Second || len(dot.boot.resolvers) != 2 {
+		t.Fatalf("wrong upstream options: %s %d %s %d", dot.Address(), dot.Weight(), dot.boot.timeout, len(dot.boot.resolvers))
+	}
+	tlsConfig, _, err := dot.boot.get()
+	if err != nil {
+		t.Fatalf("cannot bootstrap: %s", err)
+	}
+	if tlsConfig.ServerName != "dns.corp" || !tlsConfig.InsecureSkipVerify {
+		t.Fatalf("wrong TLS config: %s %v", tlsConfig.ServerName, tlsConfig.InsecureSkipVerify)
+	}
+
+	// the unknown parameters are kept
+	u, err = AddressToUpstream("https://dns.example.org/dns-query?timeout=1s&id=1", Options{})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	if u.Address() != "https://dns.example.org:443/dns-query?id=1" || u.(*dnsOverHTTPS).boot.timeout != time.Second {
+		t.Fatalf("wrong upstream options: %s", u.Address())
+	}
+
+	u, err = AddressToUpstream("tcp://8.8.8.8?timeout=3s&weight=2&max_conns=8&idle_timeout=1m", Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	if p := u.(*plainDNS); p.address != "8.8.8.8:53" || p.timeout != 3*time.Second || p.Weight() != 2 || !p.preferTCP ||
+		p.maxConns != 8 || p.idleTimeout != time.Minute {
+		t.Fatalf("wrong upstream options: %s %s %d", p.address, p.timeout, p.Weight())
+	}
+
+	_, err = AddressToUpstream("tls://1.2.3.4?timeout=abc", Options{})
+	if err == nil {
+		t.Fatalf("invalid timeout must not be accepted")
+	}
+
+	// the unknown parameters are invalid unless they belong to the path
+	for _, address := range []string{"tls://1.2.3.4?timout=1s", "tcp://8.8.8.8?max_con=8", "udp://8.8.8.8?id=1"} {
+		_, err = AddressToUpstream(address, Options{})
+		if err == nil || !strings.Contains(err.Error(), "unknown option") {
+			t.Fatalf("unknown option must not be accepted in %s: %v", address, err)
+		}
+	}
+}